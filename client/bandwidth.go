@@ -0,0 +1,127 @@
+package client
+
+import (
+	"sync/atomic"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+)
+
+// Every Datastore access the client makes goes through the functions below, which count the
+// bytes moved in each direction. Each User operation records what it moved, so callers can check
+// that an operation costs what the design says it should: appending, sharing and accepting a
+// share shouldn't cost more as files get longer or are shared more widely. The counts cover the
+// whole process, so operations running at the same time in other sessions show up in each
+// other's counts.
+
+// Bandwidth is how many bytes an operation read from and wrote to the Datastore.
+type Bandwidth struct {
+	Read    int
+	Written int
+}
+
+// Total is the number of bytes moved either way, which is what userlib.DatastoreGetBandwidth
+// counts too.
+func (usage Bandwidth) Total() int {
+	return usage.Read + usage.Written
+}
+
+// BandwidthReport, if set, is called after every User operation with what it cost.
+var BandwidthReport func(username string, operation string, usage Bandwidth)
+
+var bytesRead, bytesWritten int64
+
+func currentBandwidth() Bandwidth {
+	return Bandwidth{Read: int(atomic.LoadInt64(&bytesRead)), Written: int(atomic.LoadInt64(&bytesWritten))}
+}
+
+func datastoreGet(key userlib.UUID) ([]byte, bool) {
+	value, ok := userlib.DatastoreGet(key)
+	atomic.AddInt64(&bytesRead, int64(len(value)))
+	return value, ok
+}
+
+func datastoreSet(key userlib.UUID, value []byte) {
+	atomic.AddInt64(&bytesWritten, int64(len(value)))
+	userlib.DatastoreSet(key, value)
+}
+
+func datastoreDelete(key userlib.UUID) {
+	userlib.DatastoreDelete(key)
+}
+
+func multiGet(keys []userlib.UUID) map[userlib.UUID][]byte {
+	if len(keys) == 0 {
+		return map[userlib.UUID][]byte{}
+	}
+	values := DatastoreMultiGet(keys)
+	for _, value := range values {
+		atomic.AddInt64(&bytesRead, int64(len(value)))
+	}
+	return values
+}
+
+func multiSet(entries map[userlib.UUID][]byte) {
+	if len(entries) == 0 {
+		return
+	}
+	for _, value := range entries {
+		atomic.AddInt64(&bytesWritten, int64(len(value)))
+	}
+	DatastoreMultiSet(entries)
+}
+
+func multiDelete(keys []userlib.UUID) {
+	if len(keys) == 0 {
+		return
+	}
+	DatastoreMultiDelete(keys)
+}
+
+// compareAndSwap counts the value it compares against as read, since the backend has to read
+// the key to compare it
+func compareAndSwap(key userlib.UUID, old []byte, value []byte) bool {
+	swapped := DatastoreCompareAndSwap(key, old, value)
+	atomic.AddInt64(&bytesRead, int64(len(old)))
+	if swapped {
+		atomic.AddInt64(&bytesWritten, int64(len(value)))
+	}
+	return swapped
+}
+
+// record stores what an operation that started at start cost in the user's session
+func (userdata *User) record(operation string, start Bandwidth) {
+	end := currentBandwidth()
+	usage := Bandwidth{Read: end.Read - start.Read, Written: end.Written - start.Written}
+	userdata.bandwidthLock.Lock()
+	userdata.lastBandwidth = usage
+	userdata.bandwidthLock.Unlock()
+	if BandwidthReport != nil {
+		BandwidthReport(userdata.Username, operation, usage)
+	}
+}
+
+// measure starts measuring an operation and returns the function that finishes it, bringing
+// the session's keys up to date first. Everything it needs is kept in the returned function, so
+// operations running at the same time on one session each record their own cost. Operations
+// that do another operation's work call its unexported form, so nothing is counted twice.
+func (userdata *User) measure(operation string) func() {
+	if userdata == nil {
+		return func() {}
+	}
+	start := currentBandwidth()
+	_ = userdata.loadEpoch()
+	return func() {
+		userdata.record(operation, start)
+	}
+}
+
+// LastBandwidth reports what the most recent operation of this session read from and wrote to
+// the Datastore, including InitUser or GetUser for a session that hasn't done anything else yet.
+func (userdata *User) LastBandwidth() Bandwidth {
+	if userdata == nil {
+		return Bandwidth{}
+	}
+	userdata.bandwidthLock.Lock()
+	defer userdata.bandwidthLock.Unlock()
+	return userdata.lastBandwidth
+}
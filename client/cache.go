@@ -0,0 +1,205 @@
+package client
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// A session can keep the data nodes it has verified, so that reading a file again only downloads
+// its filestruct and header to see whether anything changed. Data nodes never change once they
+// are written, so a node that was verified under a given key and counter can be trusted for as
+// long as the header still points at it. Cached nodes are grouped by the file's header address
+// and its Version: appending keeps the version, so only the new nodes are fetched, while
+// StoreFile starts a new version and the old version's nodes are dropped. Revocation moves the
+// header to a new address, which leaves the old group to fall out of the cache.
+//
+// Optionally the cache is also kept on disk, so a later session can use it too. Every cached
+// node is encrypted and MACed with keys derived from the user's own, and a file that fails to
+// verify is ignored and read from the Datastore again.
+
+type cachekey struct {
+	File    uuid.UUID
+	Version int
+	Address uuid.UUID
+	Counter int
+}
+
+type cachedblock struct {
+	// the MAC key the node was verified with, in case a file's keys ever change under a version
+	Mac   []byte
+	Prev  uuid.UUID
+	Block []byte
+
+	// the hash of the node's ciphertext, for checking the header's digest
+	Hash []byte `json:",omitempty" since:"5"`
+}
+
+type cacheentry struct {
+	key   cachekey
+	block cachedblock
+}
+
+type blockcache struct {
+	lock     sync.Mutex
+	limit    int
+	entries  map[cachekey]*list.Element
+	order    *list.List
+	versions map[uuid.UUID]int
+
+	dir    string
+	encKey []byte
+	macKey []byte
+}
+
+// EnableCache makes the session cache up to limit verified data nodes in memory. If dir isn't
+// empty, nodes are also kept as files in that directory, where later sessions of the same user
+// can find them.
+func (userdata *User) EnableCache(limit int, dir string) error {
+	if userdata == nil || userdata.FilestructMac == nil || userdata.FilestructEnc == nil || limit <= 0 {
+		return errors.New(strings.ToTitle("ERROR"))
+	}
+	cache := blockcache{
+		limit:    limit,
+		entries:  make(map[cachekey]*list.Element),
+		order:    list.New(),
+		versions: make(map[uuid.UUID]int),
+		dir:      dir,
+	}
+	if dir != "" {
+		err := os.MkdirAll(dir, 0700)
+		if err != nil {
+			return err
+		}
+		encKey, err := userlib.HashKDF(userdata.FilestructEnc, []byte("cache-enc"))
+		if err != nil {
+			return errors.New(strings.ToTitle("ERROR"))
+		}
+		macKey, err := userlib.HashKDF(userdata.FilestructMac, []byte("cache-mac"))
+		if err != nil {
+			return errors.New(strings.ToTitle("ERROR"))
+		}
+		cache.encKey = encKey[:16]
+		cache.macKey = macKey[:16]
+	}
+	userdata.cache = &cache
+	return nil
+}
+
+// DisableCache forgets everything the session cached in memory. Files on disk are left alone.
+func (userdata *User) DisableCache() {
+	if userdata != nil {
+		userdata.cache = nil
+	}
+}
+
+// prefix names the disk files of one version of a file without revealing which file it is
+func (cache *blockcache) prefix(file uuid.UUID, version int) string {
+	hashed, _ := userlib.HMACEval(cache.macKey, []byte(file.String()+"/"+strconv.Itoa(version)))
+	return hex.EncodeToString(hashed[:16])
+}
+
+func (cache *blockcache) path(key cachekey) string {
+	hashed, _ := userlib.HMACEval(cache.macKey, []byte(key.Address.String()+"/"+strconv.Itoa(key.Counter)))
+	return filepath.Join(cache.dir, cache.prefix(key.File, key.Version)+"-"+hex.EncodeToString(hashed[:16]))
+}
+
+// check drops the nodes of any other version of the file than the one the header is at
+func (cache *blockcache) check(file uuid.UUID, version int) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	old, ok := cache.versions[file]
+	cache.versions[file] = version
+	if !ok || old == version {
+		return
+	}
+	for element := cache.order.Front(); element != nil; {
+		next := element.Next()
+		entry := element.Value.(cacheentry)
+		if entry.key.File == file && entry.key.Version != version {
+			cache.order.Remove(element)
+			delete(cache.entries, entry.key)
+		}
+		element = next
+	}
+	if cache.dir != "" {
+		stale, _ := filepath.Glob(filepath.Join(cache.dir, cache.prefix(file, old)+"-*"))
+		for _, name := range stale {
+			_ = os.Remove(name)
+		}
+	}
+}
+
+func (cache *blockcache) get(key cachekey, mac []byte) *cachedblock {
+	var block cachedblock
+	// remember can replace the element's value at any time, so it is copied under the lock
+	cache.lock.Lock()
+	element, ok := cache.entries[key]
+	if ok {
+		cache.order.MoveToFront(element)
+		block = element.Value.(cacheentry).block
+	}
+	cache.lock.Unlock()
+	if !ok {
+		if cache.dir == "" {
+			return nil
+		}
+		ciphertext, err := os.ReadFile(cache.path(key))
+		if err != nil {
+			return nil
+		}
+		plaintext, err := VerifyDec(ciphertext, cache.encKey, cache.macKey)
+		if err != nil {
+			return nil
+		}
+		err = unmarshalObject(plaintext, &block)
+		if err != nil {
+			return nil
+		}
+		cache.remember(key, block)
+	}
+	if !bytes.Equal(block.Mac, mac) {
+		return nil
+	}
+	return &block
+}
+
+func (cache *blockcache) put(key cachekey, block cachedblock) {
+	cache.remember(key, block)
+	if cache.dir == "" {
+		return
+	}
+	plaintext, err := marshalObject(block)
+	if err != nil {
+		return
+	}
+	// the cache is only an optimization, so failing to write it is not an error
+	_ = os.WriteFile(cache.path(key), EncMacGen(plaintext, cache.encKey, cache.macKey), 0600)
+}
+
+// remember keeps a node in memory, evicting the least recently used ones over the limit
+func (cache *blockcache) remember(key cachekey, block cachedblock) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	element, ok := cache.entries[key]
+	if ok {
+		element.Value = cacheentry{key: key, block: block}
+		cache.order.MoveToFront(element)
+		return
+	}
+	cache.entries[key] = cache.order.PushFront(cacheentry{key: key, block: block})
+	for cache.order.Len() > cache.limit {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(cacheentry).key)
+	}
+}
@@ -1,10 +1,14 @@
 package client
 
 import (
+	"bytes"
 	"encoding/json"
 	userlib "github.com/cs161-staff/project2-userlib"
 	"github.com/google/uuid"
+	"sort"
 	"strconv"
+	"sync"
+	"time"
 
 	// hex.EncodeToString(...) is useful for converting []byte to string
 
@@ -27,6 +31,10 @@ import (
 
 const blocksize = 10
 
+// how many times StoreFile and AppendToFile start over when another session changes the file
+// underneath them
+const swapAttempts = 5
+
 type User struct {
 	Username string
 
@@ -35,34 +43,154 @@ type User struct {
 	SharePublicKeySign  userlib.DSVerifyKey
 	SharePrivateKeySign userlib.DSSignKey
 
-	FilestructEnc []byte
-	FilestructMac []byte
-	SharetreeEnc  []byte
-	SharetreeMac  []byte
+	// the account's root keys, which only sessions logged in with the password hold
+	AccountEnc []byte
+	AccountMac []byte
+
+	// the keys the user's own state is kept under in the current epoch (see epochs.go). They
+	// aren't stored, since they change whenever a device is removed.
+	FilestructEnc []byte `json:"-"`
+	FilestructMac []byte `json:"-"`
+	SharetreeEnc  []byte `json:"-"`
+	SharetreeMac  []byte `json:"-"`
+	epoch         int
+	epochLock     sync.Mutex
+
+	// set in sessions created by AddDevice, which hold the device's private keys instead of the
+	// account's (see devices.go)
+	Device        uuid.UUID
+	DeviceKeyEnc  userlib.PKEDecKey
+	DeviceKeySign userlib.DSSignKey
+
+	// identifies this login for file leases; it isn't stored, so every session gets its own
+	session uuid.UUID
+
+	// what the last operation cost
+	bandwidthLock sync.Mutex
+	lastBandwidth Bandwidth
+
+	// verified data nodes, if the session keeps them (see cache.go)
+	cache *blockcache
 }
 
+// RootEnc and RootMac are the file key. They only protect the header at First, which holds the
+// content keys for everything else, so revoking access just means moving the header to a new
+// file key.
 type filestruct struct {
 	RootEnc []byte
 	RootMac []byte
 	First   userlib.UUID
+
+	// Owner is copied into every shared filestruct so recipients can tell who owns the file.
+	// Shares records the invitations made by recipients of this copy (sub-shares), since
+	// only the owner can write to the sharetree.
+	Owner  string
+	Shares []accessrecord
+
+	// set on a recipient's copy when they decline the invitation it came with
+	Declined bool `json:",omitempty" since:"4"`
+}
+
+// The header is the only part of a file that is ever rewritten. Data nodes hold exactly blocksize
+// bytes and never change once written; each one links back to the node before it, and whatever
+// is left over at the end of the file waits in Buffer until a full node can be written.
+//
+// Version counts the StoreFile calls that produced the current content, which was written by
+// SavedBy at Saved. Versions lists the snapshots of earlier content kept around, oldest first,
+// and Retain is how many of them to keep. Garbage lists content nobody can reach anymore that
+// hasn't been deleted yet. Domain is set when the file's content is deduplicated, and Holder
+// is this header's reference to the tail in that case. Compress says whether the content is
+// compressed the next time it is stored. Segment is the newest group of nodes that can be
+// fetched at once.
+//
+// Digest covers the ciphertext of every data node in order. The content keys of old nodes stay
+// the same when access is revoked, so without it a revoked user could replace a node with one of
+// their own that verifies just as well; with it, readers check the nodes against the header,
+// which the revoked user can no longer change. Headers from before it existed have none, and
+// their nodes are only checked against their keys until the file is next stored.
+type fileheader struct {
+	Keys   []contentkey
+	Count  int
+	Tail   userlib.UUID
+	Buffer []byte
+
+	Version  int
+	Saved    time.Time
+	SavedBy  string
+	Versions []version `json:",omitempty"`
+	Retain   int
+	Garbage  []garbage `json:",omitempty"`
+
+	Domain   *contentkey `json:",omitempty"`
+	Holder   uuid.UUID
+	Compress bool `json:",omitempty"`
+
+	Segment *segment `json:",omitempty" since:"2"`
+
+	// set once a revocation has copied the header to its new address, so that writers start over
+	// from their filestruct instead of changing a header that is about to be deleted
+	Moved bool `json:",omitempty" since:"3"`
+
+	Digest []byte `json:",omitempty" since:"5"`
+}
+
+// data node i is encrypted with keys derived from the latest contentkey whose Start <= i. Nodes
+// written with a Dedup key are stored at addresses derived from their content (see dedup.go),
+// and nodes written with a Compressed key hold compressed blocks (see compress.go).
+type contentkey struct {
+	Start      int
+	Enc        []byte
+	Mac        []byte
+	Dedup      bool `json:",omitempty"`
+	Compressed bool `json:",omitempty"`
 }
 
 type filenode struct {
-	Lastcounter int
-	Last        userlib.UUID
-	Next        userlib.UUID
-	Data        []byte
+	Prev userlib.UUID
+	Data []byte
 }
 
 type sharestruct struct {
 	F userlib.UUID
 	E []byte
 	M []byte
+
+	// only set on the recipient's own copy, never inside the invitation itself
+	Sender string `json:",omitempty"`
+
+	// set instead of E and M when the file was shared with a group; the keys come from the
+	// recipient's membership in the group
+	Group      string `json:",omitempty"`
+	GroupOwner string `json:",omitempty"`
 }
 
 type sharetree struct {
-	Sharemap map[string]uuid.UUID
-	Filemap  map[uuid.UUID][][]byte
+	Sharemap  map[string]uuid.UUID
+	Filemap   map[uuid.UUID][][]byte
+	Accessmap map[string]accessrecord
+}
+
+type accessrecord struct {
+	Recipient string
+	InvitedBy string
+	Invited   time.Time
+
+	// on sub-share records, InvitedBy's signature over the record and the filestruct it is in
+	Signature []byte `json:",omitempty" since:"4"`
+}
+
+// permission levels reported by ListAccess
+const (
+	PermissionOwner     = "owner"
+	PermissionReadWrite = "read-write"
+)
+
+// AccessEntry describes one user's access to a file.
+type AccessEntry struct {
+	Recipient  string
+	InvitedBy  string
+	Invited    time.Time
+	Permission string
 }
 
 // add byte arrays together
@@ -105,6 +233,9 @@ func EncMacGen(content []byte, symkey []byte, mackey []byte) []byte {
 }
 
 func VerifyDec(ciphertext []byte, symkey []byte, mackey []byte) (__ []byte, err error) {
+	if len(ciphertext) < userlib.AESBlockSizeBytes+64 {
+		return nil, errors.New(strings.ToTitle("invalid"))
+	}
 	hmac := ciphertext[len(ciphertext)-64:]
 	encrypted := ciphertext[:len(ciphertext)-64]
 	newHmac, err := userlib.HMACEval(mackey, encrypted)
@@ -117,11 +248,15 @@ func VerifyDec(ciphertext []byte, symkey []byte, mackey []byte) (__ []byte, err
 }
 
 func InitUser(username string, password string) (userdataptr *User, err error) {
+	start := currentBandwidth()
 	if username == "" {
 		return nil, errors.New(strings.ToTitle("username cannot be empty"))
 	}
+	if strings.HasPrefix(username, GroupPrefix) {
+		return nil, errors.New(strings.ToTitle("username cannot start with " + GroupPrefix))
+	}
 	userkey, err := uuid.FromBytes(userlib.Hash([]byte(username))[:16])
-	_, ok := userlib.DatastoreGet(userkey)
+	_, ok := datastoreGet(userkey)
 	if ok {
 		return nil, errors.New(strings.ToTitle("username already exists"))
 	}
@@ -144,17 +279,17 @@ func InitUser(username string, password string) (userdataptr *User, err error) {
 		SharePublicKeySign:  pk2,
 		SharePrivateKeySign: sk2,
 
-		FilestructEnc: userlib.RandomBytes(16),
-		FilestructMac: userlib.RandomBytes(16),
-		SharetreeEnc:  userlib.RandomBytes(16),
-		SharetreeMac:  userlib.RandomBytes(16),
+		AccountEnc: userlib.RandomBytes(16),
+		AccountMac: userlib.RandomBytes(16),
+
+		session: uuid.New(),
 	}
 
 	// may need to make sure key reuse is not implicit in the following:
 	// could mac it with just the password, and encrypt/decrypt with the user-passkey combo to change it up a little
 
 	enckey := userpasskeyGen(username, password)
-	userbytes, err := json.Marshal(userdata)
+	userbytes, err := json.Marshal(&userdata)
 	usercipher := EncMacGen(userbytes, enckey, enckey)
 
 	// currently have 4 sets of public-private key pairs, so we need to set all the below:
@@ -166,11 +301,35 @@ func InitUser(username string, password string) (userdataptr *User, err error) {
 	if err != nil {
 		return nil, err
 	}
-	userlib.DatastoreSet(userkey, usercipher)
+	err = registerKeys(username, 1, pk1, pk2)
+	if err != nil {
+		return nil, err
+	}
+	err = userdata.startEpochs()
+	if err != nil {
+		return nil, err
+	}
+	err = userdata.initPins()
+	if err != nil {
+		return nil, err
+	}
+	err = userdata.initKeylogHead()
+	if err != nil {
+		return nil, err
+	}
+	datastoreSet(userkey, usercipher)
 
+	// seeing the registration in the log also records the log's head for later
+	_, err = userdata.peerKeys(username)
+	if err != nil {
+		return nil, err
+	}
+
+	userdata.record("InitUser", start)
 	return &userdata, nil
 }
 func GetUser(username string, password string) (userdataptr *User, err error) {
+	start := currentBandwidth()
 
 	var userdata User
 	userdataptr = &userdata
@@ -180,7 +339,7 @@ func GetUser(username string, password string) (userdataptr *User, err error) {
 	}
 
 	userkey, err := uuid.FromBytes(userlib.Hash([]byte(username))[:16])
-	ciphertext, ok := userlib.DatastoreGet(userkey)
+	ciphertext, ok := datastoreGet(userkey)
 	if !ok {
 		return nil, errors.New(strings.ToTitle("there is no initialized user for the given username"))
 	}
@@ -195,273 +354,203 @@ func GetUser(username string, password string) (userdataptr *User, err error) {
 	}
 	var udata User
 	err = json.Unmarshal(user, &udata)
+	udata.session = uuid.New()
+	err = udata.loadEpoch()
+	if err != nil {
+		return nil, err
+	}
+
+	// finish publishing any keys a rotation was interrupted in the middle of, before they are
+	// checked against the key log below
+	_ = udata.resumeRotation()
+
+	// the Keystore and the key log must still hold the user's own keys, or someone else's keys
+	// are being shown to others in their name
+	_, err = udata.peerKeys(username)
+	if err != nil {
+		return nil, err
+	}
+
+	// finish any revocation a session was interrupted in the middle of, and any transfer of the
+	// user's files accepted since their last session. Failing here shouldn't stop the user from
+	// logging in; RevokeAccess will try again and report the error.
+	_ = udata.resumeRevocations()
+	_ = udata.resumeHandoffs()
+	udata.record("GetUser", start)
 	return &udata, nil
 }
 
 func (userdata *User) StoreFile(filename string, content []byte) (err error) {
+	defer userdata.measure("StoreFile")()
+	return userdata.storeFile(filename, content)
+}
+
+// storeFile is StoreFile for operations that store a file as part of what they do, so the
+// store isn't measured on its own
+func (userdata *User) storeFile(filename string, content []byte) (err error) {
 	if userdata == nil || userdata.Username == "" || userdata.FilestructMac == nil || userdata.FilestructEnc == nil {
 		return errors.New(strings.ToTitle("ERROR"))
 	}
 	// storageKey, err := uuid.FromBytes(userlib.Hash([]byte(filename + userdata.Username))[:16])
 	storageKey := filestructKeyGen(userdata.Username, filename)
-	_, exists := userlib.DatastoreGet(storageKey)
-	var rootMac []byte
-	var rootEnc []byte
+	_, exists := datastoreGet(storageKey)
 	var curfilestruct filestruct
 	if exists {
 		curfilepointer, _ := userdata.loadFileStruct(filename)
 		if curfilepointer == nil {
 			exists = false
+		} else {
+			curfilestruct = *curfilepointer
+			err = userdata.checkLease(curfilestruct)
+			if err != nil {
+				return err
+			}
 		}
 	}
-	if exists {
-		curfilepointer, _ := userdata.loadFileStruct(filename)
-		if curfilepointer == nil {
-			return errors.New(strings.ToTitle("ERROR"))
+	if !exists {
+		curfilestruct = filestruct{
+			RootEnc: userlib.RandomBytes(16),
+			RootMac: userlib.RandomBytes(16),
+			First:   uuid.New(),
+			Owner:   userdata.Username,
 		}
-		curfilestruct = *curfilepointer
-		rootEnc = curfilestruct.RootEnc
-		rootMac = curfilestruct.RootMac
-	} else {
-		rootEnc = userlib.RandomBytes(16)
-		rootMac = userlib.RandomBytes(16)
 	}
 
-	// do the firstnode first:
-	end := blocksize
-	if end > len(content) {
-		end = len(content)
-	}
-	slice := content[0:end]
-	firstNode := filenode{
-		Data: slice,
-	}
-	firstUUID := uuid.New()
-	if exists {
-		firstUUID = curfilestruct.First
-	}
-	var prevUUID uuid.UUID
-	var prevNode filenode
-	counter := 0
-	for i := blocksize; i < len(content); i += blocksize {
-		end := i + blocksize
-		if end > len(content) {
-			end = len(content)
-		}
-		slice := content[i:end]
-		macKey, err := userlib.HashKDF(rootMac, []byte("mac-key"+strconv.Itoa(counter)))
-		if err != nil {
-			return errors.New(strings.ToTitle("ERROR"))
-		}
-		symKey, err := userlib.HashKDF(rootEnc, []byte("enc-key"+strconv.Itoa(counter)))
-		if err != nil {
-			return errors.New(strings.ToTitle("ERROR"))
+	// overwriting starts over with a fresh content key, so users who lost access can't read the
+	// new content even if they kept the old keys. What was there before is kept as a snapshot.
+	swapped := false
+	for attempt := 0; attempt < swapAttempts && !swapped; attempt++ {
+		if exists && attempt > 0 {
+			// a revocation may have moved the header since the last attempt
+			curfilepointer, _ := userdata.loadFileStruct(filename)
+			if curfilepointer != nil {
+				curfilestruct = *curfilepointer
+			}
 		}
-		newnode := filenode{
-			Data: slice,
+		header := fileheader{
+			Keys:    []contentkey{newContentKey(0)},
+			Digest:  emptyDigest(),
+			Version: 1,
+			Saved:   time.Now(),
+			SavedBy: userdata.Username,
+			Retain:  DefaultVersionRetention,
 		}
-		if counter > 0 {
-			curaddress := uuid.New()
-			prevNode.Next = curaddress
-			byteform, _ := json.Marshal(prevNode)
-			block := EncMacGen(byteform, symKey[:16], macKey[:16])
-			userlib.DatastoreSet(prevUUID, block)
-			prevUUID = curaddress
-		} else {
-			prevUUID = uuid.New()
-			firstNode.Next = prevUUID
+		var old []byte
+		var taken *version
+		if exists {
+			var previous *fileheader
+			previous, old = readFileHeader(curfilestruct)
+			if previous != nil {
+				header.Version = previous.Version + 1
+				header.Retain = previous.Retain
+				header.Versions = previous.Versions
+				header.Garbage = previous.Garbage
+				if previous.Domain != nil {
+					header.Domain = previous.Domain
+					header.Keys = []contentkey{*previous.Domain}
+				}
+				header.Compress = previous.Compress
+				header.Keys[0].Compressed = previous.Compress
+				if header.Retain > 0 {
+					taken, err = previous.snapshot()
+					if err != nil {
+						return err
+					}
+					header.Versions = append(header.Versions, *taken)
+				} else {
+					header.Garbage = append(header.Garbage, previous.chain())
+				}
+				var dropped []version
+				header.Versions, dropped = header.trimVersions()
+				header.discard(dropped)
+			}
 		}
-		prevNode = newnode
-		counter += 1
-	}
-
-	// encrypt then mac the last block
-	if counter != 0 {
-		lastMac, err := userlib.HashKDF(rootMac, []byte("mac-key"+strconv.Itoa(counter)))
+		written, err := header.appendNodes(content)
 		if err != nil {
-			return errors.New(strings.ToTitle("ERROR"))
+			return err
 		}
-		lastSym, err := userlib.HashKDF(rootEnc, []byte("enc-key"+strconv.Itoa(counter)))
+		swapped, err = swapFileHeader(curfilestruct, old, header)
 		if err != nil {
-			return errors.New(strings.ToTitle("ERROR"))
+			return err
+		}
+		if !swapped {
+			// throw away everything written for this attempt
+			if taken != nil {
+				datastoreDelete(taken.Address)
+			}
+			header.rollback(written)
+			continue
 		}
-		prevNode.Next = uuid.Nil
-		byteform, _ := json.Marshal(prevNode)
-		block := EncMacGen(byteform, lastSym[:16], lastMac[:16])
-		userlib.DatastoreSet(prevUUID, block)
-	}
-
-	// encrypt then mac the first block
-	firstMac, err := userlib.HashKDF(rootMac, []byte("mac-key"+strconv.Itoa(0)))
-	if err != nil {
-		return errors.New(strings.ToTitle("ERROR"))
-	}
-	firstSym, err := userlib.HashKDF(rootEnc, []byte("enc-key"+strconv.Itoa(0)))
-	if err != nil {
-		return errors.New(strings.ToTitle("ERROR"))
 	}
-	firstNode.Lastcounter = counter
-	if counter == 0 {
-		firstNode.Last = firstUUID
-	} else {
-		firstNode.Last = prevUUID
+	if !swapped {
+		return errors.New(strings.ToTitle("file is being changed by another session, try again"))
 	}
-	byteform, _ := json.Marshal(firstNode)
-	block := EncMacGen(byteform, firstSym[:16], firstMac[:16])
-	userlib.DatastoreSet(firstUUID, block)
+	// the new content is in place either way; anything left over stays listed for next time
+	_ = collectGarbage(curfilestruct)
 
 	// put the filestruct in the Datastore
-
-	var toStore []byte
 	if exists {
-		return
-	}
-	curstruct := filestruct{
-		RootEnc: rootEnc,
-		RootMac: rootMac,
-		First:   firstUUID,
+		return nil
 	}
-	filestructBytes, err := json.Marshal(curstruct)
+	filestructBytes, err := marshalObject(curfilestruct)
 	if err != nil {
 		return errors.New(strings.ToTitle("ERROR"))
 	}
-	toStore = EncMacGen(filestructBytes, userdata.FilestructEnc, userdata.FilestructMac)
-	userlib.DatastoreSet(storageKey, toStore)
-	return
+	toStore := EncMacGen(filestructBytes, userdata.FilestructEnc, userdata.FilestructMac)
+	datastoreSet(storageKey, toStore)
+	return userdata.updateNamespace(filename, true)
 }
 
+// Only the header and the nodes being added are downloaded or uploaded, so the cost of an append
+// doesn't depend on the length of the file.
+//
+// The new nodes are written to fresh addresses and only become part of the file once the header
+// is swapped in, and the swap fails if another session changed the header in the meantime. In
+// that case the nodes are thrown away and the append starts over from the new header.
 func (userdata *User) AppendToFile(filename string, content []byte) error {
+	defer userdata.measure("AppendToFile")()
 	if userdata == nil || userdata.Username == "" || userdata.FilestructMac == nil || userdata.FilestructEnc == nil {
 		return errors.New(strings.ToTitle("ERROR"))
 	}
-	pointer, _ := userdata.loadFileStruct(filename)
-	if pointer == nil {
-		return errors.New(strings.ToTitle("File access not granted"))
-	}
-	curFileStruct := *pointer
-	pointer2 := loadFileNode(curFileStruct.First, curFileStruct.RootMac, curFileStruct.RootEnc, 0)
-	if pointer2 == nil {
-		return errors.New(strings.ToTitle("File access not granted"))
-	}
-	firstNode := *pointer2
-	var lastNode filenode
-	if firstNode.Next == uuid.Nil {
-		lastNode = firstNode
-	} else {
-		pointer2 = loadFileNode(firstNode.Last, curFileStruct.RootMac, curFileStruct.RootEnc, firstNode.Lastcounter)
-		if pointer2 == nil {
+	for attempt := 0; attempt < swapAttempts; attempt++ {
+		pointer, _ := userdata.loadFileStruct(filename)
+		if pointer == nil {
 			return errors.New(strings.ToTitle("File access not granted"))
 		}
-		lastNode = *pointer2
-	}
-
-	// first we need to check if the current last node has more space to write
-	index := 0
-	if len(lastNode.Data) < blocksize {
-		end := blocksize - len(lastNode.Data)
-		if end > len(content) {
-			end = len(content)
-			// if this is the case then we don't need to write any more to end of file. find a way to make function
-			// return after this
-		}
-		slice := content[0:end]
-		index += len(slice)
-		lastNode.Data = concatenateByteArrays(lastNode.Data, slice)
-		// if len > 50: something is wrong with my code. if len < 50 that means that there is no more content to append
-		// and we don't need to create any new nodes
-		if len(lastNode.Data) > blocksize {
-			return errors.New(strings.ToTitle("need to fix implementation"))
-		} else if len(lastNode.Data) < blocksize {
-			lastMac, err := userlib.HashKDF(curFileStruct.RootMac, []byte("mac-key"+strconv.Itoa(firstNode.Lastcounter)))
-			if err != nil {
-				return errors.New(strings.ToTitle("ERROR"))
-			}
-			lastSym, err := userlib.HashKDF(curFileStruct.RootEnc, []byte("enc-key"+strconv.Itoa(firstNode.Lastcounter)))
-			if err != nil {
-				return errors.New(strings.ToTitle("ERROR"))
-			}
-			byteform, _ := json.Marshal(lastNode)
-			block := EncMacGen(byteform, lastSym[:16], lastMac[:16])
-			userlib.DatastoreSet(firstNode.Last, block)
-			return nil
-		}
-		if firstNode.Next == uuid.Nil {
-			firstNode = lastNode
+		curFileStruct := *pointer
+		err := userdata.checkLease(curFileStruct)
+		if err != nil {
+			return err
 		}
-	}
-
-	prevUUID := firstNode.Last
-	prevNode := lastNode
-	counter := firstNode.Lastcounter
-
-	for i := index; i < len(content); i += blocksize {
-		end := i + blocksize
-		if end > len(content) {
-			end = len(content)
+		header, old := readFileHeader(curFileStruct)
+		if header == nil {
+			return errors.New(strings.ToTitle("File access not granted"))
 		}
-		slice := content[i:end]
-		macKey, err := userlib.HashKDF(curFileStruct.RootMac, []byte("mac-key"+strconv.Itoa(counter)))
+		tail, holder := header.Tail, header.Holder
+		written, err := header.appendNodes(content)
 		if err != nil {
-			return errors.New(strings.ToTitle("ERROR"))
+			return err
 		}
-		symKey, err := userlib.HashKDF(curFileStruct.RootEnc, []byte("enc-key"+strconv.Itoa(counter)))
+		swapped, err := swapFileHeader(curFileStruct, old, *header)
 		if err != nil {
-			return errors.New(strings.ToTitle("ERROR"))
-		}
-		newnode := filenode{
-			Data: slice,
+			return err
 		}
-		curaddress := uuid.New()
-		prevNode.Next = curaddress
-		byteform, _ := json.Marshal(prevNode)
-		block := EncMacGen(byteform, symKey[:16], macKey[:16])
-		if prevUUID != curFileStruct.First {
-			userlib.DatastoreSet(prevUUID, block)
-		} else {
-			firstNode = prevNode
+		if swapped {
+			if len(written) > 0 {
+				header.release(header.Count-len(written)-1, tail, holder)
+			}
+			return nil
 		}
-		prevUUID = curaddress
-		counter += 1
-		prevNode = newnode
-	}
-
-	// write the last node to datastore
-	lastMac, err := userlib.HashKDF(curFileStruct.RootMac, []byte("mac-key"+strconv.Itoa(counter)))
-	if err != nil {
-		return errors.New(strings.ToTitle("ERROR"))
-	}
-	lastSym, err := userlib.HashKDF(curFileStruct.RootEnc, []byte("enc-key"+strconv.Itoa(counter)))
-	if err != nil {
-		return errors.New(strings.ToTitle("ERROR"))
+		header.rollback(written)
 	}
-	prevNode.Next = uuid.Nil
-	byteform, _ := json.Marshal(prevNode)
-	block := EncMacGen(byteform, lastSym[:16], lastMac[:16])
-	userlib.DatastoreSet(prevUUID, block)
-
-	// we need to rewrite firstNode to memory because we are updating info about the counter & the address
-	// of the last node
-	firstMac, err := userlib.HashKDF(curFileStruct.RootMac, []byte("mac-key"+strconv.Itoa(0)))
-	if err != nil {
-		return err
-	}
-	firstSym, err := userlib.HashKDF(curFileStruct.RootEnc, []byte("enc-key"+strconv.Itoa(0)))
-	if err != nil {
-		return err
-	}
-	firstNode.Lastcounter = counter
-	firstNode.Last = prevUUID
-	byteform, _ = json.Marshal(firstNode)
-	block = EncMacGen(byteform, firstSym[:16], firstMac[:16])
-	userlib.DatastoreSet(curFileStruct.First, block)
-	return nil
+	return errors.New(strings.ToTitle("file is being changed by another session, try again"))
 }
 
 // helper method to load filestruct struct from datastore
 func (userdata *User) loadFileStruct(filename string) (*filestruct, bool) {
 
 	storageKey := filestructKeyGen(userdata.Username, filename)
-	fileJSON, ok := userlib.DatastoreGet(storageKey)
+	fileJSON, ok := datastoreGet(storageKey)
 	if !ok {
 		return nil, false
 	}
@@ -471,20 +560,28 @@ func (userdata *User) loadFileStruct(filename string) (*filestruct, bool) {
 		return nil, false
 	}
 	var curFileStruct filestruct
-	err = json.Unmarshal(filestructBytes, &curFileStruct)
-	if err != nil {
+	err = unmarshalObject(filestructBytes, &curFileStruct)
+	if err != nil && err != errWrongType {
 		return nil, false
 	}
 	if curFileStruct.First == uuid.Nil && curFileStruct.RootMac == nil && curFileStruct.RootEnc == nil {
 		var curShareStruct sharestruct
-		err = json.Unmarshal(filestructBytes, &curShareStruct)
+		err = unmarshalObject(filestructBytes, &curShareStruct)
 		if err != nil {
 			return nil, true
 		}
 		if curShareStruct.F == uuid.Nil && curShareStruct.M == nil && curShareStruct.E == nil {
 			return nil, true
 		}
-		pointer := loadFileStruct2(curShareStruct.F, curShareStruct.E, curShareStruct.M)
+		encKey, macKey := curShareStruct.E, curShareStruct.M
+		if curShareStruct.Group != "" {
+			keys := userdata.loadGroupKey(curShareStruct.GroupOwner, curShareStruct.Group)
+			if keys == nil {
+				return nil, true
+			}
+			encKey, macKey = keys.Enc, keys.Mac
+		}
+		pointer := loadFileStruct2(curShareStruct.F, encKey, macKey)
 		if pointer == nil {
 			return nil, true
 		}
@@ -495,7 +592,7 @@ func (userdata *User) loadFileStruct(filename string) (*filestruct, bool) {
 
 // helper method to load filestruct struct from datastore
 func loadFileStruct2(storageKey uuid.UUID, encKey []byte, macKey []byte) *filestruct {
-	fileJSON, ok := userlib.DatastoreGet(storageKey)
+	fileJSON, ok := datastoreGet(storageKey)
 	if !ok {
 		return nil
 	}
@@ -505,33 +602,275 @@ func loadFileStruct2(storageKey uuid.UUID, encKey []byte, macKey []byte) *filest
 		return nil
 	}
 	var curFileStruct filestruct
-	err = json.Unmarshal(filestructBytes, &curFileStruct)
+	err = unmarshalObject(filestructBytes, &curFileStruct)
 	if err != nil {
 		return nil
 	}
 	return &curFileStruct
 }
 
+// changeSharedFileStruct applies change to a shared filestruct and swaps it in, so that changes
+// other recipients make at the same time aren't lost. change reports whether there is anything
+// to store.
+func changeSharedFileStruct(structUUID uuid.UUID, encKey []byte, macKey []byte, change func(curFileStruct *filestruct) bool) error {
+	for attempt := 0; attempt < swapAttempts; attempt++ {
+		old, ok := datastoreGet(structUUID)
+		if !ok {
+			return errors.New(strings.ToTitle("shared filestruct not found"))
+		}
+		filestructBytes, err := VerifyDec(old, encKey, macKey)
+		if err != nil {
+			return errors.New(strings.ToTitle("ERROR"))
+		}
+		var curFileStruct filestruct
+		err = unmarshalObject(filestructBytes, &curFileStruct)
+		if err != nil {
+			return errors.New(strings.ToTitle("ERROR"))
+		}
+		if !change(&curFileStruct) {
+			return nil
+		}
+		filestructBytes, err = marshalObject(curFileStruct)
+		if err != nil {
+			return errors.New(strings.ToTitle("ERROR"))
+		}
+		if compareAndSwap(structUUID, old, EncMacGen(filestructBytes, encKey, macKey)) {
+			return nil
+		}
+	}
+	return errors.New(strings.ToTitle("file access is being changed by another session, try again"))
+}
+
+// derive the enc and mac keys for a single node from a pair of root keys
+func nodeKeysGen(rootEnc []byte, rootMac []byte, counter int) ([]byte, []byte, error) {
+	macKey, err := userlib.HashKDF(rootMac, []byte("mac-key"+strconv.Itoa(counter)))
+	if err != nil {
+		return nil, nil, err
+	}
+	symKey, err := userlib.HashKDF(rootEnc, []byte("enc-key"+strconv.Itoa(counter)))
+	if err != nil {
+		return nil, nil, err
+	}
+	return symKey[:16], macKey[:16], nil
+}
+
+// the Digest of a file with no data nodes
+func emptyDigest() []byte {
+	return userlib.Hash([]byte("filenodes"))
+}
+
+// extendDigest adds the next data nodes to the header's digest, given the hashes of their
+// ciphertexts in order. A header without a digest keeps going without one.
+func (header *fileheader) extendDigest(nodeHashes [][]byte) {
+	if header.Digest == nil {
+		return
+	}
+	for _, nodeHash := range nodeHashes {
+		header.Digest = userlib.Hash(concatenateByteArrays(header.Digest, nodeHash))
+	}
+}
+
+// checkDigest checks the hashes of the ciphertexts of all of the header's data nodes against its
+// digest
+func (header *fileheader) checkDigest(nodeHashes [][]byte) error {
+	if header.Digest == nil {
+		return nil
+	}
+	digest := emptyDigest()
+	for _, nodeHash := range nodeHashes {
+		digest = userlib.Hash(concatenateByteArrays(digest, nodeHash))
+	}
+	if !bytes.Equal(digest, header.Digest) {
+		return errors.New(strings.ToTitle("verification failed"))
+	}
+	return nil
+}
+
+func newContentKey(start int) contentkey {
+	return contentkey{
+		Start: start,
+		Enc:   userlib.RandomBytes(16),
+		Mac:   userlib.RandomBytes(16),
+	}
+}
+
+// helper method to load a file's header from datastore using the file key
+func loadFileHeader(curFileStruct filestruct) *fileheader {
+	header, _ := readFileHeader(curFileStruct)
+	return header
+}
+
+// readFileHeader also returns the header's ciphertext, for swapping it out with swapFileHeader.
+// The ciphertext is returned even if it doesn't verify, so StoreFile can replace a broken header.
+func readFileHeader(curFileStruct filestruct) (*fileheader, []byte) {
+	ciphertext, ok := datastoreGet(curFileStruct.First)
+	if !ok {
+		return nil, nil
+	}
+	symKey, macKey, err := nodeKeysGen(curFileStruct.RootEnc, curFileStruct.RootMac, 0)
+	if err != nil {
+		return nil, ciphertext
+	}
+	headerBytes, err := VerifyDec(ciphertext, symKey, macKey)
+	if err != nil {
+		return nil, ciphertext
+	}
+	var header fileheader
+	err = unmarshalObject(headerBytes, &header)
+	if err != nil || len(header.Keys) == 0 {
+		return nil, ciphertext
+	}
+	return &header, ciphertext
+}
+
+func encryptFileHeader(curFileStruct filestruct, header fileheader) ([]byte, error) {
+	symKey, macKey, err := nodeKeysGen(curFileStruct.RootEnc, curFileStruct.RootMac, 0)
+	if err != nil {
+		return nil, errors.New(strings.ToTitle("ERROR"))
+	}
+	headerBytes, err := marshalObject(header)
+	if err != nil {
+		return nil, errors.New(strings.ToTitle("ERROR"))
+	}
+	return EncMacGen(headerBytes, symKey, macKey), nil
+}
+
+func storeFileHeader(curFileStruct filestruct, header fileheader) error {
+	ciphertext, err := encryptFileHeader(curFileStruct, header)
+	if err != nil {
+		return err
+	}
+	datastoreSet(curFileStruct.First, ciphertext)
+	return nil
+}
+
+// swapFileHeader stores the header only if the one in Datastore is still the ciphertext old. A
+// header that has been moved is never changed again, so the swap fails as if it had raced.
+func swapFileHeader(curFileStruct filestruct, old []byte, header fileheader) (bool, error) {
+	if header.Moved {
+		return false, nil
+	}
+	ciphertext, err := encryptFileHeader(curFileStruct, header)
+	if err != nil {
+		return false, err
+	}
+	return compareAndSwap(curFileStruct.First, old, ciphertext), nil
+}
+
+// contentKey picks the content key that node i was written with
+func (header *fileheader) contentKey(i int) contentkey {
+	key := header.Keys[0]
+	for _, candidate := range header.Keys {
+		if candidate.Start <= i {
+			key = candidate
+		}
+	}
+	return key
+}
+
+// appendNodes writes the buffered bytes plus content out as full data nodes after the tail,
+// leaving any remainder in the buffer. The header itself still has to be stored by the caller.
+// The addresses of the new nodes are returned in case the header can't be.
+func (header *fileheader) appendNodes(content []byte) ([]uuid.UUID, error) {
+	data := concatenateByteArrays(header.Buffer, content)
+	key := header.Keys[len(header.Keys)-1]
+	if key.Dedup {
+		return header.appendSharedNodes(key, data)
+	}
+	size := header.blockSize()
+	n := len(data) / size
+	header.Buffer = data[n*size:]
+	if n == 0 {
+		return nil, nil
+	}
+
+	// long enough appends get a segment so their nodes can be found without walking the chain
+	var seg *segment
+	if n >= segmentMinimum {
+		seg = &segment{ID: uuid.New(), Start: header.Count, Count: n}
+	}
+	written := make([]uuid.UUID, n)
+	for i := range written {
+		if seg == nil {
+			written[i] = uuid.New()
+			continue
+		}
+		address, err := seg.address(key, header.Count+i)
+		if err != nil {
+			return nil, errors.New(strings.ToTitle("ERROR"))
+		}
+		written[i] = address
+	}
+	// the nodes are encrypted in parallel and then written in a single batch
+	ciphertexts := make([][]byte, n)
+	err := parallel(n, func(i int) error {
+		symKey, macKey, err := nodeKeysGen(key.Enc, key.Mac, header.Count+i)
+		if err != nil {
+			return errors.New(strings.ToTitle("ERROR"))
+		}
+		block, err := header.encodeBlock(data[i*size : (i+1)*size])
+		if err != nil {
+			return err
+		}
+		newnode := filenode{Prev: header.Tail, Data: block}
+		if i > 0 {
+			newnode.Prev = written[i-1]
+		}
+		byteform, err := marshalObject(newnode)
+		if err != nil {
+			return errors.New(strings.ToTitle("ERROR"))
+		}
+		ciphertexts[i] = EncMacGen(byteform, symKey, macKey)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[uuid.UUID][]byte)
+	nodeHashes := make([][]byte, n)
+	for i, address := range written {
+		entries[address] = ciphertexts[i]
+		nodeHashes[i] = userlib.Hash(ciphertexts[i])
+	}
+	header.extendDigest(nodeHashes)
+	if seg != nil {
+		record, ciphertext, err := sealSegmentRecord(key, *seg, header.Segment)
+		if err != nil {
+			return nil, errors.New(strings.ToTitle("ERROR"))
+		}
+		entries[record] = ciphertext
+		written = append(written, record)
+		header.Segment = seg
+	}
+	multiSet(entries)
+	header.Tail = written[n-1]
+	header.Count += n
+	return written, nil
+}
+
 // helper method to load a filenode struct from datastore
-func loadFileNode(address uuid.UUID, rootMac []byte, rootEnc []byte, counter int) *filenode {
-	ciphertext, ok := userlib.DatastoreGet(address)
+func loadFileNode(address uuid.UUID, key contentkey, counter int) *filenode {
+	ciphertext, ok := datastoreGet(address)
 	if !ok {
 		return nil
 	}
-	macKey, err := userlib.HashKDF(rootMac, []byte("mac-key"+strconv.Itoa(counter)))
-	if err != nil {
+	return openFileNode(ciphertext, key, counter)
+}
+
+func openFileNode(ciphertext []byte, key contentkey, counter int) *filenode {
+	if ciphertext == nil {
 		return nil
 	}
-	symKey, err := userlib.HashKDF(rootEnc, []byte("enc-key"+strconv.Itoa(counter)))
+	symKey, macKey, err := nodeKeysGen(key.Enc, key.Mac, counter)
 	if err != nil {
 		return nil
 	}
-	nodebytes, err := VerifyDec(ciphertext, symKey[:16], macKey[:16])
+	nodebytes, err := VerifyDec(ciphertext, symKey, macKey)
 	if err != nil {
 		return nil
 	}
 	var curnode filenode
-	err = json.Unmarshal(nodebytes, &curnode)
+	err = unmarshalObject(nodebytes, &curnode)
 	if err != nil {
 		return nil
 	}
@@ -539,6 +878,7 @@ func loadFileNode(address uuid.UUID, rootMac []byte, rootEnc []byte, counter int
 }
 
 func (userdata *User) LoadFile(filename string) (content []byte, err error) {
+	defer userdata.measure("LoadFile")()
 	if userdata == nil || userdata.Username == "" || userdata.FilestructMac == nil || userdata.FilestructEnc == nil {
 		return nil, errors.New(strings.ToTitle("ERROR"))
 	}
@@ -547,261 +887,502 @@ func (userdata *User) LoadFile(filename string) (content []byte, err error) {
 		return nil, errors.New(strings.ToTitle("Access not granted"))
 	}
 	curFileStruct := *pointer
-	if &curFileStruct == nil {
-		return nil, errors.New(strings.ToTitle("ERROR"))
-	}
-	counter := 0
-	pointer2 := loadFileNode(curFileStruct.First, curFileStruct.RootMac, curFileStruct.RootEnc, counter)
-	if pointer2 == nil {
-		return nil, errors.New(strings.ToTitle("ERROR"))
-	}
-	curnode := *pointer2
-	if err != nil {
+	header := loadFileHeader(curFileStruct)
+	if header == nil {
 		return nil, errors.New(strings.ToTitle("verification failed"))
 	}
-	filebytes := curnode.Data
-	for {
-		if curnode.Next == uuid.Nil {
-			break
+	return header.cachedContent(userdata.cache, curFileStruct.First)
+}
+
+// content reads every data node the header points to and puts the file back together
+func (header *fileheader) content() ([]byte, error) {
+	return header.cachedContent(nil, uuid.Nil)
+}
+
+// cachedContent is content for the header at first, taking whatever nodes it can from the cache
+func (header *fileheader) cachedContent(cache *blockcache, first uuid.UUID) ([]byte, error) {
+	if cache != nil {
+		cache.check(first, header.Version)
+	}
+	// nodes link backwards, so walk from the tail and fill in the blocks in reverse, fetching
+	// whole segments at once where there are any
+	blocks := make([][]byte, header.Count)
+	nodeHashes := make([][]byte, header.Count)
+	address := header.Tail
+	seg := header.Segment
+	for counter := header.Count - 1; counter >= 0; {
+		key := header.contentKey(counter)
+		cacheKey := cachekey{File: first, Version: header.Version, Address: address, Counter: counter}
+		if cache != nil {
+			// blocks cached before headers had digests don't have their hash, so they are read again
+			cached := cache.get(cacheKey, key.Mac)
+			if cached != nil && cached.Hash != nil {
+				blocks[counter] = cached.Block
+				nodeHashes[counter] = cached.Hash
+				address = cached.Prev
+				counter--
+				continue
+			}
+		}
+		seg = header.previousSegment(seg, counter)
+		nodes := []*filenode{}
+		hashes := [][]byte{}
+		if seg != nil && counter < seg.end() {
+			expected, err := seg.address(key, counter)
+			if err == nil && expected == address {
+				nodes, hashes, err = header.loadSegmentNodes(*seg, counter)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		if len(nodes) == 0 {
+			ciphertext, _ := datastoreGet(address)
+			curnode := openFileNode(ciphertext, key, counter)
+			if curnode == nil {
+				return nil, errors.New(strings.ToTitle("verification failed"))
+			}
+			nodes = append(nodes, curnode)
+			hashes = append(hashes, userlib.Hash(ciphertext))
 		}
-		counter += 1
-		curnode = *loadFileNode(curnode.Next, curFileStruct.RootMac, curFileStruct.RootEnc, counter)
-		if &curnode == nil {
-			return nil, errors.New(strings.ToTitle("verification failed"))
+		for i := len(nodes) - 1; i >= 0; i-- {
+			block, err := header.decodeBlock(nodes[i].Data)
+			if err != nil {
+				return nil, err
+			}
+			if cache != nil {
+				cacheKey := cachekey{File: first, Version: header.Version, Address: address, Counter: counter}
+				cache.put(cacheKey, cachedblock{Mac: header.contentKey(counter).Mac, Prev: nodes[i].Prev, Block: block,
+					Hash: hashes[i]})
+			}
+			blocks[counter] = block
+			nodeHashes[counter] = hashes[i]
+			address = nodes[i].Prev
+			counter--
 		}
-		filebytes = concatenateByteArrays(filebytes, curnode.Data)
 	}
-	return filebytes, nil
+	err := header.checkDigest(nodeHashes)
+	if err != nil {
+		return nil, err
+	}
+	filebytes := []byte{}
+	for _, block := range blocks {
+		filebytes = concatenateByteArrays(filebytes, block)
+	}
+	return concatenateByteArrays(filebytes, header.Buffer), nil
 }
 
-// helper method to load sharetree struct from datastore
-func (userdata *User) loadShareTree(filename string) *sharetree {
-	storageKey := generateSharetreeKey(userdata.Username, filename)
-	fileJSON, ok := userlib.DatastoreGet(storageKey)
+// helper method to load the sharestruct a recipient keeps in place of a filestruct
+func (userdata *User) loadShareStruct(filename string) *sharestruct {
+	storageKey := filestructKeyGen(userdata.Username, filename)
+	encryptedShared, ok := datastoreGet(storageKey)
 	if !ok {
 		return nil
 	}
-	// first step: verify and decrypt the filestruct
-	sharetreeBytes, err := VerifyDec(fileJSON, userdata.SharetreeEnc, userdata.SharetreeMac)
+	sharedbytes, err := VerifyDec(encryptedShared, userdata.FilestructEnc, userdata.FilestructMac)
 	if err != nil {
 		return nil
 	}
+	var curShareStruct sharestruct
+	err = unmarshalObject(sharedbytes, &curShareStruct)
+	if err != nil || curShareStruct.F == uuid.Nil {
+		return nil
+	}
+	return &curShareStruct
+}
+
+// helper method to load sharetree struct from datastore, with any shares added since it was last
+// stored (see sharelog.go)
+func (userdata *User) loadShareTree(filename string) *sharetree {
+	storageKey := generateSharetreeKey(userdata.Username, filename)
 	var curShareTree sharetree
-	err = json.Unmarshal(sharetreeBytes, &curShareTree)
-	if err != nil {
+	fileJSON, ok := datastoreGet(storageKey)
+	if ok {
+		// first step: verify and decrypt the sharetree
+		sharetreeBytes, err := VerifyDec(fileJSON, userdata.SharetreeEnc, userdata.SharetreeMac)
+		if err != nil {
+			return nil
+		}
+		err = unmarshalObject(sharetreeBytes, &curShareTree)
+		if err != nil {
+			return nil
+		}
+	}
+	_, entries, err := userdata.loadShareLog(filename)
+	if err != nil || (!ok && len(entries) == 0) {
 		return nil
 	}
+	for _, entry := range entries {
+		curShareTree.apply(entry)
+	}
 	return &curShareTree
 }
 
 func (userdata *User) CreateInvitation(filename string, recipientUsername string) (
 	invitationPtr uuid.UUID, err error) {
 
+	defer userdata.measure("CreateInvitation")()
 	if userdata == nil || userdata.Username == "" || userdata.FilestructMac == nil || userdata.FilestructEnc == nil {
 		return uuid.Nil, errors.New(strings.ToTitle("ERROR"))
 	}
+	if strings.HasPrefix(recipientUsername, GroupPrefix) {
+		return userdata.createGroupInvitation(filename, strings.TrimPrefix(recipientUsername, GroupPrefix))
+	}
 
 	pointer, shared := userdata.loadFileStruct(filename)
 	if pointer == nil {
 		return uuid.Nil, errors.New(strings.ToTitle("ERROR"))
 	}
+	// check the recipient before recording anything for them
+	recipientKeys, err := userdata.peerKeys(recipientUsername)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	// invitations are sealed to the latest version of the recipient's keys
+	recipientLatest := recipientKeys[len(recipientKeys)-1]
+	recipientDevices, err := loadDevices(recipientUsername, recipientLatest.Sign)
+	if err != nil {
+		return uuid.Nil, err
+	}
 
 	curFileStruct := *pointer
 	var shareInvite sharestruct
 	if shared {
-		storageKey := filestructKeyGen(userdata.Username, filename)
-		encryptedShared, _ := userlib.DatastoreGet(storageKey)
-		sharedbytes, _ := VerifyDec(encryptedShared, userdata.FilestructEnc, userdata.FilestructMac)
-		err := json.Unmarshal(sharedbytes, &shareInvite)
+		pointer2 := userdata.loadShareStruct(filename)
+		if pointer2 == nil {
+			return uuid.Nil, errors.New(strings.ToTitle("ERROR"))
+		}
+		// group members don't hold keys of their own to pass on
+		if pointer2.Group != "" {
+			return uuid.Nil, errors.New(strings.ToTitle("files shared with a group cannot be re-shared"))
+		}
+		shareInvite = sharestruct{F: pointer2.F, E: pointer2.E, M: pointer2.M}
+
+		// the owner can't see sub-shares in the sharetree, so record them in the shared filestruct
+		record := accessrecord{
+			Recipient: recipientUsername,
+			InvitedBy: userdata.Username,
+			Invited:   time.Now(),
+		}
+		record.Signature, err = userdata.sign(record.signed(shareInvite.F))
 		if err != nil {
 			return uuid.Nil, errors.New(strings.ToTitle("ERROR"))
 		}
+		err = changeSharedFileStruct(shareInvite.F, shareInvite.E, shareInvite.M, func(curFileStruct *filestruct) bool {
+			curFileStruct.Shares = append(curFileStruct.Shares, record)
+			return true
+		})
+		if err != nil {
+			return uuid.Nil, err
+		}
 	} else {
 		newMacKey := userlib.RandomBytes(16)
 		newEncKey := userlib.RandomBytes(16)
-		filestructBytes, err := json.Marshal(curFileStruct)
+		filestructUUID, err := userdata.addShareBranch(filename, recipientUsername, curFileStruct, newEncKey, newMacKey)
 		if err != nil {
 			return uuid.Nil, err
 		}
-		toStore := EncMacGen(filestructBytes, newEncKey, newMacKey)
-		filestructUUID := uuid.New()
-		userlib.DatastoreSet(filestructUUID, toStore)
 		shareInvite.E = newEncKey
 		shareInvite.M = newMacKey
 		shareInvite.F = filestructUUID
-
-		// initialize the file's sharetree if it doesn't exist
-		// for the future: need to account for the case where a non-owner shares this file (then no changes
-		// need to be made at all to the file sharetree)
-		sharetreeKey := generateSharetreeKey(userdata.Username, filename)
-		_, ok := userlib.DatastoreGet(sharetreeKey)
-		var shareTree sharetree
-		if ok {
-			pointer3 := userdata.loadShareTree(filename)
-			if pointer3 == nil {
-				return uuid.Nil, errors.New(strings.ToTitle("ERROR"))
-			}
-			shareTree = *pointer3
-
-		} else {
-			sShareMap := make(map[string]uuid.UUID)
-			sFileMap := make(map[uuid.UUID][][]byte)
-			shareTree.Filemap = sFileMap
-			shareTree.Sharemap = sShareMap
-		}
-		shareTree.Sharemap[recipientUsername] = filestructUUID
-		shareTree.Filemap[filestructUUID] = [][]byte{newEncKey, newMacKey}
-		storeBytes, _ := json.Marshal(shareTree)
-		encryptedStore := EncMacGen(storeBytes, userdata.SharetreeEnc, userdata.SharetreeMac)
-		userlib.DatastoreSet(sharetreeKey, encryptedStore)
 	}
 
-	sharestructBytes, err := json.Marshal(shareInvite)
+	sharestructBytes, err := marshalObject(shareInvite)
 	if err != nil {
 		return uuid.Nil, errors.New(strings.ToTitle("ERROR"))
 	}
-	recipientPKE, ok := userlib.KeystoreGet(recipientUsername + "shareenc")
-	if !ok {
+	// recipients with devices get the invitation sealed to each of them as well
+	var storeInvite []byte
+	if len(recipientDevices) == 0 {
+		storeInvite, err = userlib.PKEEnc(recipientLatest.Enc, sharestructBytes)
+	} else {
+		storeInvite, err = userdata.sealTo(recipientUsername, sharestructBytes)
+	}
+	if err != nil {
 		return uuid.Nil, errors.New(strings.ToTitle("ERROR"))
 	}
-	storeInvite, err := userlib.PKEEnc(recipientPKE, sharestructBytes)
+	userSign, err := userdata.sign(storeInvite)
 	if err != nil {
 		return uuid.Nil, errors.New(strings.ToTitle("ERROR"))
 	}
-	userSign, err := userlib.DSSign(userdata.SharePrivateKeySign, storeInvite)
 	storeThis := concatenateByteArrays(storeInvite, userSign)
 	shareUUID := uuid.New()
-	userlib.DatastoreSet(shareUUID, storeThis)
+	datastoreSet(shareUUID, storeThis)
+
+	// let the recipient find the invitation without it being passed around out of band
+	err = userdata.deliverNotification(recipientUsername, notification{
+		Sender:     userdata.Username,
+		Invitation: shareUUID,
+		Filename:   filename,
+		Sent:       time.Now(),
+	})
+	if err != nil {
+		return uuid.Nil, err
+	}
 
 	return shareUUID, nil
 }
 
-func (userdata *User) AcceptInvitation(senderUsername string, invitationPtr uuid.UUID, filename string) error {
-	encryptedInvite, ok := userlib.DatastoreGet(invitationPtr)
+// addShareBranch stores a copy of the owner's filestruct for a new recipient under the given
+// keys and records it in the file's sharetree
+func (userdata *User) addShareBranch(filename string, recipientUsername string, curFileStruct filestruct,
+	encKey []byte, macKey []byte) (uuid.UUID, error) {
 
-	if userdata == nil || userdata.Username == "" || userdata.FilestructMac == nil || userdata.FilestructEnc == nil {
-		return errors.New(strings.ToTitle("ERROR"))
+	// a transfer of the file would hand over a sharetree without this share
+	err := userdata.cancelTransfer(filename)
+	if err != nil {
+		return uuid.Nil, err
 	}
-
-	if !ok {
-		return errors.New(strings.ToTitle("ERROR"))
+	filestructBytes, err := marshalObject(curFileStruct)
+	if err != nil {
+		return uuid.Nil, err
 	}
-	DSVerifyKey, ok := userlib.KeystoreGet(senderUsername + "sharesign")
-	if !ok {
-		return errors.New(strings.ToTitle("ERROR"))
+	toStore := EncMacGen(filestructBytes, encKey, macKey)
+	filestructUUID := uuid.New()
+	datastoreSet(filestructUUID, toStore)
+
+	err = userdata.appendShareLog(filename, newShareEntry(recipientUsername, userdata.Username, filestructUUID, encKey, macKey))
+	if err != nil {
+		datastoreDelete(filestructUUID)
+		return uuid.Nil, err
 	}
-	sig := encryptedInvite[len(encryptedInvite)-256:]
-	message := encryptedInvite[:(len(encryptedInvite))-256]
-	err := userlib.DSVerify(DSVerifyKey, message, sig)
+	return filestructUUID, nil
+}
+
+func (userdata *User) storeShareTree(filename string, shareTree sharetree) error {
+	storeBytes, err := marshalObject(shareTree)
 	if err != nil {
 		return errors.New(strings.ToTitle("ERROR"))
 	}
-	shareBytes, err := userlib.PKEDec(userdata.SharePrivateKeyEnc, message)
-	if err != nil {
+	encryptedStore := EncMacGen(storeBytes, userdata.SharetreeEnc, userdata.SharetreeMac)
+	datastoreSet(generateSharetreeKey(userdata.Username, filename), encryptedStore)
+	userdata.clearShareLog(filename)
+	return nil
+}
+
+func (userdata *User) AcceptInvitation(senderUsername string, invitationPtr uuid.UUID, filename string) error {
+	defer userdata.measure("AcceptInvitation")()
+	if userdata == nil || userdata.Username == "" || userdata.FilestructMac == nil || userdata.FilestructEnc == nil {
 		return errors.New(strings.ToTitle("ERROR"))
 	}
-	var shareInvite sharestruct
-	err = json.Unmarshal(shareBytes, &shareInvite)
+	shareInvite, err := userdata.openInvitation(senderUsername, invitationPtr)
 	if err != nil {
-		return errors.New(strings.ToTitle("ERROR"))
+		return err
 	}
 	// retrieve the filestruct
-	_, ok = userlib.DatastoreGet(shareInvite.F)
+	_, ok := datastoreGet(shareInvite.F)
 	if !ok {
 		return errors.New(strings.ToTitle("ERROR"))
 	}
 	// make sure that the current user does not contain a file of the same name
 	putUUID := filestructKeyGen(userdata.Username, filename)
-	_, ok = userlib.DatastoreGet(putUUID)
+	_, ok = datastoreGet(putUUID)
 	if ok {
 		return errors.New(strings.ToTitle("User already has a file of this name"))
 	}
 
-	// put the sharestruct where the file would be in datastore
+	// put the sharestruct where the file would be in datastore, remembering who sent it
+	shareInvite.Sender = senderUsername
+	shareBytes, err := marshalObject(shareInvite)
+	if err != nil {
+		return errors.New(strings.ToTitle("ERROR"))
+	}
 	putThis := EncMacGen(shareBytes, userdata.FilestructEnc, userdata.FilestructMac)
-	userlib.DatastoreSet(putUUID, putThis)
+	datastoreSet(putUUID, putThis)
+	err = userdata.updateNamespace(filename, true)
+	if err != nil {
+		return err
+	}
+	// the invitation is accepted by now; a notification left behind only shows up as pending
+	_, _ = userdata.removeNotification(senderUsername, invitationPtr)
 	return nil
 }
 
+// openInvitation checks the sender's signature on an invitation and decrypts the sharestruct in it
+func (userdata *User) openInvitation(senderUsername string, invitationPtr uuid.UUID) (*sharestruct, error) {
+	encryptedInvite, ok := datastoreGet(invitationPtr)
+	if !ok {
+		return nil, errors.New(strings.ToTitle("ERROR"))
+	}
+	if len(encryptedInvite) < pkeCipherLen {
+		return nil, errors.New(strings.ToTitle("ERROR"))
+	}
+	sig := encryptedInvite[len(encryptedInvite)-256:]
+	message := encryptedInvite[:(len(encryptedInvite))-256]
+	if !userdata.verifySignature(senderUsername, message, sig) {
+		return nil, errors.New(strings.ToTitle("ERROR"))
+	}
+	// invitations to a single user are one PKE ciphertext unless the user has devices, and
+	// group invitations are JSON
+	var shareBytes []byte
+	var err error
+	if len(message) == pkeCipherLen && userdata.holdsAccountKeys() {
+		// it may be sealed to any version of the account keys
+		for _, privateKey := range userdata.decKeys() {
+			shareBytes, err = userlib.PKEDec(privateKey, message)
+			if err == nil {
+				break
+			}
+		}
+	} else if len(message) > 0 && message[0] == '{' {
+		shareBytes, err = userdata.openGroupInvitation(message)
+	} else {
+		shareBytes, err = userdata.open(message)
+	}
+	if err != nil {
+		return nil, errors.New(strings.ToTitle("ERROR"))
+	}
+	var shareInvite sharestruct
+	err = unmarshalObject(shareBytes, &shareInvite)
+	if err != nil {
+		return nil, errors.New(strings.ToTitle("ERROR"))
+	}
+	if shareInvite.Group != "" {
+		shareInvite.GroupOwner = senderUsername
+	}
+	return &shareInvite, nil
+}
+
 func (userdata *User) RevokeAccess(filename string, recipientUsername string) error {
+	defer userdata.measure("RevokeAccess")()
 	// retrieve the file sharetree
 	if userdata == nil || userdata.Username == "" || userdata.FilestructMac == nil || userdata.FilestructEnc == nil {
 		return errors.New(strings.ToTitle("ERROR"))
 	}
-	sharetreeKey := generateSharetreeKey(userdata.Username, filename)
-	_, ok := userlib.DatastoreGet(sharetreeKey)
-	var shareTree sharetree
-	if !ok {
+	// finish anything an earlier session left half done before starting over
+	err := userdata.resumeRevocations()
+	if err != nil {
+		return err
+	}
+	if !userdata.hasShareTree(filename) {
 		return errors.New(strings.ToTitle("ShareTree structure not found"))
 	}
-	// load the sharetree and remove the revoked user from the sharetree
 	pointer3 := userdata.loadShareTree(filename)
 	if pointer3 == nil {
 		return errors.New(strings.ToTitle("ERROR"))
 	}
-	shareTree = *pointer3
-	revokeUUID := shareTree.Sharemap[recipientUsername]
-	// below: double check that I'm using the right keys
-	userlib.DatastoreDelete(revokeUUID)
-	delete(shareTree.Sharemap, recipientUsername)
-	delete(shareTree.Filemap, revokeUUID)
+	revokeUUID, ok := pointer3.Sharemap[recipientUsername]
+	if !ok {
+		return errors.New(strings.ToTitle("file is not shared with this recipient"))
+	}
+	return userdata.startRevocation(filename, recipientUsername, revokeUUID)
+}
 
-	// reencrypt the file
-	filestructKey := filestructKeyGen(userdata.Username, filename)
-	filecontent, err := userdata.LoadFile(filename)
-	if err != nil {
-		return err
+// ListAccess reports who can access a file. The owner sees every recipient in the file's
+// sharetree along with the sub-shares those recipients made; a recipient sees the owner,
+// themselves and anyone else sharing their copy of the file.
+func (userdata *User) ListAccess(filename string) ([]AccessEntry, error) {
+	defer userdata.measure("ListAccess")()
+	return userdata.listAccess(filename)
+}
+
+// listAccess is ListAccess for operations that need the access list, so the listing isn't
+// measured on its own
+func (userdata *User) listAccess(filename string) ([]AccessEntry, error) {
+	if userdata == nil || userdata.Username == "" || userdata.FilestructMac == nil || userdata.FilestructEnc == nil {
+		return nil, errors.New(strings.ToTitle("ERROR"))
+	}
+	pointer, shared := userdata.loadFileStruct(filename)
+	if pointer == nil {
+		return nil, errors.New(strings.ToTitle("Access not granted"))
 	}
+	curFileStruct := *pointer
 
-	oldpointer, _ := userdata.loadFileStruct(filename)
-	if oldpointer == nil {
-		return errors.New(strings.ToTitle("ERROR"))
+	owner := curFileStruct.Owner
+	if !shared {
+		owner = userdata.Username
 	}
-	oldFileStruct := *oldpointer
-	oldFirst := loadFileNode(oldFileStruct.First, oldFileStruct.RootMac, oldFileStruct.RootEnc, 0)
-	var toDelete []uuid.UUID
-	toDelete = append(toDelete, oldFileStruct.First)
-	prevNode := oldFirst
-	for i := 0; i < oldFirst.Lastcounter; i++ {
-		if prevNode == nil || prevNode.Next == uuid.Nil {
-			break
-		}
-		toDelete = append(toDelete, prevNode.Next)
-		prevNode = loadFileNode(prevNode.Next, oldFileStruct.RootMac, oldFileStruct.RootEnc, i)
-	}
-	for i := 0; i < len(toDelete); i++ {
-		userlib.DatastoreDelete(toDelete[i])
-	}
-	userlib.DatastoreDelete(filestructKey)
-	err = userdata.StoreFile(filename, filecontent)
-	newpointer, _ := userdata.loadFileStruct(filename)
-	if newpointer == nil {
-		return errors.New(strings.ToTitle("ERROR"))
+	entries := []AccessEntry{{Recipient: owner, Permission: PermissionOwner}}
+
+	if shared {
+		pointer2 := userdata.loadShareStruct(filename)
+		if pointer2 == nil {
+			return nil, errors.New(strings.ToTitle("ERROR"))
+		}
+		entries = append(entries, AccessEntry{
+			Recipient:  userdata.Username,
+			InvitedBy:  pointer2.Sender,
+			Permission: PermissionReadWrite,
+		})
+		for _, record := range curFileStruct.Shares {
+			if !userdata.recordValid(pointer2.F, record) {
+				continue
+			}
+			if record.Recipient == userdata.Username {
+				entries[1].Invited = record.Invited
+				continue
+			}
+			entries = append(entries, record.entry())
+		}
+		return entries, nil
 	}
-	newFileStruct := *newpointer
-	if err != nil {
-		return errors.New(strings.ToTitle("ERROR"))
+
+	// a file that was never shared has no sharetree
+	if !userdata.hasShareTree(filename) {
+		return entries, nil
+	}
+	pointer3 := userdata.loadShareTree(filename)
+	if pointer3 == nil {
+		return nil, errors.New(strings.ToTitle("ERROR"))
+	}
+	shareTree := *pointer3
+	recipients := make([]string, 0, len(shareTree.Sharemap))
+	for recipient := range shareTree.Sharemap {
+		recipients = append(recipients, recipient)
 	}
-	for structUUID, keys := range shareTree.Filemap {
-		encryptedBytes, ok := userlib.DatastoreGet(structUUID)
+	sort.Strings(recipients)
+	for _, recipient := range recipients {
+		structUUID := shareTree.Sharemap[recipient]
+		record, ok := shareTree.Accessmap[recipient]
 		if !ok {
-			return err
+			record = accessrecord{Recipient: recipient, InvitedBy: userdata.Username}
 		}
-		structBytes, err := VerifyDec(encryptedBytes, keys[0], keys[1])
-		if err != nil {
-			return errors.New(strings.ToTitle("ERROR"))
+		var branch *filestruct
+		if keys := shareTree.Filemap[structUUID]; len(keys) >= 2 && !strings.HasPrefix(recipient, GroupPrefix) {
+			branch = loadFileStruct2(structUUID, keys[0], keys[1])
 		}
-		var curStruct filestruct
-		err = json.Unmarshal(structBytes, &curStruct)
-		if err != nil {
-			return errors.New(strings.ToTitle("ERROR"))
+		// a recipient who declined the invitation is no longer listed
+		if branch != nil && branch.Declined {
+			continue
+		}
+		// an owner who received the file through a transfer keeps their old shared filestruct
+		// around for the sub-shares made from it
+		if recipient != userdata.Username {
+			entries = append(entries, record.entry())
+		}
+		if strings.HasPrefix(recipient, GroupPrefix) {
+			entries = append(entries, userdata.groupAccess(strings.TrimPrefix(recipient, GroupPrefix), record.Invited)...)
+			continue
+		}
+		if branch == nil {
+			continue
+		}
+		for _, record := range branch.Shares {
+			if userdata.recordValid(structUUID, record) {
+				entries = append(entries, record.entry())
+			}
 		}
-		curStruct.First = newFileStruct.First
-		curStruct.RootMac = newFileStruct.RootMac
-		curStruct.RootEnc = newFileStruct.RootEnc
-		newBytes, err := json.Marshal(curStruct)
-		newEncryption := EncMacGen(newBytes, keys[0], keys[1])
-		userlib.DatastoreSet(structUUID, newEncryption)
 	}
-	return nil
+	return entries, nil
+}
+
+// signed is what InvitedBy signs on a sub-share recorded in the shared filestruct at structUUID,
+// so that a record can't be forged by another recipient or moved to another file
+func (record accessrecord) signed(structUUID uuid.UUID) []byte {
+	invited := strconv.FormatInt(record.Invited.UnixNano(), 10)
+	return concatenateByteArrays(structUUID[:], []byte(record.Recipient+"/"+record.InvitedBy+"/"+invited+"/sub-share"))
+}
+
+// recordValid reports whether a sub-share record carries its sharer's signature
+func (userdata *User) recordValid(structUUID uuid.UUID, record accessrecord) bool {
+	return len(record.Signature) > 0 && userdata.verifySignature(record.InvitedBy, record.signed(structUUID), record.Signature)
+}
+
+func (record accessrecord) entry() AccessEntry {
+	return AccessEntry{
+		Recipient:  record.Recipient,
+		InvitedBy:  record.InvitedBy,
+		Invited:    record.Invited,
+		Permission: PermissionReadWrite,
+	}
 }
@@ -0,0 +1,376 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Filenodes, headers, filestructs, sharestructs, sharetrees and share log entries are stored in a
+// compact binary encoding instead of JSON, which spends a third more on every []byte field by
+// base64-encoding it. An encoded object starts with the format version and a tag for its type,
+// followed by its exported fields in the order they are declared:
+//   - bools are one byte, ints are varints, and arrays (UUIDs) are their raw bytes
+//   - strings, byte slices, slices and maps are a uvarint of their length plus one (zero for
+//     nil) followed by their contents; map entries are sorted by their encoded key
+//   - pointers are a zero byte for nil, or a one followed by the value
+//   - time.Time uses its own MarshalBinary, prefixed with its length
+//
+// Removing or reordering fields of any of these types changes the format. A field can be added
+// at the end of a struct by raising binaryFormat and tagging the field with the format it first
+// appears in, as in `since:"2"`; objects written in an earlier format are read without it.
+// Readers still accept JSON, which is what older clients wrote.
+
+// WriteLegacyEncoding makes the client write JSON again, for sharing a Datastore with clients
+// that can only read JSON. Reading works the same either way.
+var WriteLegacyEncoding = false
+
+const binaryFormat = 5
+
+// the tags of the types that use the binary encoding; tags must never be reused
+var objectTags = map[reflect.Type]byte{
+	reflect.TypeOf(filenode{}):      1,
+	reflect.TypeOf(fileheader{}):    2,
+	reflect.TypeOf(filestruct{}):    3,
+	reflect.TypeOf(sharestruct{}):   4,
+	reflect.TypeOf(sharetree{}):     5,
+	reflect.TypeOf(shareentry{}):    6,
+	reflect.TypeOf(cachedblock{}):   7,
+	reflect.TypeOf(segmentrecord{}): 8,
+}
+
+// errWrongType means the data holds a different type of object than the one asked for
+var errWrongType = errors.New(strings.ToTitle("object has a different type"))
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func marshalObject(v interface{}) ([]byte, error) {
+	if WriteLegacyEncoding {
+		return json.Marshal(v)
+	}
+	value := reflect.ValueOf(v)
+	if value.Kind() == reflect.Ptr {
+		value = value.Elem()
+	}
+	tag, ok := objectTags[value.Type()]
+	if !ok {
+		return nil, errors.New(strings.ToTitle("no binary encoding for " + value.Type().String()))
+	}
+	return appendValue([]byte{binaryFormat, tag}, value)
+}
+
+// unmarshalObject decodes either encoding into v, which must point to one of the tagged types
+func unmarshalObject(data []byte, v interface{}) error {
+	if len(data) == 0 || data[0] == 0 || data[0] > binaryFormat {
+		return json.Unmarshal(data, v)
+	}
+	value := reflect.ValueOf(v).Elem()
+	if len(data) < 2 || objectTags[value.Type()] != data[1] {
+		return errWrongType
+	}
+	decoder := objectDecoder{format: data[0], data: data[2:]}
+	err := decoder.readValue(value)
+	if err != nil {
+		return err
+	}
+	if len(decoder.data) != 0 {
+		return errors.New(strings.ToTitle("trailing data after object"))
+	}
+	return nil
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], x)]...)
+}
+
+func appendVarint(buf []byte, x int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutVarint(tmp[:], x)]...)
+}
+
+func appendValue(buf []byte, value reflect.Value) ([]byte, error) {
+	if value.Type() == timeType {
+		timeBytes, err := value.Interface().(time.Time).MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		buf = appendUvarint(buf, uint64(len(timeBytes)))
+		return append(buf, timeBytes...), nil
+	}
+	var err error
+	switch value.Kind() {
+	case reflect.Bool:
+		if value.Bool() {
+			return append(buf, 1), nil
+		}
+		return append(buf, 0), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendVarint(buf, value.Int()), nil
+	case reflect.String:
+		buf = appendUvarint(buf, uint64(value.Len())+1)
+		return append(buf, value.String()...), nil
+	case reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			buf, err = appendValue(buf, value.Index(i))
+			if err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case reflect.Slice:
+		if value.IsNil() {
+			return append(buf, 0), nil
+		}
+		buf = appendUvarint(buf, uint64(value.Len())+1)
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			return append(buf, value.Bytes()...), nil
+		}
+		for i := 0; i < value.Len(); i++ {
+			buf, err = appendValue(buf, value.Index(i))
+			if err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case reflect.Map:
+		if value.IsNil() {
+			return append(buf, 0), nil
+		}
+		buf = appendUvarint(buf, uint64(value.Len())+1)
+		type entry struct{ key, value []byte }
+		var entries []entry
+		iter := value.MapRange()
+		for iter.Next() {
+			keyBytes, err := appendValue(nil, iter.Key())
+			if err != nil {
+				return nil, err
+			}
+			valueBytes, err := appendValue(nil, iter.Value())
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry{keyBytes, valueBytes})
+		}
+		sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i].key, entries[j].key) < 0 })
+		for _, e := range entries {
+			buf = append(append(buf, e.key...), e.value...)
+		}
+		return buf, nil
+	case reflect.Ptr:
+		if value.IsNil() {
+			return append(buf, 0), nil
+		}
+		return appendValue(append(buf, 1), value.Elem())
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			if value.Type().Field(i).PkgPath != "" {
+				continue
+			}
+			buf, err = appendValue(buf, value.Field(i))
+			if err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case reflect.Uint8:
+		return append(buf, byte(value.Uint())), nil
+	}
+	return nil, errors.New(strings.ToTitle("no binary encoding for " + value.Type().String()))
+}
+
+type objectDecoder struct {
+	format byte
+	data   []byte
+}
+
+// since is the format a struct field was added in
+func since(field reflect.StructField) byte {
+	format, err := strconv.Atoi(field.Tag.Get("since"))
+	if err != nil {
+		return 1
+	}
+	return byte(format)
+}
+
+var errTruncated = errors.New(strings.ToTitle("object is truncated"))
+
+func (decoder *objectDecoder) readByte() (byte, error) {
+	if len(decoder.data) == 0 {
+		return 0, errTruncated
+	}
+	b := decoder.data[0]
+	decoder.data = decoder.data[1:]
+	return b, nil
+}
+
+func (decoder *objectDecoder) readBytes(n uint64) ([]byte, error) {
+	if n > uint64(len(decoder.data)) {
+		return nil, errTruncated
+	}
+	b := decoder.data[:n]
+	decoder.data = decoder.data[n:]
+	return b, nil
+}
+
+func (decoder *objectDecoder) readUvarint() (uint64, error) {
+	x, n := binary.Uvarint(decoder.data)
+	if n <= 0 {
+		return 0, errTruncated
+	}
+	decoder.data = decoder.data[n:]
+	return x, nil
+}
+
+// readLength reads a length written as length plus one, reporting nil for zero. A length can
+// never be more than the bytes left, since every element takes at least one byte.
+func (decoder *objectDecoder) readLength() (int, bool, error) {
+	n, err := decoder.readUvarint()
+	if err != nil {
+		return 0, false, err
+	}
+	if n == 0 {
+		return 0, true, nil
+	}
+	if n-1 > uint64(len(decoder.data)) {
+		return 0, false, errTruncated
+	}
+	return int(n - 1), false, nil
+}
+
+func (decoder *objectDecoder) readValue(value reflect.Value) error {
+	if value.Type() == timeType {
+		n, err := decoder.readUvarint()
+		if err != nil {
+			return err
+		}
+		timeBytes, err := decoder.readBytes(n)
+		if err != nil {
+			return err
+		}
+		var t time.Time
+		err = t.UnmarshalBinary(timeBytes)
+		if err != nil {
+			return err
+		}
+		value.Set(reflect.ValueOf(t))
+		return nil
+	}
+	switch value.Kind() {
+	case reflect.Bool:
+		b, err := decoder.readByte()
+		if err != nil {
+			return err
+		}
+		value.SetBool(b == 1)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x, n := binary.Varint(decoder.data)
+		if n <= 0 {
+			return errTruncated
+		}
+		decoder.data = decoder.data[n:]
+		value.SetInt(x)
+		return nil
+	case reflect.String:
+		n, isNil, err := decoder.readLength()
+		if err != nil || isNil {
+			return err
+		}
+		b, err := decoder.readBytes(uint64(n))
+		if err != nil {
+			return err
+		}
+		value.SetString(string(b))
+		return nil
+	case reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			err := decoder.readValue(value.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Slice:
+		n, isNil, err := decoder.readLength()
+		if err != nil || isNil {
+			return err
+		}
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			b, err := decoder.readBytes(uint64(n))
+			if err != nil {
+				return err
+			}
+			value.SetBytes(append([]byte{}, b...))
+			return nil
+		}
+		slice := reflect.MakeSlice(value.Type(), n, n)
+		for i := 0; i < n; i++ {
+			err = decoder.readValue(slice.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+		value.Set(slice)
+		return nil
+	case reflect.Map:
+		n, isNil, err := decoder.readLength()
+		if err != nil || isNil {
+			return err
+		}
+		m := reflect.MakeMapWithSize(value.Type(), n)
+		for i := 0; i < n; i++ {
+			key := reflect.New(value.Type().Key()).Elem()
+			err = decoder.readValue(key)
+			if err != nil {
+				return err
+			}
+			elem := reflect.New(value.Type().Elem()).Elem()
+			err = decoder.readValue(elem)
+			if err != nil {
+				return err
+			}
+			m.SetMapIndex(key, elem)
+		}
+		value.Set(m)
+		return nil
+	case reflect.Ptr:
+		b, err := decoder.readByte()
+		if err != nil || b == 0 {
+			return err
+		}
+		elem := reflect.New(value.Type().Elem())
+		err = decoder.readValue(elem.Elem())
+		if err != nil {
+			return err
+		}
+		value.Set(elem)
+		return nil
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			if field.PkgPath != "" || since(field) > decoder.format {
+				continue
+			}
+			err := decoder.readValue(value.Field(i))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Uint8:
+		b, err := decoder.readByte()
+		if err != nil {
+			return err
+		}
+		value.SetUint(uint64(b))
+		return nil
+	}
+	return errors.New(strings.ToTitle("no binary encoding for " + value.Type().String()))
+}
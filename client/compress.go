@@ -0,0 +1,98 @@
+package client
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Compression is opt-in per file. A compressed file is cut into larger blocks than usual, since
+// there is nothing to gain from compressing a few bytes at a time, and each block is compressed
+// with flate before it is encrypted. Like deduplication, it is recorded in the file's content
+// keys and takes effect the next time the file is stored.
+//
+// Compressing before encrypting leaks how compressible each block is: the Datastore can see the
+// size of every filenode, and if an attacker can get their own text into the same block as a
+// secret, the sizes tell them whether their guess matched part of it. That is why compression is
+// off unless a user turns it on, and it should stay off for files that mix secrets with content
+// somebody else can influence. The header's buffer is never compressed, since it is encrypted
+// together with the rest of the header.
+
+// how many bytes of a compressed file go into each filenode, before compression
+const compressedBlocksize = 1024
+
+func (header *fileheader) blockSize() int {
+	if len(header.Keys) > 0 && header.Keys[0].Compressed {
+		return compressedBlocksize
+	}
+	return blocksize
+}
+
+func (header *fileheader) encodeBlock(block []byte) ([]byte, error) {
+	if !header.Keys[0].Compressed {
+		return block, nil
+	}
+	var compressed bytes.Buffer
+	writer, err := flate.NewWriter(&compressed, flate.BestCompression)
+	if err != nil {
+		return nil, errors.New(strings.ToTitle("ERROR"))
+	}
+	_, err = writer.Write(block)
+	if err != nil {
+		return nil, errors.New(strings.ToTitle("ERROR"))
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, errors.New(strings.ToTitle("ERROR"))
+	}
+	return compressed.Bytes(), nil
+}
+
+// decodeBlock undoes encodeBlock, refusing anything that doesn't expand to exactly one block
+func (header *fileheader) decodeBlock(data []byte) ([]byte, error) {
+	if !header.Keys[0].Compressed {
+		return data, nil
+	}
+	reader := flate.NewReader(bytes.NewReader(data))
+	defer reader.Close()
+	block, err := io.ReadAll(io.LimitReader(reader, compressedBlocksize+1))
+	if err != nil || len(block) != compressedBlocksize {
+		return nil, errors.New(strings.ToTitle("verification failed"))
+	}
+	return block, nil
+}
+
+// SetCompression turns compression of a file's content on or off. It takes effect the next time
+// the file is stored.
+func (userdata *User) SetCompression(filename string, enabled bool) error {
+	defer userdata.measure("SetCompression")()
+	if userdata == nil || userdata.Username == "" || userdata.FilestructMac == nil || userdata.FilestructEnc == nil {
+		return errors.New(strings.ToTitle("ERROR"))
+	}
+	for attempt := 0; attempt < swapAttempts; attempt++ {
+		pointer, _ := userdata.loadFileStruct(filename)
+		if pointer == nil {
+			return errors.New(strings.ToTitle("Access not granted"))
+		}
+		curFileStruct := *pointer
+		err := userdata.checkLease(curFileStruct)
+		if err != nil {
+			return err
+		}
+		header, old := readFileHeader(curFileStruct)
+		if header == nil {
+			return errors.New(strings.ToTitle("verification failed"))
+		}
+		header.Compress = enabled
+		swapped, err := swapFileHeader(curFileStruct, old, *header)
+		if err != nil {
+			return err
+		}
+		if swapped {
+			return nil
+		}
+	}
+	return errors.New(strings.ToTitle("file is being changed by another session, try again"))
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"bytes"
+	"sync"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+)
+
+// Datastore only offers plain Get and Set, so two sessions that read the same header and then
+// write it back would silently lose one of their changes. Writes that depend on what was read go
+// through DatastoreCompareAndSwap instead. Like the userlib functions it can be replaced, e.g. by
+// a backend with its own conditional writes.
+
+// DatastoreCompareAndSwap sets key to value only if it currently holds old, and reports whether
+// the write happened. A nil old means the key must not have a value yet, and a nil value deletes
+// the key.
+var DatastoreCompareAndSwap = datastoreCompareAndSwap
+
+var datastoreLock sync.Mutex
+
+// the default backend makes the compare and the write atomic for every client in this process
+func datastoreCompareAndSwap(key userlib.UUID, old []byte, value []byte) bool {
+	datastoreLock.Lock()
+	defer datastoreLock.Unlock()
+	current, ok := userlib.DatastoreGet(key)
+	if ok != (old != nil) || !bytes.Equal(current, old) {
+		return false
+	}
+	if value == nil {
+		userlib.DatastoreDelete(key)
+	} else {
+		userlib.DatastoreSet(key, value)
+	}
+	return true
+}
+
+// Writing a file or revoking access touches many keys at once. These go through the batch
+// functions below, so a backend that can commit several writes in one request or transaction
+// can replace them. The defaults just call the userlib functions one key at a time.
+
+// DatastoreMultiGet returns the values of whichever of keys have one.
+var DatastoreMultiGet = datastoreMultiGet
+
+// DatastoreMultiSet sets every key in entries to its value.
+var DatastoreMultiSet = datastoreMultiSet
+
+// DatastoreMultiDelete deletes keys, in the order given.
+var DatastoreMultiDelete = datastoreMultiDelete
+
+func datastoreMultiGet(keys []userlib.UUID) map[userlib.UUID][]byte {
+	values := make(map[userlib.UUID][]byte)
+	for _, key := range keys {
+		value, ok := userlib.DatastoreGet(key)
+		if ok {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+func datastoreMultiSet(entries map[userlib.UUID][]byte) {
+	for key, value := range entries {
+		userlib.DatastoreSet(key, value)
+	}
+}
+
+func datastoreMultiDelete(keys []userlib.UUID) {
+	for _, key := range keys {
+		userlib.DatastoreDelete(key)
+	}
+}
@@ -0,0 +1,317 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Deduplication is opt-in per file. A deduplicated file's content key is its domain key, and
+// each data node is stored at an address derived from the domain key, the node before it and
+// its data, so two chains that start with the same blocks under the same domain share those
+// nodes. Each user has one domain, kept under their working keys, and turning deduplication on
+// puts the file in the domain of whoever turned it on, so near-identical files of the same user
+// share their common nodes. The domain key is in every such file's header, so anyone a
+// deduplicated file is shared with can read whatever is stored in the domain, including the
+// user's other deduplicated files, and check whether a guessed block is stored there.
+//
+// Since a node can be part of several chains, it is only deleted once nothing refers to it. Each
+// node has a reference set next to it listing the nodes that link back to it and the headers (or
+// snapshots) whose tail it is, identified by the header's Holder. Sets rather than counts make
+// adding or removing the same reference twice harmless, so a client that stops partway through
+// can simply run again; at worst it leaks a node, but it never deletes one that is still used.
+//
+// Revoking access to a deduplicated file gives the owner a fresh domain and moves the file to it.
+// Their other deduplicated files stay in the old domain, which the revoked user still knows,
+// until deduplication is turned on for them again and they are stored.
+
+func newDomain(start int) contentkey {
+	key := newContentKey(start)
+	key.Dedup = true
+	return key
+}
+
+func domainKeyGen(username string) userlib.UUID {
+	p1 := userlib.Hash([]byte(username))
+	p2 := userlib.Hash([]byte("domain"))
+	hashed := userlib.Hash(concatenateByteArrays(p1, p2))[:16]
+	dKey, _ := uuid.FromBytes(hashed)
+	return dKey
+}
+
+func (userdata *User) domainKeys() ([]byte, []byte, error) {
+	return userdata.workingKeys().derived("domain")
+}
+
+// loadDomain returns the user's deduplication domain, or nil if they don't have one yet, along
+// with its ciphertext
+func (userdata *User) loadDomain() (*contentkey, []byte, error) {
+	ciphertext, ok := datastoreGet(domainKeyGen(userdata.Username))
+	if !ok {
+		return nil, nil, nil
+	}
+	encKey, macKey, err := userdata.domainKeys()
+	if err != nil {
+		return nil, nil, err
+	}
+	domainBytes, err := VerifyDec(ciphertext, encKey, macKey)
+	if err != nil {
+		return nil, nil, errors.New(strings.ToTitle("verification failed"))
+	}
+	var domain contentkey
+	err = json.Unmarshal(domainBytes, &domain)
+	if err != nil || !domain.Dedup {
+		return nil, nil, errors.New(strings.ToTitle("verification failed"))
+	}
+	return &domain, ciphertext, nil
+}
+
+// renewDomain returns the user's deduplication domain, creating it if they have none. If replaced
+// is given and is still their domain, it is swapped for a fresh one first.
+func (userdata *User) renewDomain(replaced *contentkey) (contentkey, error) {
+	encKey, macKey, err := userdata.domainKeys()
+	if err != nil {
+		return contentkey{}, err
+	}
+	for attempt := 0; attempt < swapAttempts; attempt++ {
+		domain, old, err := userdata.loadDomain()
+		if err != nil {
+			return contentkey{}, err
+		}
+		if domain != nil && (replaced == nil || !bytes.Equal(domain.Mac, replaced.Mac)) {
+			return *domain, nil
+		}
+		fresh := newDomain(0)
+		domainBytes, err := json.Marshal(fresh)
+		if err != nil {
+			return contentkey{}, errors.New(strings.ToTitle("ERROR"))
+		}
+		if compareAndSwap(domainKeyGen(userdata.Username), old, EncMacGen(domainBytes, encKey, macKey)) {
+			return fresh, nil
+		}
+	}
+	return contentkey{}, errors.New(strings.ToTitle("domain is being changed by another session, try again"))
+}
+
+func sharedNodeAddress(key contentkey, prev uuid.UUID, data []byte) (uuid.UUID, error) {
+	addressKey, err := userlib.HashKDF(key.Mac, []byte("address"))
+	if err != nil {
+		return uuid.Nil, err
+	}
+	hashed, err := userlib.HMACEval(addressKey[:16], concatenateByteArrays(prev[:], data))
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return uuid.FromBytes(hashed[:16])
+}
+
+func refsKeyGen(address uuid.UUID) userlib.UUID {
+	hashed := userlib.Hash(concatenateByteArrays(address[:], []byte("refs")))[:16]
+	rKey, _ := uuid.FromBytes(hashed)
+	return rKey
+}
+
+func refsKeysGen(key contentkey, address uuid.UUID) ([]byte, []byte, error) {
+	encKey, err := userlib.HashKDF(key.Enc, []byte("refs-enc"+address.String()))
+	if err != nil {
+		return nil, nil, err
+	}
+	macKey, err := userlib.HashKDF(key.Mac, []byte("refs-mac"+address.String()))
+	if err != nil {
+		return nil, nil, err
+	}
+	return encKey[:16], macKey[:16], nil
+}
+
+// updateRefs adds or removes a reference to a shared node, returning how many are left and the
+// ciphertext of the set as stored
+func updateRefs(key contentkey, address uuid.UUID, referrer uuid.UUID, add bool) (int, []byte, error) {
+	encKey, macKey, err := refsKeysGen(key, address)
+	if err != nil {
+		return 0, nil, errors.New(strings.ToTitle("ERROR"))
+	}
+	for attempt := 0; attempt < swapAttempts; attempt++ {
+		refs := make(map[uuid.UUID]bool)
+		old, ok := datastoreGet(refsKeyGen(address))
+		if ok {
+			refsBytes, err := VerifyDec(old, encKey, macKey)
+			if err == nil {
+				_ = json.Unmarshal(refsBytes, &refs)
+			}
+		} else {
+			old = nil
+		}
+		if add {
+			refs[referrer] = true
+		} else {
+			delete(refs, referrer)
+		}
+		refsBytes, err := json.Marshal(refs)
+		if err != nil {
+			return 0, nil, errors.New(strings.ToTitle("ERROR"))
+		}
+		ciphertext := EncMacGen(refsBytes, encKey, macKey)
+		if compareAndSwap(refsKeyGen(address), old, ciphertext) {
+			return len(refs), ciphertext, nil
+		}
+	}
+	return 0, nil, errors.New(strings.ToTitle("file is being changed by another session, try again"))
+}
+
+// appendSharedNodes is appendNodes for a deduplicated file. References are added from the new
+// tail down, before each node is written, so a node is never left unreferenced.
+func (header *fileheader) appendSharedNodes(key contentkey, data []byte) ([]uuid.UUID, error) {
+	var nodes []filenode
+	var written []uuid.UUID
+	prev := header.Tail
+	index := 0
+	size := header.blockSize()
+	for ; index+size <= len(data); index += size {
+		block, err := header.encodeBlock(data[index : index+size])
+		if err != nil {
+			return nil, err
+		}
+		address, err := sharedNodeAddress(key, prev, block)
+		if err != nil {
+			return nil, errors.New(strings.ToTitle("ERROR"))
+		}
+		nodes = append(nodes, filenode{Prev: prev, Data: block})
+		written = append(written, address)
+		prev = address
+	}
+	header.Buffer = data[index:]
+	if len(written) == 0 {
+		return nil, nil
+	}
+
+	holder := uuid.New()
+	referrer := holder
+	nodeHashes := make([][]byte, len(written))
+	for i := len(written) - 1; i >= 0; i-- {
+		counter := header.Count + i
+		_, _, err := updateRefs(key, written[i], referrer, true)
+		if err != nil {
+			return nil, err
+		}
+		symKey, macKey, err := nodeKeysGen(key.Enc, key.Mac, counter)
+		if err != nil {
+			return nil, errors.New(strings.ToTitle("ERROR"))
+		}
+		// the digest covers whichever ciphertext of the node is stored, so one that another
+		// chain wrote is kept, and a new one is only written if nobody beat us to it
+		ciphertext, _ := datastoreGet(written[i])
+		if openFileNode(ciphertext, key, counter) == nil {
+			byteform, err := marshalObject(nodes[i])
+			if err != nil {
+				return nil, errors.New(strings.ToTitle("ERROR"))
+			}
+			fresh := EncMacGen(byteform, symKey, macKey)
+			if compareAndSwap(written[i], ciphertext, fresh) {
+				ciphertext = fresh
+			} else {
+				ciphertext, _ = datastoreGet(written[i])
+			}
+		}
+		nodeHashes[i] = userlib.Hash(ciphertext)
+		referrer = written[i]
+	}
+	header.extendDigest(nodeHashes)
+	if header.Tail != uuid.Nil {
+		_, _, err := updateRefs(header.contentKey(header.Count-1), header.Tail, referrer, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+	header.Tail = written[len(written)-1]
+	header.Count += len(written)
+	header.Holder = holder
+	return written, nil
+}
+
+// release drops a reference to a shared node, deleting it if that was the last one and carrying
+// on down the chain. Nodes of files that aren't deduplicated have no references to drop.
+func (header *fileheader) release(counter int, address uuid.UUID, referrer uuid.UUID) {
+	for counter >= 0 && address != uuid.Nil && referrer != uuid.Nil {
+		key := header.contentKey(counter)
+		if !key.Dedup {
+			return
+		}
+		remaining, refs, err := updateRefs(key, address, referrer, false)
+		if err != nil || remaining > 0 {
+			return
+		}
+		curnode := loadFileNode(address, key, counter)
+		if curnode == nil {
+			datastoreDelete(refsKeyGen(address))
+			return
+		}
+		// if somebody starts using the node again while it is being deleted, put it back, unless
+		// they already wrote it again themselves
+		ciphertext, _ := datastoreGet(address)
+		datastoreDelete(address)
+		if !compareAndSwap(refsKeyGen(address), refs, nil) {
+			compareAndSwap(address, nil, ciphertext)
+			return
+		}
+		referrer = address
+		address = curnode.Prev
+		counter--
+	}
+}
+
+// rollback throws away the nodes an append wrote when its header could not be stored
+func (header *fileheader) rollback(written []uuid.UUID) {
+	if len(written) == 0 {
+		return
+	}
+	if header.contentKey(header.Count - 1).Dedup {
+		header.release(header.Count-1, header.Tail, header.Holder)
+		return
+	}
+	multiDelete(written)
+}
+
+// SetDeduplication turns deduplication of a file's content on or off. Turning it on puts the file
+// in the caller's domain, and it takes effect the next time the file is stored.
+func (userdata *User) SetDeduplication(filename string, enabled bool) error {
+	defer userdata.measure("SetDeduplication")()
+	if userdata == nil || userdata.Username == "" || userdata.FilestructMac == nil || userdata.FilestructEnc == nil {
+		return errors.New(strings.ToTitle("ERROR"))
+	}
+	for attempt := 0; attempt < swapAttempts; attempt++ {
+		pointer, _ := userdata.loadFileStruct(filename)
+		if pointer == nil {
+			return errors.New(strings.ToTitle("Access not granted"))
+		}
+		curFileStruct := *pointer
+		err := userdata.checkLease(curFileStruct)
+		if err != nil {
+			return err
+		}
+		header, old := readFileHeader(curFileStruct)
+		if header == nil {
+			return errors.New(strings.ToTitle("verification failed"))
+		}
+		if !enabled {
+			header.Domain = nil
+		} else {
+			domain, err := userdata.renewDomain(nil)
+			if err != nil {
+				return err
+			}
+			header.Domain = &domain
+		}
+		swapped, err := swapFileHeader(curFileStruct, old, *header)
+		if err != nil {
+			return err
+		}
+		if swapped {
+			return nil
+		}
+	}
+	return errors.New(strings.ToTitle("file is being changed by another session, try again"))
+}
@@ -0,0 +1,345 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// A user can enroll devices, each with a key pair of its own. The public keys are kept in a
+// device list in the Datastore, signed with the account's latest sharesign key, and everything
+// sealed to the user (invitations, inbox notifications and group memberships) is sealed to the
+// account's latest shareenc key and to every device on the list. A session created by AddDevice holds
+// the device's private keys instead of the account's: it opens what is sealed to it with its own
+// key and signs with its own key, and other users check those signatures against the list.
+//
+// Removing a device takes it off the list, so nothing sealed from then on can be opened with its
+// keys, its signatures stop verifying, and its exported sessions no longer resume. Only sessions
+// logged in with the password hold the account keys, so only they can change the list. Devices
+// don't hold the account's root keys either, only the keys of the current epoch, and removing a
+// device moves the user's state to new ones (see epochs.go), so a removed device can neither read
+// what the user stores afterwards nor store anything in their name. It still knows the keys of
+// the files it could already open; revoke and share those again to change them.
+
+// MaxDevices is how many devices a user can enroll at once.
+const MaxDevices = 16
+
+// Device describes one of the user's enrolled devices.
+type Device struct {
+	ID    uuid.UUID
+	Name  string
+	Added time.Time
+}
+
+type device struct {
+	ID    uuid.UUID
+	Name  string
+	Added time.Time
+	Enc   userlib.PKEEncKey
+	Sign  userlib.DSVerifyKey
+}
+
+type devicelist struct {
+	Devices []device
+}
+
+func devicesKeyGen(username string) userlib.UUID {
+	p1 := userlib.Hash([]byte(username))
+	p2 := userlib.Hash([]byte("devices"))
+	hashed := userlib.Hash(concatenateByteArrays(p1, p2))[:16]
+	dKey, _ := uuid.FromBytes(hashed)
+	return dKey
+}
+
+// the device list's signature covers the username, so one user's list can't pass for another's
+func devicesSigned(username string, content []byte) []byte {
+	return concatenateByteArrays(content, []byte(username+"/devices"))
+}
+
+// loadDevices returns a user's enrolled devices, checking the list against the user's account
+// verify key. A user who never enrolled one has none; a list that fails to verify is an error,
+// since sealing to fewer devices than the user has would be the safe choice anyway.
+func loadDevices(username string, verifyKey userlib.DSVerifyKey) ([]device, error) {
+	signed, ok := datastoreGet(devicesKeyGen(username))
+	if !ok {
+		return nil, nil
+	}
+	var entry signedentry
+	err := json.Unmarshal(signed, &entry)
+	if err != nil {
+		return nil, errors.New(strings.ToTitle("invalid device list"))
+	}
+	err = userlib.DSVerify(verifyKey, devicesSigned(username, entry.Content), entry.Signature)
+	if err != nil {
+		return nil, errors.New(strings.ToTitle("invalid device list"))
+	}
+	var list devicelist
+	err = json.Unmarshal(entry.Content, &list)
+	if err != nil {
+		return nil, errors.New(strings.ToTitle("invalid device list"))
+	}
+	return list.Devices, nil
+}
+
+func (userdata *User) storeDevices(devices []device) error {
+	listBytes, err := json.Marshal(devicelist{Devices: devices})
+	if err != nil {
+		return err
+	}
+	sig, err := userdata.sign(devicesSigned(userdata.Username, listBytes))
+	if err != nil {
+		return err
+	}
+	signed, err := json.Marshal(signedentry{Content: listBytes, Signature: sig})
+	if err != nil {
+		return err
+	}
+	datastoreSet(devicesKeyGen(userdata.Username), signed)
+	return nil
+}
+
+// ownDevices loads the user's own device list, which is signed with their latest account key
+func (userdata *User) ownDevices() ([]device, error) {
+	versions, err := accountKeys(userdata.Username)
+	if err != nil {
+		return nil, err
+	}
+	return loadDevices(userdata.Username, versions[len(versions)-1].Sign)
+}
+
+// holdsAccountKeys says whether the session logged in with the password rather than as a device
+func (userdata *User) holdsAccountKeys() bool {
+	return userdata.Device == uuid.Nil
+}
+
+// AddDevice enrolls a new device under the given name and returns a session for it. The session
+// holds the device's keys instead of the account's, and is usually handed to the device with
+// ExportSession.
+func (userdata *User) AddDevice(name string) (*User, error) {
+	defer userdata.measure("AddDevice")()
+	if userdata == nil || userdata.Username == "" || userdata.FilestructMac == nil || userdata.FilestructEnc == nil {
+		return nil, errors.New(strings.ToTitle("ERROR"))
+	}
+	if !userdata.holdsAccountKeys() {
+		return nil, errors.New(strings.ToTitle("only a session logged in with the password can add devices"))
+	}
+	if name == "" {
+		return nil, errors.New(strings.ToTitle("device name cannot be empty"))
+	}
+	devices, err := userdata.ownDevices()
+	if err != nil {
+		return nil, err
+	}
+	for _, other := range devices {
+		if other.Name == name {
+			return nil, errors.New(strings.ToTitle("there is already a device with this name"))
+		}
+	}
+	if len(devices) >= MaxDevices {
+		return nil, errors.New(strings.ToTitle("too many devices"))
+	}
+	pk, sk, err := userlib.PKEKeyGen()
+	if err != nil {
+		return nil, err
+	}
+	signKey, verifyKey, err := userlib.DSKeyGen()
+	if err != nil {
+		return nil, err
+	}
+	enrolled := device{ID: uuid.New(), Name: name, Added: time.Now(), Enc: pk, Sign: verifyKey}
+	err = userdata.storeDeviceKeys(enrolled, userdata.epoch, userdata.workingKeys())
+	if err != nil {
+		return nil, err
+	}
+	err = userdata.storeDevices(append(devices, enrolled))
+	if err != nil {
+		return nil, err
+	}
+
+	session := User{
+		Username: userdata.Username,
+
+		SharePublicKeyEnc:  userdata.SharePublicKeyEnc,
+		SharePublicKeySign: userdata.SharePublicKeySign,
+
+		Device:        enrolled.ID,
+		DeviceKeyEnc:  sk,
+		DeviceKeySign: signKey,
+
+		session: uuid.New(),
+	}
+	session.setWorkingKeys(userdata.workingKeys(), userdata.epoch)
+	return &session, nil
+}
+
+// ListDevices lists the user's enrolled devices, oldest first.
+func (userdata *User) ListDevices() ([]Device, error) {
+	defer userdata.measure("ListDevices")()
+	if userdata == nil || userdata.Username == "" {
+		return nil, errors.New(strings.ToTitle("ERROR"))
+	}
+	devices, err := userdata.ownDevices()
+	if err != nil {
+		return nil, err
+	}
+	listed := []Device{}
+	for _, enrolled := range devices {
+		listed = append(listed, Device{ID: enrolled.ID, Name: enrolled.Name, Added: enrolled.Added})
+	}
+	return listed, nil
+}
+
+// RemoveDevice takes the named device off the user's device list and moves the user's state to
+// keys it doesn't have.
+func (userdata *User) RemoveDevice(name string) error {
+	defer userdata.measure("RemoveDevice")()
+	if userdata == nil || userdata.Username == "" {
+		return errors.New(strings.ToTitle("ERROR"))
+	}
+	if !userdata.holdsAccountKeys() {
+		return errors.New(strings.ToTitle("only a session logged in with the password can remove devices"))
+	}
+	devices, err := userdata.ownDevices()
+	if err != nil {
+		return err
+	}
+	for _, enrolled := range devices {
+		if enrolled.Name == name {
+			return userdata.beginEpoch(enrolled.ID)
+		}
+	}
+	return errors.New(strings.ToTitle("device not found"))
+}
+
+// enrolled says whether the session's device is still on the user's list
+func (userdata *User) enrolled() bool {
+	if userdata.holdsAccountKeys() {
+		return true
+	}
+	devices, err := userdata.ownDevices()
+	if err != nil {
+		return false
+	}
+	for _, enrolled := range devices {
+		if enrolled.ID == userdata.Device {
+			return true
+		}
+	}
+	return false
+}
+
+// sealTo seals content so that the account's latest keys and every enrolled device of username
+// can open it.
+// Users without devices get the single-key format of pkeSeal.
+func (userdata *User) sealTo(username string, content []byte) ([]byte, error) {
+	versions, err := userdata.peerKeys(username)
+	if err != nil {
+		return nil, err
+	}
+	latest := versions[len(versions)-1]
+	devices, err := loadDevices(username, latest.Sign)
+	if err != nil {
+		return nil, err
+	}
+	if len(devices) == 0 {
+		return pkeSeal(latest.Enc, content)
+	}
+	keys := []userlib.PKEEncKey{latest.Enc}
+	for _, enrolled := range devices {
+		keys = append(keys, enrolled.Enc)
+	}
+	return pkeSealAll(keys, content)
+}
+
+// pkeSealAll is pkeSeal for several public keys at once: a byte counting the keys, the
+// symmetric keys wrapped for each of them in turn, then the content.
+func pkeSealAll(publicKeys []userlib.PKEEncKey, content []byte) ([]byte, error) {
+	keys := userlib.RandomBytes(32)
+	sealed := []byte{byte(len(publicKeys))}
+	for _, publicKey := range publicKeys {
+		wrapped, err := userlib.PKEEnc(publicKey, keys)
+		if err != nil {
+			return nil, err
+		}
+		sealed = concatenateByteArrays(sealed, wrapped)
+	}
+	return concatenateByteArrays(sealed, EncMacGen(content, keys[:16], keys[16:])), nil
+}
+
+// open decrypts something sealed to the user with whichever private keys the session holds
+func (userdata *User) open(sealed []byte) ([]byte, error) {
+	privateKeys := userdata.decKeys()
+	if len(sealed) > 0 {
+		count := int(sealed[0])
+		body := 1 + count*pkeCipherLen
+		if count > 0 && count <= MaxDevices+1 && len(sealed) >= body+userlib.AESBlockSizeBytes+userlib.HashSizeBytes {
+			for i := 0; i < count; i++ {
+				for _, privateKey := range privateKeys {
+					keys, err := userlib.PKEDec(privateKey, sealed[1+i*pkeCipherLen:1+(i+1)*pkeCipherLen])
+					if err != nil || len(keys) != 32 {
+						continue
+					}
+					content, err := VerifyDec(sealed[body:], keys[:16], keys[16:])
+					if err == nil {
+						return content, nil
+					}
+				}
+			}
+		}
+	}
+	if !userdata.holdsAccountKeys() {
+		return nil, errors.New(strings.ToTitle("invalid"))
+	}
+	for _, privateKey := range privateKeys {
+		content, err := pkeOpen(privateKey, sealed)
+		if err == nil {
+			return content, nil
+		}
+	}
+	return nil, errors.New(strings.ToTitle("invalid"))
+}
+
+// sign signs content with the account's latest key, or the device's key in a device session
+func (userdata *User) sign(content []byte) ([]byte, error) {
+	if !userdata.holdsAccountKeys() {
+		return userlib.DSSign(userdata.DeviceKeySign, content)
+	}
+	_, keys, err := userdata.accountKeyring()
+	if err != nil {
+		return nil, err
+	}
+	return userlib.DSSign(keys[len(keys)-1].Sign, content)
+}
+
+// verifySignature checks a signature made by any version of username's account keys or by one
+// of their devices
+func (userdata *User) verifySignature(username string, content []byte, sig []byte) bool {
+	versions, err := userdata.peerKeys(username)
+	if err != nil {
+		return false
+	}
+	return signatureValid(username, versions, content, sig)
+}
+
+// signatureValid is verifySignature for versions of the keys the caller already trusts
+func signatureValid(username string, versions []keyversion, content []byte, sig []byte) bool {
+	for _, version := range versions {
+		if userlib.DSVerify(version.Sign, content, sig) == nil {
+			return true
+		}
+	}
+	devices, err := loadDevices(username, versions[len(versions)-1].Sign)
+	if err != nil {
+		return false
+	}
+	for _, enrolled := range devices {
+		if userlib.DSVerify(enrolled.Sign, content, sig) == nil {
+			return true
+		}
+	}
+	return false
+}
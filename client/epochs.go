@@ -0,0 +1,572 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Only sessions logged in with the password hold the account's root keys. The user's own state
+// (the file list, filestructs, sharetrees, groups and the rest) is kept under working keys derived
+// from the root keys for the current epoch, and each enrolled device is given that epoch's working
+// keys, sealed to the device and signed by the account. Removing a device starts a new epoch: the
+// device is taken off the list and its copy of the keys is deleted, the other devices are given
+// the new keys, and everything the user keeps is moved to them. A removed device still knows the
+// old keys, but nothing is kept under them anymore, so it can't open what the user stores from
+// then on, and whatever it writes with them is refused like any other tampering.
+//
+// The epoch is recorded under the root keys, along with the removal while the move is unfinished,
+// so a session that stops partway is finished by the next one logged in with the password. A hint
+// next to it, which every session can read, says when to load the keys again. It is only a hint:
+// the epoch and the keys it leads to are checked whenever they are loaded.
+
+// the keys the user's own state is kept under in one epoch
+type workingkeys struct {
+	FilestructEnc []byte
+	FilestructMac []byte
+	SharetreeEnc  []byte
+	SharetreeMac  []byte
+}
+
+// the account's current epoch, readable only with the root keys
+type epochrecord struct {
+	Epoch int
+	// set until the user's state has moved to the epoch's keys, after Removed was removed
+	Moving  bool      `json:",omitempty"`
+	Removed uuid.UUID `json:",omitempty"`
+}
+
+// what a device is given for an epoch: the working keys, sealed to the device
+type devicekeys struct {
+	Epoch  int
+	Device uuid.UUID
+	Keys   []byte
+}
+
+func epochKeyGen(username string) userlib.UUID {
+	p1 := userlib.Hash([]byte(username))
+	p2 := userlib.Hash([]byte("epoch"))
+	hashed := userlib.Hash(concatenateByteArrays(p1, p2))[:16]
+	eKey, _ := uuid.FromBytes(hashed)
+	return eKey
+}
+
+func epochHintKeyGen(username string) userlib.UUID {
+	p1 := userlib.Hash([]byte(username))
+	p2 := userlib.Hash([]byte("epoch-hint"))
+	hashed := userlib.Hash(concatenateByteArrays(p1, p2))[:16]
+	hKey, _ := uuid.FromBytes(hashed)
+	return hKey
+}
+
+func deviceKeysKeyGen(username string, id uuid.UUID) userlib.UUID {
+	p1 := userlib.Hash([]byte(username))
+	p2 := userlib.Hash(id[:])
+	p3 := userlib.Hash([]byte("device-keys"))
+	hashed := userlib.Hash(concatenateByteArrays(concatenateByteArrays(p1, p2), p3))[:16]
+	dKey, _ := uuid.FromBytes(hashed)
+	return dKey
+}
+
+// the signature on a device's keys covers the username, so one user's can't pass for another's
+func deviceKeysSigned(username string, content []byte) []byte {
+	return concatenateByteArrays(content, []byte(username+"/device-keys"))
+}
+
+// derived returns the keys for one kind of the user's state, e.g. "namespace"
+func (keys workingkeys) derived(label string) ([]byte, []byte, error) {
+	encKey, err := userlib.HashKDF(keys.FilestructEnc, []byte(label+"-enc"))
+	if err != nil {
+		return nil, nil, err
+	}
+	macKey, err := userlib.HashKDF(keys.FilestructMac, []byte(label+"-mac"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return encKey[:16], macKey[:16], nil
+}
+
+func (userdata *User) workingKeys() workingkeys {
+	return workingkeys{
+		FilestructEnc: userdata.FilestructEnc,
+		FilestructMac: userdata.FilestructMac,
+		SharetreeEnc:  userdata.SharetreeEnc,
+		SharetreeMac:  userdata.SharetreeMac,
+	}
+}
+
+func (userdata *User) setWorkingKeys(keys workingkeys, epoch int) {
+	userdata.FilestructEnc = keys.FilestructEnc
+	userdata.FilestructMac = keys.FilestructMac
+	userdata.SharetreeEnc = keys.SharetreeEnc
+	userdata.SharetreeMac = keys.SharetreeMac
+	userdata.epoch = epoch
+}
+
+// epochKeys derives the working keys of an epoch from the root keys
+func (userdata *User) epochKeys(epoch int) (workingkeys, error) {
+	suffix := "/" + strconv.Itoa(epoch)
+	filestructEnc, err := userlib.HashKDF(userdata.AccountEnc, []byte("filestruct-enc"+suffix))
+	if err != nil {
+		return workingkeys{}, err
+	}
+	filestructMac, err := userlib.HashKDF(userdata.AccountMac, []byte("filestruct-mac"+suffix))
+	if err != nil {
+		return workingkeys{}, err
+	}
+	sharetreeEnc, err := userlib.HashKDF(userdata.AccountEnc, []byte("sharetree-enc"+suffix))
+	if err != nil {
+		return workingkeys{}, err
+	}
+	sharetreeMac, err := userlib.HashKDF(userdata.AccountMac, []byte("sharetree-mac"+suffix))
+	if err != nil {
+		return workingkeys{}, err
+	}
+	return workingkeys{
+		FilestructEnc: filestructEnc[:16],
+		FilestructMac: filestructMac[:16],
+		SharetreeEnc:  sharetreeEnc[:16],
+		SharetreeMac:  sharetreeMac[:16],
+	}, nil
+}
+
+func (userdata *User) epochRecordKeys() ([]byte, []byte, error) {
+	encKey, err := userlib.HashKDF(userdata.AccountEnc, []byte("epoch-enc"))
+	if err != nil {
+		return nil, nil, err
+	}
+	macKey, err := userlib.HashKDF(userdata.AccountMac, []byte("epoch-mac"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return encKey[:16], macKey[:16], nil
+}
+
+// helper method to load the account's epoch record, along with its ciphertext
+func (userdata *User) loadEpochRecord() (*epochrecord, []byte, error) {
+	ciphertext, ok := datastoreGet(epochKeyGen(userdata.Username))
+	if !ok {
+		return nil, nil, errors.New(strings.ToTitle("the account's keys are missing"))
+	}
+	encKey, macKey, err := userdata.epochRecordKeys()
+	if err != nil {
+		return nil, nil, err
+	}
+	recordBytes, err := VerifyDec(ciphertext, encKey, macKey)
+	if err != nil {
+		return nil, nil, errors.New(strings.ToTitle("verification failed"))
+	}
+	var record epochrecord
+	err = json.Unmarshal(recordBytes, &record)
+	if err != nil || record.Epoch < 1 {
+		return nil, nil, errors.New(strings.ToTitle("verification failed"))
+	}
+	return &record, ciphertext, nil
+}
+
+func (userdata *User) sealEpochRecord(record epochrecord) ([]byte, error) {
+	encKey, macKey, err := userdata.epochRecordKeys()
+	if err != nil {
+		return nil, err
+	}
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return EncMacGen(recordBytes, encKey, macKey), nil
+}
+
+// startEpochs records the first epoch of a new user and gives the session its keys
+func (userdata *User) startEpochs() error {
+	keys, err := userdata.epochKeys(1)
+	if err != nil {
+		return err
+	}
+	sealed, err := userdata.sealEpochRecord(epochrecord{Epoch: 1})
+	if err != nil {
+		return err
+	}
+	datastoreSet(epochKeyGen(userdata.Username), sealed)
+	datastoreSet(epochHintKeyGen(userdata.Username), []byte("1"))
+	userdata.setWorkingKeys(keys, 1)
+	return nil
+}
+
+// loadEpoch brings the session's working keys up to date. Unless the hint says the epoch changed
+// it reads nothing else. A session whose keys can't be loaded is left without any, so that every
+// operation fails until they can.
+func (userdata *User) loadEpoch() error {
+	userdata.epochLock.Lock()
+	defer userdata.epochLock.Unlock()
+	hint, ok := datastoreGet(epochHintKeyGen(userdata.Username))
+	if ok && userdata.epoch != 0 && string(hint) == strconv.Itoa(userdata.epoch) {
+		return nil
+	}
+	var err error
+	if userdata.holdsAccountKeys() {
+		err = userdata.loadAccountEpoch()
+	} else {
+		err = userdata.loadDeviceEpoch()
+	}
+	if err != nil {
+		userdata.setWorkingKeys(workingkeys{}, 0)
+	}
+	return err
+}
+
+func (userdata *User) loadAccountEpoch() error {
+	record, old, err := userdata.loadEpochRecord()
+	if err != nil {
+		return err
+	}
+	if record.Epoch < userdata.epoch {
+		return errors.New(strings.ToTitle("the account's keys went back to an earlier epoch"))
+	}
+	if record.Moving {
+		return userdata.finishEpoch(record, old)
+	}
+	if record.Epoch == userdata.epoch {
+		return nil
+	}
+	keys, err := userdata.epochKeys(record.Epoch)
+	if err != nil {
+		return err
+	}
+	userdata.setWorkingKeys(keys, record.Epoch)
+	return nil
+}
+
+// loadDeviceEpoch opens the keys the account gave the session's device
+func (userdata *User) loadDeviceEpoch() error {
+	signed, ok := datastoreGet(deviceKeysKeyGen(userdata.Username, userdata.Device))
+	if !ok {
+		return errors.New(strings.ToTitle("device was removed"))
+	}
+	var entry signedentry
+	err := json.Unmarshal(signed, &entry)
+	if err != nil {
+		return errors.New(strings.ToTitle("invalid device keys"))
+	}
+	// only the account signs a device's keys, so a device can't hand keys to another
+	versions, err := accountKeys(userdata.Username)
+	if err != nil {
+		return err
+	}
+	own, err := keyFingerprint(userdata.SharePublicKeyEnc, userdata.SharePublicKeySign)
+	if err != nil {
+		return err
+	}
+	first, err := keyFingerprint(versions[0].Enc, versions[0].Sign)
+	if err != nil || own != first {
+		return errors.New(strings.ToTitle("the keystore has the wrong keys for this user"))
+	}
+	valid := false
+	for _, version := range versions {
+		if userlib.DSVerify(version.Sign, deviceKeysSigned(userdata.Username, entry.Content), entry.Signature) == nil {
+			valid = true
+			break
+		}
+	}
+	var given devicekeys
+	if !valid || json.Unmarshal(entry.Content, &given) != nil || given.Device != userdata.Device {
+		return errors.New(strings.ToTitle("invalid device keys"))
+	}
+	if given.Epoch < userdata.epoch {
+		return errors.New(strings.ToTitle("the account's keys went back to an earlier epoch"))
+	}
+	if given.Epoch == userdata.epoch {
+		return nil
+	}
+	keysBytes, err := pkeOpen(userdata.DeviceKeyEnc, given.Keys)
+	if err != nil {
+		return errors.New(strings.ToTitle("invalid device keys"))
+	}
+	var keys workingkeys
+	err = json.Unmarshal(keysBytes, &keys)
+	if err != nil {
+		return errors.New(strings.ToTitle("invalid device keys"))
+	}
+	userdata.setWorkingKeys(keys, given.Epoch)
+	return nil
+}
+
+// storeDeviceKeys gives a device the working keys of an epoch
+func (userdata *User) storeDeviceKeys(enrolled device, epoch int, keys workingkeys) error {
+	keysBytes, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	sealed, err := pkeSeal(enrolled.Enc, keysBytes)
+	if err != nil {
+		return err
+	}
+	contentBytes, err := json.Marshal(devicekeys{Epoch: epoch, Device: enrolled.ID, Keys: sealed})
+	if err != nil {
+		return err
+	}
+	sig, err := userdata.sign(deviceKeysSigned(userdata.Username, contentBytes))
+	if err != nil {
+		return err
+	}
+	signed, err := json.Marshal(signedentry{Content: contentBytes, Signature: sig})
+	if err != nil {
+		return err
+	}
+	datastoreSet(deviceKeysKeyGen(userdata.Username, enrolled.ID), signed)
+	return nil
+}
+
+// beginEpoch starts the epoch that removes the device with the given ID and moves the user's
+// state to it. A move another session left unfinished is finished first.
+func (userdata *User) beginEpoch(removed uuid.UUID) error {
+	userdata.epochLock.Lock()
+	defer userdata.epochLock.Unlock()
+	for attempt := 0; attempt < swapAttempts; attempt++ {
+		record, old, err := userdata.loadEpochRecord()
+		if err != nil {
+			return err
+		}
+		if record.Moving {
+			err = userdata.finishEpoch(record, old)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		next := epochrecord{Epoch: record.Epoch + 1, Moving: true, Removed: removed}
+		sealed, err := userdata.sealEpochRecord(next)
+		if err != nil {
+			return err
+		}
+		if compareAndSwap(epochKeyGen(userdata.Username), old, sealed) {
+			return userdata.finishEpoch(&next, sealed)
+		}
+	}
+	return errors.New(strings.ToTitle("devices are being changed by another session, try again"))
+}
+
+// finishEpoch takes the removed device off the list, gives the other devices the new keys and
+// moves the user's state to them. Every step can be repeated, so any session holding the root
+// keys can finish an epoch another one started.
+func (userdata *User) finishEpoch(record *epochrecord, old []byte) error {
+	datastoreSet(epochHintKeyGen(userdata.Username), []byte(strconv.Itoa(record.Epoch)))
+	devices, err := userdata.ownDevices()
+	if err != nil {
+		return err
+	}
+	var kept []device
+	for _, enrolled := range devices {
+		if enrolled.ID != record.Removed {
+			kept = append(kept, enrolled)
+		}
+	}
+	if len(kept) == 0 {
+		// no list at all is the same as an empty one, and there is nothing to sign again when
+		// the account's keys rotate
+		datastoreDelete(devicesKeyGen(userdata.Username))
+	} else if len(kept) != len(devices) {
+		err = userdata.storeDevices(kept)
+		if err != nil {
+			return err
+		}
+	}
+	datastoreDelete(deviceKeysKeyGen(userdata.Username, record.Removed))
+
+	from, err := userdata.epochKeys(record.Epoch - 1)
+	if err != nil {
+		return err
+	}
+	to, err := userdata.epochKeys(record.Epoch)
+	if err != nil {
+		return err
+	}
+	for _, enrolled := range kept {
+		err = userdata.storeDeviceKeys(enrolled, record.Epoch, to)
+		if err != nil {
+			return err
+		}
+	}
+	err = moveState(userdata.Username, from, to)
+	if err != nil {
+		return err
+	}
+
+	sealed, err := userdata.sealEpochRecord(epochrecord{Epoch: record.Epoch})
+	if err != nil {
+		return err
+	}
+	if !compareAndSwap(epochKeyGen(userdata.Username), old, sealed) {
+		// another session finished first, or has already started the next epoch
+		return userdata.loadAccountEpoch()
+	}
+	userdata.setWorkingKeys(to, record.Epoch)
+	return nil
+}
+
+// moveObject re-encrypts the object at address from one pair of keys to the other and returns
+// its content. An object already under the new keys is left as it is, and one that verifies under
+// neither pair is skipped, since it was tampered with and has nothing to keep.
+func moveObject(address userlib.UUID, fromEnc []byte, fromMac []byte, toEnc []byte, toMac []byte) ([]byte, error) {
+	for attempt := 0; attempt < swapAttempts; attempt++ {
+		ciphertext, ok := datastoreGet(address)
+		if !ok {
+			return nil, nil
+		}
+		content, err := VerifyDec(ciphertext, toEnc, toMac)
+		if err == nil {
+			return content, nil
+		}
+		content, err = VerifyDec(ciphertext, fromEnc, fromMac)
+		if err != nil {
+			return nil, nil
+		}
+		if compareAndSwap(address, ciphertext, EncMacGen(content, toEnc, toMac)) {
+			return content, nil
+		}
+	}
+	return nil, errors.New(strings.ToTitle("the user's state is being changed by another session, try again"))
+}
+
+// moveDerived is moveObject for state kept under keys derived for label
+func moveDerived(address userlib.UUID, label string, from workingkeys, to workingkeys) ([]byte, error) {
+	fromEnc, fromMac, err := from.derived(label)
+	if err != nil {
+		return nil, err
+	}
+	toEnc, toMac, err := to.derived(label)
+	if err != nil {
+		return nil, err
+	}
+	return moveObject(address, fromEnc, fromMac, toEnc, toMac)
+}
+
+// moveState moves everything the user keeps under the working keys of one epoch to the next.
+// The file list goes first, so a move that is started again still knows which files to move.
+func moveState(username string, from workingkeys, to workingkeys) error {
+	namesBytes, err := moveDerived(namespaceKeyGen(username), "namespace", from, to)
+	if err != nil {
+		return err
+	}
+	_, err = moveDerived(sessionsKeyGen(username), "sessions", from, to)
+	if err != nil {
+		return err
+	}
+	_, err = moveDerived(keylogHeadKeyGen(username), "keylog", from, to)
+	if err != nil {
+		return err
+	}
+	_, err = moveDerived(domainKeyGen(username), "domain", from, to)
+	if err != nil {
+		return err
+	}
+	err = movePins(username, from, to)
+	if err != nil {
+		return err
+	}
+	_, err = moveObject(journalKeyGen(username), from.SharetreeEnc, from.SharetreeMac, to.SharetreeEnc, to.SharetreeMac)
+	if err != nil {
+		return err
+	}
+	_, err = moveObject(handoffsKeyGen(username), from.SharetreeEnc, from.SharetreeMac, to.SharetreeEnc, to.SharetreeMac)
+	if err != nil {
+		return err
+	}
+
+	var names namespace
+	if namesBytes != nil && json.Unmarshal(namesBytes, &names) != nil {
+		return nil
+	}
+	for _, filename := range names.Files {
+		filestructBytes, err := moveObject(filestructKeyGen(username, filename), from.FilestructEnc, from.FilestructMac,
+			to.FilestructEnc, to.FilestructMac)
+		if err != nil {
+			return err
+		}
+		var curFileStruct filestruct
+		if filestructBytes != nil && unmarshalObject(filestructBytes, &curFileStruct) == nil && curFileStruct.First != uuid.Nil {
+			err = moveLease(username, curFileStruct, from, to)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = moveObject(keepKeyGen(username, filename), from.FilestructEnc, from.FilestructMac, to.FilestructEnc, to.FilestructMac)
+		if err != nil {
+			return err
+		}
+		_, err = moveObject(generateSharetreeKey(username, filename), from.SharetreeEnc, from.SharetreeMac, to.SharetreeEnc, to.SharetreeMac)
+		if err != nil {
+			return err
+		}
+		tailBytes, err := moveObject(shareLogKeyGen(username, filename), from.SharetreeEnc, from.SharetreeMac, to.SharetreeEnc, to.SharetreeMac)
+		if err != nil {
+			return err
+		}
+		address, _ := uuid.FromBytes(tailBytes)
+		for address != uuid.Nil {
+			entryBytes, err := moveObject(address, from.SharetreeEnc, from.SharetreeMac, to.SharetreeEnc, to.SharetreeMac)
+			if err != nil {
+				return err
+			}
+			var entry shareentry
+			if entryBytes == nil || unmarshalObject(entryBytes, &entry) != nil {
+				break
+			}
+			address = entry.Prev
+		}
+	}
+	for _, groupname := range names.Groups {
+		_, err = moveObject(groupKeyGen(username, groupname), from.SharetreeEnc, from.SharetreeMac, to.SharetreeEnc, to.SharetreeMac)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// movePins moves the pin index, then each bucket it marks to its address under the new keys
+func movePins(username string, from workingkeys, to workingkeys) error {
+	indexBytes, err := moveDerived(pinIndexKeyGen(username), "pins", from, to)
+	if err != nil || indexBytes == nil {
+		return err
+	}
+	var index pinindex
+	if json.Unmarshal(indexBytes, &index) != nil || len(index.Used) != pinBuckets/8 {
+		return nil
+	}
+	fromEnc, fromMac, err := from.derived("pins")
+	if err != nil {
+		return err
+	}
+	toEnc, toMac, err := to.derived("pins")
+	if err != nil {
+		return err
+	}
+	for bucket := 0; bucket < pinBuckets; bucket++ {
+		if index.Used[bucket/8]&(1<<(bucket%8)) == 0 {
+			continue
+		}
+		oldAddress, err := pinBucketKeyGen(bucket, fromMac)
+		if err != nil {
+			return err
+		}
+		newAddress, err := pinBucketKeyGen(bucket, toMac)
+		if err != nil {
+			return err
+		}
+		ciphertext, ok := datastoreGet(oldAddress)
+		if !ok {
+			continue
+		}
+		bucketBytes, err := VerifyDec(ciphertext, fromEnc, fromMac)
+		if err == nil {
+			// a bucket already written under the new keys is newer than this one
+			compareAndSwap(newAddress, nil, EncMacGen(bucketBytes, toEnc, toMac))
+		}
+		datastoreDelete(oldAddress)
+	}
+	return nil
+}
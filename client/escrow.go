@@ -0,0 +1,308 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Besides recovery codes, a user can escrow their recovery key (see recovery.go) with trusted
+// teammates so that any threshold of them can restore the account together. The recovery key is
+// encrypted under a fresh escrow key, and the escrow key is split with Shamir's scheme (see
+// shamir.go) into one share per trustee. Each share is signed by the user and sealed to the
+// trustee's shareenc key. Escrowing again makes a new escrow key, so shares handed out before are
+// of no use any more. Like GenerateRecoveryCodes, escrowing refuses a recovery key that doesn't
+// verify, so the shares never protect a key the server chose.
+//
+// To recover, the user starts a request from any client. The request holds a fresh public key
+// and its UUID is derived from that key, so the user can read the UUID out to each trustee and
+// the trustee knows the key hasn't been swapped in the Datastore. Each trustee opens their share
+// and reseals it to the request's key. Once enough shares are in, the user combines them, opens
+// the recovery key and sets a new password.
+
+type escrow struct {
+	ID        uuid.UUID
+	Threshold int
+	Trustees  []string
+	// the recovery key, encrypted under the escrow key
+	Key []byte
+}
+
+// what each trustee holds
+type escrowshare struct {
+	Owner  string
+	Escrow uuid.UUID
+	Share  []byte
+}
+
+// what a trustee passes on to a recovery request: their share as the owner signed it
+type escrowrelease struct {
+	Trustee string
+	Entry   signedentry
+}
+
+type escrowrequest struct {
+	Owner  string
+	Key    userlib.PKEEncKey
+	Shares [][]byte
+}
+
+// EscrowRecovery is a request to restore an account from escrowed shares. ID is what the user
+// gives each trustee to pass to ReleaseEscrowShare.
+type EscrowRecovery struct {
+	ID       uuid.UUID
+	username string
+	key      userlib.PKEDecKey
+}
+
+func escrowShareKeyGen(owner string, trustee string) userlib.UUID {
+	p1 := userlib.Hash([]byte(owner))
+	p2 := userlib.Hash([]byte(trustee))
+	p3 := userlib.Hash([]byte("escrow"))
+	hashed := userlib.Hash(concatenateByteArrays(concatenateByteArrays(p1, p2), p3))[:16]
+	eKey, _ := uuid.FromBytes(hashed)
+	return eKey
+}
+
+// escrowRequestID derives a request's UUID from its public key
+func escrowRequestID(key userlib.PKEEncKey) (uuid.UUID, error) {
+	keyBytes, err := json.Marshal(key)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return uuid.FromBytes(userlib.Hash(concatenateByteArrays([]byte("escrow-request"), keyBytes))[:16])
+}
+
+func escrowKeys(key []byte) ([]byte, []byte, error) {
+	encKey, err := userlib.HashKDF(key, []byte("escrow-enc"))
+	if err != nil {
+		return nil, nil, err
+	}
+	macKey, err := userlib.HashKDF(key, []byte("escrow-mac"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return encKey[:16], macKey[:16], nil
+}
+
+// EscrowAccountKey splits the user's recovery key among trustees, any threshold of whom can
+// later help restore the account. It replaces any earlier escrow.
+func (userdata *User) EscrowAccountKey(trustees []string, threshold int) error {
+	defer userdata.measure("EscrowAccountKey")()
+	if userdata == nil || userdata.Username == "" || userdata.FilestructMac == nil || userdata.FilestructEnc == nil {
+		return errors.New(strings.ToTitle("ERROR"))
+	}
+	seen := make(map[string]bool)
+	for _, trustee := range trustees {
+		if trustee == userdata.Username || seen[trustee] {
+			return errors.New(strings.ToTitle("trustees must be distinct other users"))
+		}
+		seen[trustee] = true
+	}
+	if threshold < 1 || threshold > len(trustees) {
+		return errors.New(strings.ToTitle("invalid threshold"))
+	}
+	key, state, err := userdata.recoveryKey()
+	if err != nil {
+		return err
+	}
+	err = userdata.sealRecoveryUser(key, state)
+	if err != nil {
+		return err
+	}
+	escrowKey := userlib.RandomBytes(16)
+	shares, err := splitSecret(escrowKey, len(trustees), threshold)
+	if err != nil {
+		return err
+	}
+	encKey, macKey, err := escrowKeys(escrowKey)
+	if err != nil {
+		return err
+	}
+	previous := state.Escrow
+	state.Escrow = &escrow{
+		ID:        uuid.New(),
+		Threshold: threshold,
+		Trustees:  trustees,
+		Key:       EncMacGen(key, encKey, macKey),
+	}
+	sealedShares := make(map[uuid.UUID][]byte)
+	for i, trustee := range trustees {
+		shareBytes, err := json.Marshal(escrowshare{Owner: userdata.Username, Escrow: state.Escrow.ID, Share: shares[i]})
+		if err != nil {
+			return err
+		}
+		sealed, err := userdata.signAndSeal(trustee, shareBytes)
+		if err != nil {
+			return err
+		}
+		sealedShares[escrowShareKeyGen(userdata.Username, trustee)] = sealed
+	}
+	if previous != nil {
+		var stale []uuid.UUID
+		for _, trustee := range previous.Trustees {
+			if !seen[trustee] {
+				stale = append(stale, escrowShareKeyGen(userdata.Username, trustee))
+			}
+		}
+		multiDelete(stale)
+	}
+	multiSet(sealedShares)
+	return userdata.storeRecovery(state)
+}
+
+// StartEscrowRecovery opens a request to restore username's account from escrowed shares.
+func StartEscrowRecovery(username string) (*EscrowRecovery, error) {
+	state, _ := loadRecovery(username)
+	if state == nil || state.Escrow == nil {
+		return nil, errors.New(strings.ToTitle("this user has no escrow"))
+	}
+	pk, sk, err := userlib.PKEKeyGen()
+	if err != nil {
+		return nil, err
+	}
+	id, err := escrowRequestID(pk)
+	if err != nil {
+		return nil, err
+	}
+	requestBytes, err := json.Marshal(escrowrequest{Owner: username, Key: pk})
+	if err != nil {
+		return nil, err
+	}
+	datastoreSet(id, requestBytes)
+	return &EscrowRecovery{ID: id, username: username, key: sk}, nil
+}
+
+// helper method to load a recovery request along with its stored bytes
+func loadEscrowRequest(id uuid.UUID) (*escrowrequest, []byte) {
+	requestBytes, ok := datastoreGet(id)
+	if !ok {
+		return nil, nil
+	}
+	var request escrowrequest
+	err := json.Unmarshal(requestBytes, &request)
+	if err != nil {
+		return nil, requestBytes
+	}
+	return &request, requestBytes
+}
+
+// ReleaseEscrowShare hands the user's share of owner's escrow to the recovery request with the
+// given ID. Only call it for an ID the owner gave you themselves.
+func (userdata *User) ReleaseEscrowShare(owner string, request uuid.UUID) error {
+	defer userdata.measure("ReleaseEscrowShare")()
+	if userdata == nil || userdata.Username == "" {
+		return errors.New(strings.ToTitle("ERROR"))
+	}
+	sealed, ok := datastoreGet(escrowShareKeyGen(owner, userdata.Username))
+	if !ok {
+		return errors.New(strings.ToTitle("no escrow share from this user"))
+	}
+	entry := userdata.openSealed(sealed)
+	if entry == nil || !userdata.verifyEntry(entry, owner, userdata.Username) {
+		return errors.New(strings.ToTitle("invalid escrow share"))
+	}
+	var share escrowshare
+	err := json.Unmarshal(entry.Content, &share)
+	if err != nil || share.Owner != owner {
+		return errors.New(strings.ToTitle("invalid escrow share"))
+	}
+	releaseBytes, err := json.Marshal(escrowrelease{Trustee: userdata.Username, Entry: *entry})
+	if err != nil {
+		return err
+	}
+	for attempt := 0; attempt < swapAttempts; attempt++ {
+		current, old := loadEscrowRequest(request)
+		if current == nil || current.Owner != owner {
+			return errors.New(strings.ToTitle("recovery request not found"))
+		}
+		id, err := escrowRequestID(current.Key)
+		if err != nil || id != request {
+			return errors.New(strings.ToTitle("recovery request was tampered with"))
+		}
+		resealed, err := pkeSeal(current.Key, releaseBytes)
+		if err != nil {
+			return err
+		}
+		current.Shares = append(current.Shares, resealed)
+		requestBytes, err := json.Marshal(current)
+		if err != nil {
+			return err
+		}
+		if compareAndSwap(request, old, requestBytes) {
+			return nil
+		}
+	}
+	return errors.New(strings.ToTitle("recovery request is being changed, try again"))
+}
+
+// Complete combines the shares released so far and, if there are enough, sets a new password and
+// returns a session for the recovered account.
+func (recovery *EscrowRecovery) Complete(newPassword string) (*User, error) {
+	state, _ := loadRecovery(recovery.username)
+	if state == nil || state.Escrow == nil {
+		return nil, errors.New(strings.ToTitle("this user has no escrow"))
+	}
+	request, requestBytes := loadEscrowRequest(recovery.ID)
+	if request == nil {
+		return nil, errors.New(strings.ToTitle("recovery request not found"))
+	}
+	// there is no session to hold pins yet, so the owner's keys come straight from the Keystore
+	versions, err := accountKeys(recovery.username)
+	if err != nil {
+		return nil, err
+	}
+	var shares [][]byte
+	seen := make(map[byte]bool)
+	for _, resealed := range request.Shares {
+		releaseBytes, err := pkeOpen(recovery.key, resealed)
+		if err != nil {
+			continue
+		}
+		// every share has to carry the owner's signature, so a trustee can't pass on a bad one
+		var release escrowrelease
+		err = json.Unmarshal(releaseBytes, &release)
+		if err != nil || !signatureValid(recovery.username, versions,
+			concatenateByteArrays(release.Entry.Content, []byte(release.Trustee)), release.Entry.Signature) {
+			continue
+		}
+		var share escrowshare
+		err = json.Unmarshal(release.Entry.Content, &share)
+		if err != nil || share.Owner != recovery.username || share.Escrow != state.Escrow.ID ||
+			len(share.Share) == 0 || seen[share.Share[0]] {
+			continue
+		}
+		seen[share.Share[0]] = true
+		shares = append(shares, share.Share)
+	}
+	if len(shares) < state.Escrow.Threshold {
+		return nil, errors.New(strings.ToTitle("not enough shares yet"))
+	}
+	escrowKey, err := combineShares(shares)
+	if err != nil {
+		return nil, err
+	}
+	encKey, macKey, err := escrowKeys(escrowKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := VerifyDec(state.Escrow.Key, encKey, macKey)
+	if err != nil || len(key) != 16 {
+		return nil, errors.New(strings.ToTitle("shares don't open the escrow"))
+	}
+	udata, err := restoreAccount(recovery.username, state, key, newPassword, func(*User) error {
+		if !compareAndSwap(recovery.ID, requestBytes, nil) {
+			return errors.New(strings.ToTitle("recovery request is being changed, try again"))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	_ = udata.resumeRevocations()
+	_ = udata.resumeHandoffs()
+	return udata, nil
+}
@@ -0,0 +1,136 @@
+package client
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Content becomes unreachable when StoreFile replaces it without keeping a snapshot, or when a
+// snapshot falls out of the retention window. Rather than deleting it straight away, the header
+// that stops pointing at it lists it as garbage, and it is deleted once that header is in place.
+// A client that stops partway through leaves the entry listed, so the next StoreFile or a call
+// to CollectGarbage picks it up again. Reclaiming an entry a second time is harmless.
+
+// garbage holds what it takes to find every node of some unreachable content
+type garbage struct {
+	Keys   []contentkey
+	Count  int
+	Tail   uuid.UUID
+	Holder uuid.UUID
+
+	// the snapshot the content was kept in, if it was kept
+	Snapshot uuid.UUID
+
+	Segment *segment `json:",omitempty" since:"2"`
+}
+
+func (header *fileheader) chain() garbage {
+	return garbage{Keys: header.Keys, Count: header.Count, Tail: header.Tail, Holder: header.Holder,
+		Segment: header.Segment}
+}
+
+// discard lists the content of versions that are no longer kept as garbage
+func (header *fileheader) discard(dropped []version) {
+	for _, entry := range dropped {
+		entryGarbage := garbage{}
+		snap := loadSnapshot(entry)
+		if snap != nil {
+			entryGarbage = snap.chain()
+		}
+		entryGarbage.Snapshot = entry.Address
+		header.Garbage = append(header.Garbage, entryGarbage)
+	}
+}
+
+// reclaim deletes the nodes of some unreachable content, oldest first, so that an interrupted
+// reclaim can still find the nodes it didn't get to by walking back from the tail. The segment
+// records go after the nodes, also oldest first. Deduplicated content only gives up its
+// reference to the tail instead.
+func (entry garbage) reclaim() {
+	chain := fileheader{Keys: entry.Keys, Count: entry.Count, Tail: entry.Tail, Segment: entry.Segment}
+	if len(chain.Keys) > 0 && chain.Keys[0].Dedup {
+		chain.release(chain.Count-1, chain.Tail, entry.Holder)
+		if entry.Snapshot != uuid.Nil {
+			datastoreDelete(entry.Snapshot)
+		}
+		return
+	}
+	var addresses []uuid.UUID
+	address := chain.Tail
+	for counter := chain.Count - 1; counter >= 0 && len(chain.Keys) > 0; counter-- {
+		curnode := loadFileNode(address, chain.contentKey(counter), counter)
+		if curnode == nil {
+			break
+		}
+		addresses = append(addresses, address)
+		address = curnode.Prev
+	}
+	var records []uuid.UUID
+	for seg := chain.Segment; seg != nil && len(chain.Keys) > 0; {
+		key := chain.contentKey(seg.Start)
+		address, err := seg.recordAddress(key)
+		if err != nil {
+			break
+		}
+		records = append(records, address)
+		record := loadSegmentRecord(key, *seg)
+		if record == nil {
+			break
+		}
+		seg = record.Prev
+	}
+	// everything goes in one batch, still oldest first
+	var batch []uuid.UUID
+	for i := len(addresses) - 1; i >= 0; i-- {
+		batch = append(batch, addresses[i])
+	}
+	for i := len(records) - 1; i >= 0; i-- {
+		batch = append(batch, records[i])
+	}
+	if entry.Snapshot != uuid.Nil {
+		batch = append(batch, entry.Snapshot)
+	}
+	multiDelete(batch)
+}
+
+// collectGarbage reclaims everything the file's header lists as garbage and then clears the list
+func collectGarbage(curFileStruct filestruct) error {
+	for attempt := 0; attempt < swapAttempts; attempt++ {
+		header, old := readFileHeader(curFileStruct)
+		if header == nil {
+			return errors.New(strings.ToTitle("verification failed"))
+		}
+		// a moved header's garbage is collected at its new address
+		if len(header.Garbage) == 0 || header.Moved {
+			return nil
+		}
+		for _, entry := range header.Garbage {
+			entry.reclaim()
+		}
+		header.Garbage = nil
+		swapped, err := swapFileHeader(curFileStruct, old, *header)
+		if err != nil {
+			return err
+		}
+		if swapped {
+			return nil
+		}
+	}
+	return errors.New(strings.ToTitle("file is being changed by another session, try again"))
+}
+
+// CollectGarbage deletes any content of a file that is no longer reachable but was left behind,
+// for example by a client that stopped in the middle of StoreFile.
+func (userdata *User) CollectGarbage(filename string) error {
+	defer userdata.measure("CollectGarbage")()
+	if userdata == nil || userdata.Username == "" || userdata.FilestructMac == nil || userdata.FilestructEnc == nil {
+		return errors.New(strings.ToTitle("ERROR"))
+	}
+	pointer, _ := userdata.loadFileStruct(filename)
+	if pointer == nil {
+		return errors.New(strings.ToTitle("Access not granted"))
+	}
+	return collectGarbage(*pointer)
+}
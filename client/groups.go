@@ -0,0 +1,476 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// A group is a named list of users owned by whoever created it. Files shared with a group get a
+// single shared filestruct encrypted under the group key, and each member receives the group key
+// sealed to their public key. Removing a member rotates the group key and the file key of every
+// file shared with the group, so the removed member loses access to all of them at once. The
+// removal is committed together with the list of files still to rotate, so a removal that stops
+// partway is finished by the next call to RemoveMember instead of leaving files readable.
+
+// GroupPrefix marks a CreateInvitation or RevokeAccess recipient as one of the user's groups
+// rather than a username, e.g. CreateInvitation(filename, GroupPrefix+"team").
+const GroupPrefix = "group:"
+
+type group struct {
+	Name    string
+	Members []string
+	Enc     []byte
+	Mac     []byte
+	Version int
+	Files   map[uuid.UUID]groupfile
+
+	// set while a removal is unfinished: the members may not all have the new key yet, and the
+	// files in Rotating still need to move to it and get a new file key
+	Removing bool        `json:",omitempty"`
+	Rotating []uuid.UUID `json:",omitempty"`
+}
+
+// a file shared with the group, keyed in group.Files by its shared filestruct UUID
+type groupfile struct {
+	Filename   string
+	Invitation uuid.UUID
+	Shared     time.Time
+}
+
+// what each member receives for their membership
+type groupkey struct {
+	Group   string
+	Enc     []byte
+	Mac     []byte
+	Version int
+}
+
+// a group invitation holds one sealed sharestruct per member, keyed by the hashed username
+type groupinvite struct {
+	Entries map[string][]byte
+}
+
+func groupKeyGen(username string, groupname string) userlib.UUID {
+	p1 := userlib.Hash([]byte(username))
+	p2 := userlib.Hash([]byte(groupname))
+	p3 := userlib.Hash([]byte("group"))
+	bytes := concatenateByteArrays(concatenateByteArrays(p1, p2), p3)
+	gKey, _ := uuid.FromBytes(userlib.Hash(bytes)[:16])
+	return gKey
+}
+
+func membershipKeyGen(owner string, groupname string, member string) userlib.UUID {
+	p1 := userlib.Hash([]byte(owner))
+	p2 := userlib.Hash([]byte(groupname))
+	p3 := userlib.Hash([]byte(member))
+	p4 := userlib.Hash([]byte("membership"))
+	bytes := concatenateByteArrays(concatenateByteArrays(p1, p2), concatenateByteArrays(p3, p4))
+	mKey, _ := uuid.FromBytes(userlib.Hash(bytes)[:16])
+	return mKey
+}
+
+// helper method to load one of the user's own groups from datastore
+func (userdata *User) loadGroup(groupname string) *group {
+	groupBytes, ok := datastoreGet(groupKeyGen(userdata.Username, groupname))
+	if !ok {
+		return nil
+	}
+	plaintext, err := VerifyDec(groupBytes, userdata.SharetreeEnc, userdata.SharetreeMac)
+	if err != nil {
+		return nil
+	}
+	var curGroup group
+	err = json.Unmarshal(plaintext, &curGroup)
+	if err != nil || curGroup.Name != groupname {
+		return nil
+	}
+	if curGroup.Files == nil {
+		curGroup.Files = make(map[uuid.UUID]groupfile)
+	}
+	return &curGroup
+}
+
+func (userdata *User) storeGroup(curGroup *group) error {
+	groupBytes, err := json.Marshal(curGroup)
+	if err != nil {
+		return err
+	}
+	toStore := EncMacGen(groupBytes, userdata.SharetreeEnc, userdata.SharetreeMac)
+	datastoreSet(groupKeyGen(userdata.Username, curGroup.Name), toStore)
+	return nil
+}
+
+// storeMembership hands the current group key to a member
+func (userdata *User) storeMembership(curGroup *group, member string) error {
+	keyBytes, err := json.Marshal(groupkey{
+		Group:   curGroup.Name,
+		Enc:     curGroup.Enc,
+		Mac:     curGroup.Mac,
+		Version: curGroup.Version,
+	})
+	if err != nil {
+		return err
+	}
+	sealed, err := userdata.signAndSeal(member, keyBytes)
+	if err != nil {
+		return err
+	}
+	datastoreSet(membershipKeyGen(userdata.Username, curGroup.Name, member), sealed)
+	return nil
+}
+
+// loadGroupKey is used by members to recover the current key of a group they belong to
+func (userdata *User) loadGroupKey(owner string, groupname string) *groupkey {
+	sealed, ok := datastoreGet(membershipKeyGen(owner, groupname, userdata.Username))
+	if !ok {
+		return nil
+	}
+	entry := userdata.openSealed(sealed)
+	if entry == nil || !userdata.verifyEntry(entry, owner, userdata.Username) {
+		return nil
+	}
+	var keys groupkey
+	err := json.Unmarshal(entry.Content, &keys)
+	if err != nil || keys.Group != groupname {
+		return nil
+	}
+	return &keys
+}
+
+// storeGroupInvite (re)writes the invitation for a file shared with the group so that it holds
+// an entry for exactly the current members
+func (userdata *User) storeGroupInvite(curGroup *group, structUUID uuid.UUID) error {
+	file := curGroup.Files[structUUID]
+	shareBytes, err := marshalObject(sharestruct{F: structUUID, Group: curGroup.Name})
+	if err != nil {
+		return err
+	}
+	invite := groupinvite{Entries: make(map[string][]byte)}
+	for _, member := range curGroup.Members {
+		sealed, err := userdata.sealTo(member, shareBytes)
+		if err != nil {
+			return err
+		}
+		invite.Entries[userlib.MapKeyFromBytes([]byte(member))] = sealed
+	}
+	inviteBytes, err := json.Marshal(invite)
+	if err != nil {
+		return err
+	}
+	userSign, err := userdata.sign(inviteBytes)
+	if err != nil {
+		return err
+	}
+	datastoreSet(file.Invitation, concatenateByteArrays(inviteBytes, userSign))
+	return nil
+}
+
+// openGroupInvitation finds and decrypts this user's entry in a group invitation whose
+// signature has already been checked
+func (userdata *User) openGroupInvitation(message []byte) ([]byte, error) {
+	var invite groupinvite
+	err := json.Unmarshal(message, &invite)
+	if err != nil {
+		return nil, err
+	}
+	sealed, ok := invite.Entries[userlib.MapKeyFromBytes([]byte(userdata.Username))]
+	if !ok {
+		return nil, errors.New(strings.ToTitle("not a member of this group"))
+	}
+	return userdata.open(sealed)
+}
+
+// createGroupInvitation shares an owned file with every member of one of the user's groups
+func (userdata *User) createGroupInvitation(filename string, groupname string) (uuid.UUID, error) {
+	curGroup := userdata.loadGroup(groupname)
+	if curGroup == nil {
+		return uuid.Nil, errors.New(strings.ToTitle("group not found"))
+	}
+	pointer, shared := userdata.loadFileStruct(filename)
+	if pointer == nil {
+		return uuid.Nil, errors.New(strings.ToTitle("ERROR"))
+	}
+	if shared {
+		return uuid.Nil, errors.New(strings.ToTitle("only the owner can share a file with a group"))
+	}
+	pointer3 := userdata.loadShareTree(filename)
+	if pointer3 != nil {
+		_, ok := pointer3.Sharemap[GroupPrefix+groupname]
+		if ok {
+			return uuid.Nil, errors.New(strings.ToTitle("file is already shared with this group"))
+		}
+	}
+
+	structUUID, err := userdata.addShareBranch(filename, GroupPrefix+groupname, *pointer, curGroup.Enc, curGroup.Mac)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	invitationPtr := uuid.New()
+	curGroup.Files[structUUID] = groupfile{
+		Filename:   filename,
+		Invitation: invitationPtr,
+		Shared:     time.Now(),
+	}
+	err = userdata.storeGroupInvite(curGroup, structUUID)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	err = userdata.storeGroup(curGroup)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	for _, member := range curGroup.Members {
+		err = userdata.deliverNotification(member, notification{
+			Sender:     userdata.Username,
+			Invitation: invitationPtr,
+			Filename:   filename,
+			Sent:       time.Now(),
+		})
+		if err != nil {
+			return uuid.Nil, err
+		}
+	}
+	return invitationPtr, nil
+}
+
+// forgetGroupFile is called after the group's shared filestruct was revoked from a file
+func (userdata *User) forgetGroupFile(groupname string, structUUID uuid.UUID) error {
+	curGroup := userdata.loadGroup(groupname)
+	if curGroup == nil {
+		return nil
+	}
+	file, ok := curGroup.Files[structUUID]
+	if !ok {
+		return nil
+	}
+	datastoreDelete(file.Invitation)
+	delete(curGroup.Files, structUUID)
+	return userdata.storeGroup(curGroup)
+}
+
+// groupAccess lists the members of one of the user's groups for ListAccess
+func (userdata *User) groupAccess(groupname string, invited time.Time) []AccessEntry {
+	curGroup := userdata.loadGroup(groupname)
+	if curGroup == nil {
+		return nil
+	}
+	var entries []AccessEntry
+	for _, member := range curGroup.Members {
+		entries = append(entries, AccessEntry{
+			Recipient:  member,
+			InvitedBy:  GroupPrefix + groupname,
+			Invited:    invited,
+			Permission: PermissionReadWrite,
+		})
+	}
+	return entries
+}
+
+// CreateGroup creates an empty group owned by the user.
+func (userdata *User) CreateGroup(groupname string) error {
+	defer userdata.measure("CreateGroup")()
+	if userdata == nil || userdata.Username == "" || userdata.SharetreeMac == nil || userdata.SharetreeEnc == nil {
+		return errors.New(strings.ToTitle("ERROR"))
+	}
+	if groupname == "" {
+		return errors.New(strings.ToTitle("group name cannot be empty"))
+	}
+	_, ok := datastoreGet(groupKeyGen(userdata.Username, groupname))
+	if ok {
+		return errors.New(strings.ToTitle("group already exists"))
+	}
+	err := userdata.storeGroup(&group{
+		Name:  groupname,
+		Enc:   userlib.RandomBytes(16),
+		Mac:   userlib.RandomBytes(16),
+		Files: make(map[uuid.UUID]groupfile),
+	})
+	if err != nil {
+		return err
+	}
+	return userdata.addGroupName(groupname)
+}
+
+// AddMember adds a user to one of the user's groups, giving them access to every file already
+// shared with the group. The new member finds the invitations in their inbox.
+func (userdata *User) AddMember(groupname string, username string) error {
+	defer userdata.measure("AddMember")()
+	if userdata == nil || userdata.Username == "" {
+		return errors.New(strings.ToTitle("ERROR"))
+	}
+	curGroup := userdata.loadGroup(groupname)
+	if curGroup == nil {
+		return errors.New(strings.ToTitle("group not found"))
+	}
+	if username == userdata.Username {
+		return errors.New(strings.ToTitle("invalid member"))
+	}
+	_, err := userdata.peerKeys(username)
+	if err != nil {
+		return err
+	}
+	for _, member := range curGroup.Members {
+		if member == username {
+			return errors.New(strings.ToTitle("user is already a member"))
+		}
+	}
+	curGroup.Members = append(curGroup.Members, username)
+	err = userdata.storeMembership(curGroup, username)
+	if err != nil {
+		return err
+	}
+	err = userdata.storeGroup(curGroup)
+	if err != nil {
+		return err
+	}
+	for structUUID, file := range curGroup.Files {
+		err = userdata.storeGroupInvite(curGroup, structUUID)
+		if err != nil {
+			return err
+		}
+		err = userdata.deliverNotification(username, notification{
+			Sender:     userdata.Username,
+			Invitation: file.Invitation,
+			Filename:   file.Filename,
+			Sent:       time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveMember removes a user from one of the user's groups. The group key is rotated along with
+// the file key of every file shared with the group, so the removed member loses access to all of
+// them. If an earlier removal from the group didn't finish, it is finished first, so calling
+// RemoveMember again after an error completes the removal.
+func (userdata *User) RemoveMember(groupname string, username string) error {
+	defer userdata.measure("RemoveMember")()
+	if userdata == nil || userdata.Username == "" {
+		return errors.New(strings.ToTitle("ERROR"))
+	}
+	curGroup := userdata.loadGroup(groupname)
+	if curGroup == nil {
+		return errors.New(strings.ToTitle("group not found"))
+	}
+	var remaining []string
+	for _, member := range curGroup.Members {
+		if member != username {
+			remaining = append(remaining, member)
+		}
+	}
+	if len(remaining) == len(curGroup.Members) {
+		if curGroup.Removing {
+			return userdata.finishRemoval(curGroup)
+		}
+		return errors.New(strings.ToTitle("user is not a member"))
+	}
+	datastoreDelete(membershipKeyGen(userdata.Username, groupname, username))
+
+	// the removal is committed along with everything that is left to do for it: the group key is
+	// rotated, and every file shared with the group has to move to the new key
+	curGroup.Members = remaining
+	curGroup.Enc = userlib.RandomBytes(16)
+	curGroup.Mac = userlib.RandomBytes(16)
+	curGroup.Version += 1
+	curGroup.Removing = true
+	for structUUID := range curGroup.Files {
+		if !containsUUID(curGroup.Rotating, structUUID) {
+			curGroup.Rotating = append(curGroup.Rotating, structUUID)
+		}
+	}
+	err := userdata.storeGroup(curGroup)
+	if err != nil {
+		return err
+	}
+	return userdata.finishRemoval(curGroup)
+}
+
+// finishRemoval hands the current group key to every member and moves each file left in
+// Rotating to it, crossing files off as they are done. Every step can safely be repeated.
+func (userdata *User) finishRemoval(curGroup *group) error {
+	for _, member := range curGroup.Members {
+		err := userdata.storeMembership(curGroup, member)
+		if err != nil {
+			return err
+		}
+	}
+	for len(curGroup.Rotating) > 0 {
+		structUUID := curGroup.Rotating[0]
+		file, ok := curGroup.Files[structUUID]
+		if ok {
+			err := userdata.rotateGroupFile(curGroup, structUUID, file)
+			if err != nil {
+				return err
+			}
+		}
+		curGroup.Rotating = curGroup.Rotating[1:]
+		err := userdata.storeGroup(curGroup)
+		if err != nil {
+			return err
+		}
+	}
+	curGroup.Removing = false
+	return userdata.storeGroup(curGroup)
+}
+
+// rotateGroupFile moves the group's shared filestruct for a file to the current group key, then
+// rotates the file's own key
+func (userdata *User) rotateGroupFile(curGroup *group, structUUID uuid.UUID, file groupfile) error {
+	err := userdata.storeGroupInvite(curGroup, structUUID)
+	if err != nil {
+		return err
+	}
+	pointer, shared := userdata.loadFileStruct(file.Filename)
+	pointer3 := userdata.loadShareTree(file.Filename)
+	if pointer == nil || shared || pointer3 == nil {
+		// the file is gone, so there is nothing left to protect
+		return nil
+	}
+	shareTree := *pointer3
+	oldKeys, ok := shareTree.Filemap[structUUID]
+	if !ok {
+		// the group was revoked from the file in the meantime
+		return nil
+	}
+	if len(oldKeys) < 2 {
+		return errors.New(strings.ToTitle("ERROR"))
+	}
+	if !bytes.Equal(oldKeys[0], curGroup.Enc) || !bytes.Equal(oldKeys[1], curGroup.Mac) {
+		branch := loadFileStruct2(structUUID, oldKeys[0], oldKeys[1])
+		if branch == nil {
+			// an earlier attempt may have re-encrypted it without updating the sharetree
+			branch = loadFileStruct2(structUUID, curGroup.Enc, curGroup.Mac)
+		}
+		if branch == nil {
+			return errors.New(strings.ToTitle("ERROR"))
+		}
+		branchBytes, err := marshalObject(branch)
+		if err != nil {
+			return err
+		}
+		datastoreSet(structUUID, EncMacGen(branchBytes, curGroup.Enc, curGroup.Mac))
+		shareTree.Filemap[structUUID] = [][]byte{curGroup.Enc, curGroup.Mac}
+		err = userdata.storeShareTree(file.Filename, shareTree)
+		if err != nil {
+			return err
+		}
+	}
+	return userdata.startRevocation(file.Filename, "", uuid.Nil)
+}
+
+func containsUUID(list []uuid.UUID, target uuid.UUID) bool {
+	for _, item := range list {
+		if item == target {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,268 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Every user has an inbox in Datastore where senders drop a notification for each invitation
+// they create. The inbox is a plain list of sealed entries, so anyone can append to it, but each
+// entry is encrypted with the recipient's shareenc key (and their devices' keys, see devices.go)
+// and signed with the sender's sharesign key.
+
+// length of an RSA ciphertext produced by userlib.PKEEnc
+const pkeCipherLen = 256
+
+// Invitation describes a pending invitation waiting in the user's inbox. Transfer is set when the
+// sender is handing over ownership of a file; accept those with AcceptOwnership instead.
+type Invitation struct {
+	Sender     string
+	Invitation uuid.UUID
+	Filename   string
+	Sent       time.Time
+	Transfer   bool
+}
+
+type notification struct {
+	Sender     string
+	Invitation uuid.UUID
+	Filename   string
+	Sent       time.Time
+	Transfer   bool `json:",omitempty"`
+}
+
+type signedentry struct {
+	Content   []byte
+	Signature []byte
+}
+
+func inboxKeyGen(username string) userlib.UUID {
+	p1 := userlib.Hash([]byte(username))
+	p2 := userlib.Hash([]byte("inbox"))
+	hashed := userlib.Hash(concatenateByteArrays(p1, p2))[:16]
+	iKey, _ := uuid.FromBytes(hashed)
+	return iKey
+}
+
+// pkeSeal encrypts content of any length to a public key: a fresh pair of symmetric keys is
+// encrypted with PKEEnc and the content itself with EncMacGen.
+func pkeSeal(publicKey userlib.PKEEncKey, content []byte) ([]byte, error) {
+	keys := userlib.RandomBytes(32)
+	wrapped, err := userlib.PKEEnc(publicKey, keys)
+	if err != nil {
+		return nil, err
+	}
+	return concatenateByteArrays(wrapped, EncMacGen(content, keys[:16], keys[16:])), nil
+}
+
+func pkeOpen(privateKey userlib.PKEDecKey, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < pkeCipherLen+userlib.AESBlockSizeBytes+userlib.HashSizeBytes {
+		return nil, errors.New(strings.ToTitle("invalid"))
+	}
+	keys, err := userlib.PKEDec(privateKey, ciphertext[:pkeCipherLen])
+	if err != nil || len(keys) != 32 {
+		return nil, errors.New(strings.ToTitle("invalid"))
+	}
+	return VerifyDec(ciphertext[pkeCipherLen:], keys[:16], keys[16:])
+}
+
+// helper method to load the raw list of sealed entries in a user's inbox, along with the inbox
+// as stored
+func loadInbox(username string) ([][]byte, []byte) {
+	inboxBytes, ok := datastoreGet(inboxKeyGen(username))
+	if !ok {
+		return nil, nil
+	}
+	var sealed [][]byte
+	err := json.Unmarshal(inboxBytes, &sealed)
+	if err != nil {
+		return nil, inboxBytes
+	}
+	return sealed, inboxBytes
+}
+
+// swapInbox replaces the inbox with sealed, as long as it still holds old. Senders write to the
+// inbox while its owner removes entries from it, so neither can simply overwrite it.
+func swapInbox(username string, old []byte, sealed [][]byte) (bool, error) {
+	inboxBytes, err := json.Marshal(sealed)
+	if err != nil {
+		return false, err
+	}
+	return compareAndSwap(inboxKeyGen(username), old, inboxBytes), nil
+}
+
+// signAndSeal signs content for a recipient and seals it to their public key. The signature
+// covers the recipient's username so the result can't be replayed to somebody else.
+func (userdata *User) signAndSeal(recipientUsername string, content []byte) ([]byte, error) {
+	sig, err := userdata.sign(concatenateByteArrays(content, []byte(recipientUsername)))
+	if err != nil {
+		return nil, err
+	}
+	entryBytes, err := json.Marshal(signedentry{Content: content, Signature: sig})
+	if err != nil {
+		return nil, err
+	}
+	return userdata.sealTo(recipientUsername, entryBytes)
+}
+
+// openSealed decrypts a sealed entry addressed to this user. The caller must still check the
+// signature with verifyEntry once it knows who the sender is supposed to be.
+func (userdata *User) openSealed(sealed []byte) *signedentry {
+	entryBytes, err := userdata.open(sealed)
+	if err != nil {
+		return nil
+	}
+	var entry signedentry
+	err = json.Unmarshal(entryBytes, &entry)
+	if err != nil {
+		return nil
+	}
+	return &entry
+}
+
+func (userdata *User) verifyEntry(entry *signedentry, senderUsername string, recipientUsername string) bool {
+	return userdata.verifySignature(senderUsername, concatenateByteArrays(entry.Content, []byte(recipientUsername)), entry.Signature)
+}
+
+// deliverNotification drops a signed and sealed notification into the recipient's inbox
+func (userdata *User) deliverNotification(recipientUsername string, note notification) error {
+	noteBytes, err := json.Marshal(note)
+	if err != nil {
+		return err
+	}
+	sealed, err := userdata.signAndSeal(recipientUsername, noteBytes)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; attempt < swapAttempts; attempt++ {
+		entries, old := loadInbox(recipientUsername)
+		swapped, err := swapInbox(recipientUsername, old, append(entries, sealed))
+		if err != nil || swapped {
+			return err
+		}
+	}
+	return errors.New(strings.ToTitle("inbox is being changed by another session, try again"))
+}
+
+// openNotification decrypts an inbox entry and checks the sender's signature on it
+func (userdata *User) openNotification(sealed []byte) *notification {
+	entry := userdata.openSealed(sealed)
+	if entry == nil {
+		return nil
+	}
+	var note notification
+	err := json.Unmarshal(entry.Content, &note)
+	if err != nil {
+		return nil
+	}
+	if !userdata.verifyEntry(entry, note.Sender, userdata.Username) {
+		return nil
+	}
+	return &note
+}
+
+// PendingInvitations lists the invitations in the user's inbox that can still be accepted.
+// Entries that fail to decrypt or verify are ignored.
+func (userdata *User) PendingInvitations() ([]Invitation, error) {
+	defer userdata.measure("PendingInvitations")()
+	if userdata == nil || userdata.Username == "" {
+		return nil, errors.New(strings.ToTitle("ERROR"))
+	}
+	var pending []Invitation
+	entries, _ := loadInbox(userdata.Username)
+	for _, sealed := range entries {
+		note := userdata.openNotification(sealed)
+		if note == nil {
+			continue
+		}
+		_, ok := datastoreGet(note.Invitation)
+		if !ok {
+			continue
+		}
+		pending = append(pending, Invitation{
+			Sender:     note.Sender,
+			Invitation: note.Invitation,
+			Filename:   note.Filename,
+			Sent:       note.Sent,
+			Transfer:   note.Transfer,
+		})
+	}
+	return pending, nil
+}
+
+// removeNotification drops every inbox entry for the given invitation, returning whether any
+// were found. Entries that no longer verify are dropped as well, unless this is a device session,
+// which can't open entries sealed before it was enrolled.
+func (userdata *User) removeNotification(senderUsername string, invitationPtr uuid.UUID) (bool, error) {
+	for attempt := 0; attempt < swapAttempts; attempt++ {
+		entries, old := loadInbox(userdata.Username)
+		found := false
+		var kept [][]byte
+		for _, sealed := range entries {
+			note := userdata.openNotification(sealed)
+			if note == nil {
+				if !userdata.holdsAccountKeys() {
+					kept = append(kept, sealed)
+				}
+				continue
+			}
+			if note.Sender == senderUsername && note.Invitation == invitationPtr {
+				found = true
+				continue
+			}
+			kept = append(kept, sealed)
+		}
+		swapped, err := swapInbox(userdata.Username, old, kept)
+		if err != nil {
+			return false, err
+		}
+		if swapped {
+			return found, nil
+		}
+	}
+	return false, errors.New(strings.ToTitle("inbox is being changed by another session, try again"))
+}
+
+// DeclineInvitation removes an invitation from the user's inbox and deletes it from Datastore.
+// The filestruct the invitation came with is marked declined, or for a sub-share the sharer's
+// record of it is dropped, so that the user stops being listed by ListAccess.
+func (userdata *User) DeclineInvitation(senderUsername string, invitationPtr uuid.UUID) error {
+	defer userdata.measure("DeclineInvitation")()
+	if userdata == nil || userdata.Username == "" {
+		return errors.New(strings.ToTitle("ERROR"))
+	}
+	// transfers and invitations that don't open have nothing to mark
+	shareInvite, _ := userdata.openInvitation(senderUsername, invitationPtr)
+	found, err := userdata.removeNotification(senderUsername, invitationPtr)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.New(strings.ToTitle("invitation not found"))
+	}
+	if shareInvite != nil && shareInvite.Group == "" {
+		err = changeSharedFileStruct(shareInvite.F, shareInvite.E, shareInvite.M, func(curFileStruct *filestruct) bool {
+			for i, record := range curFileStruct.Shares {
+				if record.Recipient == userdata.Username && record.InvitedBy == senderUsername {
+					curFileStruct.Shares = append(curFileStruct.Shares[:i], curFileStruct.Shares[i+1:]...)
+					return true
+				}
+			}
+			if curFileStruct.Owner != senderUsername || curFileStruct.Declined {
+				return false
+			}
+			curFileStruct.Declined = true
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	datastoreDelete(invitationPtr)
+	return nil
+}
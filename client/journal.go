@@ -0,0 +1,367 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Revocation takes several Datastore writes, so it is staged such that the file stays readable if
+// the client stops partway through:
+//  1. the revocation is recorded in the owner's journal
+//  2. the header is copied to its new address under the new file key (the old one is untouched)
+//  3. the header is copied again and the old one is marked as moved in one swap, so appends made
+//     since the first copy are kept and later ones start over at the new header; then the
+//     owner's filestruct, the sharetree and every remaining shared filestruct are switched over
+//     to the new header
+//  4. the old header and the revoked shared filestruct are deleted
+// The journal entry is updated after each stage. GetUser and RevokeAccess resume any entry left
+// behind, and an entry whose file no longer exists before the switch is rolled back by dropping it.
+
+const (
+	revocationPlanned = iota
+	revocationWritten
+	revocationSwitched
+)
+
+type revocation struct {
+	Filename  string
+	Recipient string    // empty when only the file key is being rotated
+	Revoked   uuid.UUID // the recipient's shared filestruct
+	OldFirst  uuid.UUID
+
+	// the new file key, header address and content key
+	RootEnc []byte
+	RootMac []byte
+	First   uuid.UUID
+	Key     contentkey
+
+	// the owner's fresh deduplication domain, if the file is deduplicated
+	Domain *contentkey `json:",omitempty"`
+
+	Stage int
+}
+
+func journalKeyGen(username string) userlib.UUID {
+	p1 := userlib.Hash([]byte(username))
+	p2 := userlib.Hash([]byte("journal"))
+	hashed := userlib.Hash(concatenateByteArrays(p1, p2))[:16]
+	jKey, _ := uuid.FromBytes(hashed)
+	return jKey
+}
+
+// helper method to load the user's journal of unfinished revocations, keyed by filename
+func (userdata *User) loadJournal() (map[string]revocation, error) {
+	journal, _, err := userdata.readJournal()
+	return journal, err
+}
+
+// readJournal is loadJournal along with the journal's ciphertext
+func (userdata *User) readJournal() (map[string]revocation, []byte, error) {
+	journal := make(map[string]revocation)
+	ciphertext, ok := datastoreGet(journalKeyGen(userdata.Username))
+	if !ok {
+		return journal, nil, nil
+	}
+	journalBytes, err := VerifyDec(ciphertext, userdata.SharetreeEnc, userdata.SharetreeMac)
+	if err != nil {
+		return nil, nil, errors.New(strings.ToTitle("journal has been tampered with"))
+	}
+	err = json.Unmarshal(journalBytes, &journal)
+	if err != nil {
+		return nil, nil, errors.New(strings.ToTitle("journal has been tampered with"))
+	}
+	return journal, ciphertext, nil
+}
+
+// changeJournal applies change to the journal and swaps it in, so that entries another of the
+// user's sessions writes at the same time aren't lost
+func (userdata *User) changeJournal(change func(journal map[string]revocation)) error {
+	for attempt := 0; attempt < swapAttempts; attempt++ {
+		journal, old, err := userdata.readJournal()
+		if err != nil {
+			return err
+		}
+		change(journal)
+		var value []byte
+		if len(journal) > 0 {
+			journalBytes, err := json.Marshal(journal)
+			if err != nil {
+				return err
+			}
+			value = EncMacGen(journalBytes, userdata.SharetreeEnc, userdata.SharetreeMac)
+		} else if old == nil {
+			return nil
+		}
+		if compareAndSwap(journalKeyGen(userdata.Username), old, value) {
+			return nil
+		}
+	}
+	return errors.New(strings.ToTitle("revocations are being changed by another session, try again"))
+}
+
+func (userdata *User) journalStage(r *revocation, stage int) error {
+	r.Stage = stage
+	return userdata.changeJournal(func(journal map[string]revocation) {
+		journal[r.Filename] = *r
+	})
+}
+
+func (userdata *User) journalDone(filename string) error {
+	return userdata.changeJournal(func(journal map[string]revocation) {
+		delete(journal, filename)
+	})
+}
+
+// startRevocation removes a recipient (if any) from an owned file and rotates its file key
+func (userdata *User) startRevocation(filename string, recipientUsername string, revokeUUID uuid.UUID) error {
+	journal, err := userdata.loadJournal()
+	if err != nil {
+		return err
+	}
+	if pending, ok := journal[filename]; ok {
+		err = userdata.completeRevocation(&pending)
+		if err != nil {
+			return err
+		}
+	}
+
+	pointer, shared := userdata.loadFileStruct(filename)
+	if pointer == nil || shared {
+		return errors.New(strings.ToTitle("ERROR"))
+	}
+	err = userdata.checkOwnLease(*pointer)
+	if err != nil {
+		return err
+	}
+	err = userdata.cancelTransfer(filename)
+	if err != nil {
+		return err
+	}
+	header := loadFileHeader(*pointer)
+	if header == nil {
+		return errors.New(strings.ToTitle("ERROR"))
+	}
+	r := revocation{
+		Filename:  filename,
+		Recipient: recipientUsername,
+		Revoked:   revokeUUID,
+		OldFirst:  pointer.First,
+		RootEnc:   userlib.RandomBytes(16),
+		RootMac:   userlib.RandomBytes(16),
+		First:     uuid.New(),
+		Key:       newContentKey(header.Count),
+	}
+	// the recipient knew the deduplication domain, so the owner moves on to a fresh one
+	if header.Domain != nil {
+		domain, err := userdata.renewDomain(header.Domain)
+		if err != nil {
+			return err
+		}
+		r.Domain = &domain
+	}
+	err = userdata.journalStage(&r, revocationPlanned)
+	if err != nil {
+		return err
+	}
+	return userdata.completeRevocation(&r)
+}
+
+// resumeRevocations finishes every revocation left in the journal
+func (userdata *User) resumeRevocations() error {
+	journal, err := userdata.loadJournal()
+	if err != nil {
+		return err
+	}
+	for _, pending := range journal {
+		pending := pending
+		err = userdata.completeRevocation(&pending)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// completeRevocation carries a revocation through whichever stages it hasn't finished yet. Every
+// stage can safely be repeated.
+func (userdata *User) completeRevocation(r *revocation) error {
+	storageKey := filestructKeyGen(userdata.Username, r.Filename)
+	if r.Stage == revocationPlanned {
+		pointer, shared := userdata.loadFileStruct(r.Filename)
+		if pointer == nil || shared || pointer.First != r.OldFirst {
+			// the file is gone and nothing was switched over yet, so there is nothing to finish
+			return userdata.journalDone(r.Filename)
+		}
+		header := loadFileHeader(*pointer)
+		if header == nil {
+			return errors.New(strings.ToTitle("ERROR"))
+		}
+		err := r.copyHeader(*pointer, *header)
+		if err != nil {
+			return err
+		}
+		err = userdata.journalStage(r, revocationWritten)
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.Stage == revocationWritten {
+		var shareTree sharetree
+		pointer3 := userdata.loadShareTree(r.Filename)
+		if pointer3 != nil {
+			shareTree = *pointer3
+		}
+		pointer, shared := userdata.loadFileStruct(r.Filename)
+		if pointer == nil || shared {
+			// the owner no longer has the file, so the copied header is of no use to anyone
+			datastoreDelete(r.First)
+			return userdata.journalDone(r.Filename)
+		}
+		// unless the switch below already happened, appends may have landed since the copy
+		if pointer.First != r.First {
+			err := r.moveHeader(*pointer)
+			if err != nil {
+				return err
+			}
+		}
+
+		// the sharetree, the owner's filestruct and every shared filestruct switch over in one batch
+		entries := make(map[uuid.UUID][]byte)
+		if r.Recipient != "" && shareTree.Sharemap != nil {
+			delete(shareTree.Sharemap, r.Recipient)
+			delete(shareTree.Filemap, r.Revoked)
+			delete(shareTree.Accessmap, r.Recipient)
+			storeBytes, err := marshalObject(shareTree)
+			if err != nil {
+				return errors.New(strings.ToTitle("ERROR"))
+			}
+			entries[generateSharetreeKey(userdata.Username, r.Filename)] = EncMacGen(storeBytes, userdata.SharetreeEnc, userdata.SharetreeMac)
+		}
+		newFileStruct := *pointer
+		newFileStruct.RootEnc = r.RootEnc
+		newFileStruct.RootMac = r.RootMac
+		newFileStruct.First = r.First
+		filestructBytes, err := marshalObject(newFileStruct)
+		if err != nil {
+			return errors.New(strings.ToTitle("ERROR"))
+		}
+		entries[storageKey] = EncMacGen(filestructBytes, userdata.FilestructEnc, userdata.FilestructMac)
+
+		var structUUIDs []uuid.UUID
+		for structUUID := range shareTree.Filemap {
+			structUUIDs = append(structUUIDs, structUUID)
+		}
+		current := multiGet(structUUIDs)
+		for structUUID, keys := range shareTree.Filemap {
+			if len(keys) < 2 {
+				return errors.New(strings.ToTitle("ERROR"))
+			}
+			encryptedBytes, ok := current[structUUID]
+			if !ok {
+				return errors.New(strings.ToTitle("shared filestruct not found"))
+			}
+			structBytes, err := VerifyDec(encryptedBytes, keys[0], keys[1])
+			if err != nil {
+				return errors.New(strings.ToTitle("ERROR"))
+			}
+			var curStruct filestruct
+			err = unmarshalObject(structBytes, &curStruct)
+			if err != nil {
+				return errors.New(strings.ToTitle("ERROR"))
+			}
+			curStruct.First = r.First
+			curStruct.RootMac = r.RootMac
+			curStruct.RootEnc = r.RootEnc
+			newBytes, err := marshalObject(curStruct)
+			if err != nil {
+				return errors.New(strings.ToTitle("ERROR"))
+			}
+			entries[structUUID] = EncMacGen(newBytes, keys[0], keys[1])
+		}
+		multiSet(entries)
+		if r.Recipient != "" && shareTree.Sharemap != nil {
+			userdata.clearShareLog(r.Filename)
+		}
+		err = userdata.journalStage(r, revocationSwitched)
+		if err != nil {
+			return err
+		}
+	}
+
+	// nothing points at the old header, its lease or the revoked filestruct anymore
+	stale := []uuid.UUID{r.OldFirst, leaseKeyGen(filestruct{First: r.OldFirst})}
+	if r.Revoked != uuid.Nil {
+		stale = append(stale, r.Revoked)
+	}
+	multiDelete(stale)
+	if strings.HasPrefix(r.Recipient, GroupPrefix) {
+		err := userdata.forgetGroupFile(strings.TrimPrefix(r.Recipient, GroupPrefix), r.Revoked)
+		if err != nil {
+			return err
+		}
+	}
+	return userdata.journalDone(r.Filename)
+}
+
+// copyHeader stores a copy of the file's header at the revocation's new address, under the new
+// file key and with the new content key for everything appended from now on
+func (r *revocation) copyHeader(oldStruct filestruct, header fileheader) error {
+	// taken before the unused key is dropped below, since it may be the file's only key
+	r.Key.Start = header.Count
+	r.Key.Dedup = header.Keys[0].Dedup
+	r.Key.Compressed = header.Keys[0].Compressed
+	// a key that was never used for any node can simply be replaced
+	if header.Keys[len(header.Keys)-1].Start == header.Count {
+		header.Keys = header.Keys[:len(header.Keys)-1]
+	}
+	header.Keys = append(header.Keys, r.Key)
+	// the file moves to the owner's fresh domain; one turned on after the revocation was planned
+	// gets a domain of its own
+	if header.Domain != nil {
+		if r.Domain == nil {
+			domain := newDomain(0)
+			r.Domain = &domain
+		}
+		header.Domain = r.Domain
+	}
+	newFileStruct := oldStruct
+	newFileStruct.RootEnc = r.RootEnc
+	newFileStruct.RootMac = r.RootMac
+	newFileStruct.First = r.First
+	return storeFileHeader(newFileStruct, header)
+}
+
+// moveHeader copies the old header again and marks it as moved in the same swap it was read for.
+// Whatever was appended since the first copy is then part of the new header, and nothing can be
+// appended to the old one anymore, since writers refuse to change a moved header and start over
+// from their filestruct, which the switch points at the new one.
+func (r *revocation) moveHeader(oldStruct filestruct) error {
+	for attempt := 0; attempt < swapAttempts; attempt++ {
+		header, old := readFileHeader(oldStruct)
+		if header == nil {
+			return errors.New(strings.ToTitle("ERROR"))
+		}
+		if header.Moved {
+			// it was copied right before it was marked
+			return nil
+		}
+		err := r.copyHeader(oldStruct, *header)
+		if err != nil {
+			return err
+		}
+		header.Moved = true
+		ciphertext, err := encryptFileHeader(oldStruct, *header)
+		if err != nil {
+			return err
+		}
+		if compareAndSwap(oldStruct.First, old, ciphertext) {
+			return nil
+		}
+	}
+	return errors.New(strings.ToTitle("file is being changed by another session, try again"))
+}
@@ -0,0 +1,276 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Pinning (see pins.go) only protects keys after first contact. On top of it, every key a user
+// publishes is also appended to a key transparency log: an append-only Merkle tree whose entries
+// are the registrations of InitUser and RotateKeys. Before the client uses keys from the
+// Keystore it asks the log for the user's latest registration and checks that the keys match
+// and that the entry is included in the current tree. Each user also keeps the last tree head
+// they saw, encrypted like their other state, and checks that every new head extends it, so the
+// log can't rewrite history once a user has seen it. The head is created by InitUser, so deleting
+// it can't undo the checks either. GetUser checks the user's own registration, so a log that
+// shows others a different key for them is noticed by them the next time they log in.
+//
+// Like the Datastore functions, the log can be replaced. LocalKeyLog is an in-process stand-in
+// for a real log server. Setting KeyTransparencyLog to nil turns the checks off.
+
+// KeyLogHead is the size and root hash of the key transparency log at some point.
+type KeyLogHead struct {
+	Size int
+	Root []byte
+}
+
+// KeyLog is a key transparency log server. Nothing it returns is trusted without a proof.
+type KeyLog interface {
+	// Append adds an entry and returns its index.
+	Append(entry []byte) (int, error)
+	// Head returns the current size and root of the log.
+	Head() (KeyLogHead, error)
+	// Lookup returns the indices of the entries registering username's keys, oldest first.
+	Lookup(username string) ([]int, error)
+	// Entry returns the entry at index.
+	Entry(index int) ([]byte, error)
+	// InclusionProof proves that the entry at index is in the log of the given size.
+	InclusionProof(index int, size int) ([][]byte, error)
+	// ConsistencyProof proves that the log of size first is a prefix of the log of size second.
+	ConsistencyProof(first int, second int) ([][]byte, error)
+}
+
+// KeyTransparencyLog is the log that key registrations go to and are checked against.
+var KeyTransparencyLog KeyLog = NewLocalKeyLog(nil)
+
+type keylogentry struct {
+	Username string
+	Version  int
+	Enc      userlib.PKEEncKey
+	Sign     userlib.DSVerifyKey
+}
+
+func keylogHeadKeyGen(username string) userlib.UUID {
+	p1 := userlib.Hash([]byte(username))
+	p2 := userlib.Hash([]byte("keylog"))
+	hashed := userlib.Hash(concatenateByteArrays(p1, p2))[:16]
+	kKey, _ := uuid.FromBytes(hashed)
+	return kKey
+}
+
+func (userdata *User) keylogHeadKeys() ([]byte, []byte, error) {
+	return userdata.workingKeys().derived("keylog")
+}
+
+// registerKeys appends a version of username's public keys to the log
+func registerKeys(username string, version int, encKey userlib.PKEEncKey, verifyKey userlib.DSVerifyKey) error {
+	if KeyTransparencyLog == nil {
+		return nil
+	}
+	entryBytes, err := json.Marshal(keylogentry{Username: username, Version: version, Enc: encKey, Sign: verifyKey})
+	if err != nil {
+		return err
+	}
+	_, err = KeyTransparencyLog.Append(entryBytes)
+	return err
+}
+
+// helper method to store an empty log head for a new user, who hasn't seen the log yet
+func (userdata *User) initKeylogHead() error {
+	encKey, macKey, err := userdata.keylogHeadKeys()
+	if err != nil {
+		return err
+	}
+	headBytes, err := json.Marshal(KeyLogHead{})
+	if err != nil {
+		return err
+	}
+	datastoreSet(keylogHeadKeyGen(userdata.Username), EncMacGen(headBytes, encKey, macKey))
+	return nil
+}
+
+// loadKeylogHead returns the last log head the user saw. InitUser stores one, so a missing head
+// is an error rather than a user who never saw the log.
+func (userdata *User) loadKeylogHead() (KeyLogHead, error) {
+	ciphertext, ok := datastoreGet(keylogHeadKeyGen(userdata.Username))
+	if !ok {
+		return KeyLogHead{}, errors.New(strings.ToTitle("the last key log head seen is missing"))
+	}
+	encKey, macKey, err := userdata.keylogHeadKeys()
+	if err != nil {
+		return KeyLogHead{}, err
+	}
+	headBytes, err := VerifyDec(ciphertext, encKey, macKey)
+	if err != nil {
+		return KeyLogHead{}, errors.New(strings.ToTitle("verification failed"))
+	}
+	var head KeyLogHead
+	err = json.Unmarshal(headBytes, &head)
+	if err != nil {
+		return KeyLogHead{}, errors.New(strings.ToTitle("verification failed"))
+	}
+	return head, nil
+}
+
+// currentKeylogHead fetches the log's head and checks that it extends the last one the user saw
+func (userdata *User) currentKeylogHead() (KeyLogHead, error) {
+	head, err := KeyTransparencyLog.Head()
+	if err != nil {
+		return KeyLogHead{}, err
+	}
+	seen, err := userdata.loadKeylogHead()
+	if err != nil {
+		return KeyLogHead{}, err
+	}
+	if head.Size == seen.Size && bytes.Equal(head.Root, seen.Root) {
+		return head, nil
+	}
+	if head.Size < seen.Size {
+		return KeyLogHead{}, errors.New(strings.ToTitle("the key log is smaller than it was"))
+	}
+	if seen.Size > 0 {
+		proof, err := KeyTransparencyLog.ConsistencyProof(seen.Size, head.Size)
+		if err != nil || !verifyConsistency(seen.Size, head.Size, seen.Root, head.Root, proof) {
+			return KeyLogHead{}, errors.New(strings.ToTitle("the key log rewrote its history"))
+		}
+	}
+	encKey, macKey, err := userdata.keylogHeadKeys()
+	if err != nil {
+		return KeyLogHead{}, err
+	}
+	headBytes, err := json.Marshal(head)
+	if err != nil {
+		return KeyLogHead{}, err
+	}
+	datastoreSet(keylogHeadKeyGen(userdata.Username), EncMacGen(headBytes, encKey, macKey))
+	return head, nil
+}
+
+// checkKeyLog checks that the keys with the given fingerprint are the latest ones username
+// registered in the log
+func (userdata *User) checkKeyLog(username string, fingerprint string) error {
+	if KeyTransparencyLog == nil {
+		return nil
+	}
+	head, err := userdata.currentKeylogHead()
+	if err != nil {
+		return err
+	}
+	indices, err := KeyTransparencyLog.Lookup(username)
+	if err != nil {
+		return err
+	}
+	latest := -1
+	for _, index := range indices {
+		if index > latest && index < head.Size {
+			latest = index
+		}
+	}
+	if latest < 0 {
+		return errors.New(strings.ToTitle("the keys of " + username + " are not in the key log"))
+	}
+	entryBytes, err := KeyTransparencyLog.Entry(latest)
+	if err != nil {
+		return err
+	}
+	proof, err := KeyTransparencyLog.InclusionProof(latest, head.Size)
+	if err != nil || !verifyInclusion(latest, head.Size, merkleLeaf(entryBytes), proof, head.Root) {
+		return errors.New(strings.ToTitle("the key log gave an invalid proof"))
+	}
+	var entry keylogentry
+	err = json.Unmarshal(entryBytes, &entry)
+	if err != nil || entry.Username != username {
+		return errors.New(strings.ToTitle("the key log gave an invalid entry"))
+	}
+	logged, err := keyFingerprint(entry.Enc, entry.Sign)
+	if err != nil || logged != fingerprint {
+		return errors.New(strings.ToTitle("the keys of " + username + " don't match the key log"))
+	}
+	return nil
+}
+
+// LocalKeyLog is a key transparency log kept in memory, standing in for a log server.
+type LocalKeyLog struct {
+	lock    sync.Mutex
+	entries [][]byte
+	leaves  [][]byte
+	users   map[string][]int
+}
+
+// NewLocalKeyLog returns a log holding the given entries, e.g. ones saved from Entries.
+func NewLocalKeyLog(entries [][]byte) *LocalKeyLog {
+	log := &LocalKeyLog{users: make(map[string][]int)}
+	for _, entry := range entries {
+		log.add(entry)
+	}
+	return log
+}
+
+func (log *LocalKeyLog) add(entry []byte) int {
+	index := len(log.entries)
+	log.entries = append(log.entries, entry)
+	log.leaves = append(log.leaves, merkleLeaf(entry))
+	var parsed keylogentry
+	if json.Unmarshal(entry, &parsed) == nil {
+		log.users[parsed.Username] = append(log.users[parsed.Username], index)
+	}
+	return index
+}
+
+// Entries returns every entry in the log, in order.
+func (log *LocalKeyLog) Entries() [][]byte {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	return append([][]byte{}, log.entries...)
+}
+
+func (log *LocalKeyLog) Append(entry []byte) (int, error) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	return log.add(entry), nil
+}
+
+func (log *LocalKeyLog) Head() (KeyLogHead, error) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	return KeyLogHead{Size: len(log.leaves), Root: merkleRoot(log.leaves)}, nil
+}
+
+func (log *LocalKeyLog) Lookup(username string) ([]int, error) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	return append([]int{}, log.users[username]...), nil
+}
+
+func (log *LocalKeyLog) Entry(index int) ([]byte, error) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	if index < 0 || index >= len(log.entries) {
+		return nil, errors.New(strings.ToTitle("no such entry"))
+	}
+	return log.entries[index], nil
+}
+
+func (log *LocalKeyLog) InclusionProof(index int, size int) ([][]byte, error) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	if index < 0 || index >= size || size > len(log.leaves) {
+		return nil, errors.New(strings.ToTitle("no such entry"))
+	}
+	return inclusionProof(index, log.leaves[:size]), nil
+}
+
+func (log *LocalKeyLog) ConsistencyProof(first int, second int) ([][]byte, error) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	if first < 0 || first > second || second > len(log.leaves) {
+		return nil, errors.New(strings.ToTitle("invalid sizes"))
+	}
+	return consistencyProof(first, log.leaves[:second]), nil
+}
@@ -0,0 +1,218 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// A lease lets one session tell every other session with access to a file that it is editing
+// the file. It lives next to the header, at an address derived from the header's UUID, and is
+// encrypted with keys derived from the file key, so only users with access can read or take it.
+// Leases are advisory: StoreFile, AppendToFile and RevokeAccess refuse to touch a file leased
+// by another session, but a lease never changes what LoadFile returns. Every lease expires, so a
+// client that crashes while holding one only blocks the file until then. Revoking access moves
+// the header, which also releases the lease.
+//
+// Only the owner's own leases hold off a revocation, or a recipient could keep their access by
+// renewing a lease forever. Anyone with access can write a lease naming any holder, so the owner's
+// leases carry a tag that only the owner's sessions can compute. The tag key comes from the
+// owner's working keys, so when those change the owner's live leases are tagged again.
+
+// MaxLeaseDuration is the longest a single call to LockFile can hold a file for. Call LockFile
+// again before the lease runs out to extend it.
+const MaxLeaseDuration = time.Hour
+
+type lease struct {
+	Holder  string
+	Session uuid.UUID
+	Expires time.Time
+	Tag     []byte `json:",omitempty"`
+}
+
+func leaseKeyGen(curFileStruct filestruct) userlib.UUID {
+	hashed := userlib.Hash(concatenateByteArrays(curFileStruct.First[:], []byte("lease")))[:16]
+	lKey, _ := uuid.FromBytes(hashed)
+	return lKey
+}
+
+func leaseKeysGen(curFileStruct filestruct) ([]byte, []byte, error) {
+	encKey, err := userlib.HashKDF(curFileStruct.RootEnc, []byte("lease-enc"))
+	if err != nil {
+		return nil, nil, err
+	}
+	macKey, err := userlib.HashKDF(curFileStruct.RootMac, []byte("lease-mac"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return encKey[:16], macKey[:16], nil
+}
+
+// helper method to load the lease on a file, along with its ciphertext. A lease that fails to
+// verify is treated as no lease at all, since anyone with access could simply overwrite it.
+func loadLease(curFileStruct filestruct) (*lease, []byte) {
+	ciphertext, ok := datastoreGet(leaseKeyGen(curFileStruct))
+	if !ok {
+		return nil, nil
+	}
+	encKey, macKey, err := leaseKeysGen(curFileStruct)
+	if err != nil {
+		return nil, ciphertext
+	}
+	leaseBytes, err := VerifyDec(ciphertext, encKey, macKey)
+	if err != nil {
+		return nil, ciphertext
+	}
+	var curLease lease
+	err = json.Unmarshal(leaseBytes, &curLease)
+	if err != nil {
+		return nil, ciphertext
+	}
+	return &curLease, ciphertext
+}
+
+// heldByOther reports whether the lease is still running and belongs to another session
+func (curLease *lease) heldByOther(userdata *User) bool {
+	if curLease == nil || time.Now().After(curLease.Expires) {
+		return false
+	}
+	return curLease.Holder != userdata.Username || curLease.Session != userdata.session
+}
+
+// leaseTag is what the owner's sessions put on their leases on a file they own
+func (userdata *User) leaseTag(curFileStruct filestruct, curLease lease) ([]byte, error) {
+	return leaseTag(userdata.SharetreeMac, curFileStruct, curLease)
+}
+
+func leaseTag(sharetreeMac []byte, curFileStruct filestruct, curLease lease) ([]byte, error) {
+	tagKey, err := userlib.HashKDF(sharetreeMac, []byte("lease-tag"))
+	if err != nil {
+		return nil, err
+	}
+	expires := []byte(strconv.FormatInt(curLease.Expires.UnixNano(), 10))
+	content := concatenateByteArrays(concatenateByteArrays(curFileStruct.First[:], curLease.Session[:]), expires)
+	return userlib.HMACEval(tagKey[:16], concatenateByteArrays(content, []byte(curLease.Holder)))
+}
+
+// checkOwnLease returns an error if another of the owner's sessions holds the lease on a file
+// they own. Leases held by recipients are ignored.
+func (userdata *User) checkOwnLease(curFileStruct filestruct) error {
+	curLease, _ := loadLease(curFileStruct)
+	if !curLease.heldByOther(userdata) || curLease.Holder != userdata.Username {
+		return nil
+	}
+	tag, err := userdata.leaseTag(curFileStruct, *curLease)
+	if err != nil || !userlib.HMACEqual(tag, curLease.Tag) {
+		return nil
+	}
+	return errors.New(strings.ToTitle("file is locked by another of your sessions until " +
+		curLease.Expires.Format(time.RFC3339)))
+}
+
+// checkLease returns an error if another session holds the lease on the file
+func (userdata *User) checkLease(curFileStruct filestruct) error {
+	curLease, _ := loadLease(curFileStruct)
+	if curLease.heldByOther(userdata) {
+		return errors.New(strings.ToTitle("file is locked by " + curLease.Holder + " until " +
+			curLease.Expires.Format(time.RFC3339)))
+	}
+	return nil
+}
+
+// LockFile takes the lease on a file for the given duration, or extends it if this session
+// already holds it. It fails if another session holds an unexpired lease.
+func (userdata *User) LockFile(filename string, duration time.Duration) error {
+	defer userdata.measure("LockFile")()
+	if userdata == nil || userdata.Username == "" || userdata.FilestructMac == nil || userdata.FilestructEnc == nil {
+		return errors.New(strings.ToTitle("ERROR"))
+	}
+	if duration <= 0 || duration > MaxLeaseDuration {
+		return errors.New(strings.ToTitle("lease duration must be positive and at most " + MaxLeaseDuration.String()))
+	}
+	pointer, shared := userdata.loadFileStruct(filename)
+	if pointer == nil {
+		return errors.New(strings.ToTitle("File access not granted"))
+	}
+	curFileStruct := *pointer
+	curLease, old := loadLease(curFileStruct)
+	if curLease.heldByOther(userdata) {
+		return errors.New(strings.ToTitle("file is locked by " + curLease.Holder + " until " +
+			curLease.Expires.Format(time.RFC3339)))
+	}
+
+	encKey, macKey, err := leaseKeysGen(curFileStruct)
+	if err != nil {
+		return errors.New(strings.ToTitle("ERROR"))
+	}
+	newLease := lease{
+		Holder:  userdata.Username,
+		Session: userdata.session,
+		Expires: time.Now().Add(duration),
+	}
+	if !shared {
+		newLease.Tag, err = userdata.leaseTag(curFileStruct, newLease)
+		if err != nil {
+			return errors.New(strings.ToTitle("ERROR"))
+		}
+	}
+	leaseBytes, err := json.Marshal(newLease)
+	if err != nil {
+		return errors.New(strings.ToTitle("ERROR"))
+	}
+	// two sessions can both see the file unlocked; only the first to write gets the lease
+	if !compareAndSwap(leaseKeyGen(curFileStruct), old, EncMacGen(leaseBytes, encKey, macKey)) {
+		return errors.New(strings.ToTitle("file was locked by another session"))
+	}
+	return nil
+}
+
+// UnlockFile gives up the lease this session holds on a file.
+func (userdata *User) UnlockFile(filename string) error {
+	defer userdata.measure("UnlockFile")()
+	if userdata == nil || userdata.Username == "" || userdata.FilestructMac == nil || userdata.FilestructEnc == nil {
+		return errors.New(strings.ToTitle("ERROR"))
+	}
+	pointer, _ := userdata.loadFileStruct(filename)
+	if pointer == nil {
+		return errors.New(strings.ToTitle("File access not granted"))
+	}
+	curLease, _ := loadLease(*pointer)
+	if curLease == nil || curLease.heldByOther(userdata) {
+		return errors.New(strings.ToTitle("file is not locked by this session"))
+	}
+	datastoreDelete(leaseKeyGen(*pointer))
+	return nil
+}
+
+// moveLease tags the owner's live lease on a file again under the working keys of the next
+// epoch. A lease with any other tag is left alone.
+func moveLease(username string, curFileStruct filestruct, from workingkeys, to workingkeys) error {
+	curLease, old := loadLease(curFileStruct)
+	if curLease == nil || curLease.Holder != username || time.Now().After(curLease.Expires) {
+		return nil
+	}
+	tag, err := leaseTag(from.SharetreeMac, curFileStruct, *curLease)
+	if err != nil || !userlib.HMACEqual(tag, curLease.Tag) {
+		return nil
+	}
+	curLease.Tag, err = leaseTag(to.SharetreeMac, curFileStruct, *curLease)
+	if err != nil {
+		return err
+	}
+	encKey, macKey, err := leaseKeysGen(curFileStruct)
+	if err != nil {
+		return err
+	}
+	leaseBytes, err := json.Marshal(curLease)
+	if err != nil {
+		return err
+	}
+	// a lease taken or given up in the meantime needs nothing from us
+	compareAndSwap(leaseKeyGen(curFileStruct), old, EncMacGen(leaseBytes, encKey, macKey))
+	return nil
+}
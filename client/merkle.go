@@ -0,0 +1,147 @@
+package client
+
+import (
+	"bytes"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+)
+
+// Merkle tree hashing as in RFC 6962, used by the key transparency log (see keylog.go). Leaves
+// and interior nodes are hashed with different prefixes, so a leaf can never pass for a node.
+// The proofs follow the RFC too: an inclusion proof shows that an entry is in a tree of a given
+// size, and a consistency proof shows that a smaller tree is a prefix of a larger one.
+
+func merkleLeaf(entry []byte) []byte {
+	return userlib.Hash(concatenateByteArrays([]byte{0}, entry))
+}
+
+func merkleNode(left []byte, right []byte) []byte {
+	return userlib.Hash(concatenateByteArrays(concatenateByteArrays([]byte{1}, left), right))
+}
+
+// merkleSplit returns the largest power of two smaller than n, for n > 1
+func merkleSplit(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// merkleRoot returns the root of the tree over the given leaf hashes
+func merkleRoot(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		return userlib.Hash(nil)
+	case 1:
+		return leaves[0]
+	}
+	k := merkleSplit(len(leaves))
+	return merkleNode(merkleRoot(leaves[:k]), merkleRoot(leaves[k:]))
+}
+
+// inclusionProof returns the audit path for leaf m in the tree over leaves
+func inclusionProof(m int, leaves [][]byte) [][]byte {
+	if len(leaves) <= 1 {
+		return nil
+	}
+	k := merkleSplit(len(leaves))
+	if m < k {
+		return append(inclusionProof(m, leaves[:k]), merkleRoot(leaves[k:]))
+	}
+	return append(inclusionProof(m-k, leaves[k:]), merkleRoot(leaves[:k]))
+}
+
+// consistencyProof shows that the tree over the first m leaves is a prefix of the tree over all
+// of them
+func consistencyProof(m int, leaves [][]byte) [][]byte {
+	if m <= 0 || m >= len(leaves) {
+		return nil
+	}
+	return subProof(m, leaves, true)
+}
+
+func subProof(m int, leaves [][]byte, complete bool) [][]byte {
+	if m == len(leaves) {
+		if complete {
+			return nil
+		}
+		return [][]byte{merkleRoot(leaves)}
+	}
+	k := merkleSplit(len(leaves))
+	if m <= k {
+		return append(subProof(m, leaves[:k], complete), merkleRoot(leaves[k:]))
+	}
+	return append(subProof(m-k, leaves[k:], false), merkleRoot(leaves[:k]))
+}
+
+// verifyInclusion checks that leaf is at index in the tree of the given size and root
+func verifyInclusion(index int, size int, leaf []byte, proof [][]byte, root []byte) bool {
+	if index < 0 || index >= size {
+		return false
+	}
+	fn, sn := index, size-1
+	hash := leaf
+	for _, sibling := range proof {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			hash = merkleNode(sibling, hash)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			hash = merkleNode(hash, sibling)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(hash, root)
+}
+
+// verifyConsistency checks that the tree of size first and root firstRoot is a prefix of the
+// tree of size second and root secondRoot
+func verifyConsistency(first int, second int, firstRoot []byte, secondRoot []byte, proof [][]byte) bool {
+	if first < 0 || first > second {
+		return false
+	}
+	if first == second {
+		return len(proof) == 0 && bytes.Equal(firstRoot, secondRoot)
+	}
+	if first == 0 {
+		// the empty tree is a prefix of every tree
+		return len(proof) == 0
+	}
+	if first&(first-1) == 0 {
+		proof = append([][]byte{firstRoot}, proof...)
+	}
+	if len(proof) == 0 {
+		return false
+	}
+	fn, sn := first-1, second-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = merkleNode(c, fr)
+			sr = merkleNode(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = merkleNode(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(fr, firstRoot) && bytes.Equal(sr, secondRoot)
+}
@@ -0,0 +1,182 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// A user's filestructs are stored at addresses derived from the filename, so nothing in the
+// Datastore says which names a user has. Each user keeps a list of them instead, encrypted with
+// keys derived from their filestruct keys. StoreFile and AcceptInvitation add a name the first
+// time it is used, and DeleteFile and TransferOwnership take it out again. A name stays on the
+// list when a recipient loses access, so ListFiles checks each one before reporting it. Files
+// created before the list existed aren't on it until they are stored again.
+
+type namespace struct {
+	Files []string
+	// the user's own groups, so they can be found when the user's keys change (see epochs.go)
+	Groups []string `json:",omitempty"`
+}
+
+func namespaceKeyGen(username string) userlib.UUID {
+	p1 := userlib.Hash([]byte(username))
+	p2 := userlib.Hash([]byte("namespace"))
+	hashed := userlib.Hash(concatenateByteArrays(p1, p2))[:16]
+	nKey, _ := uuid.FromBytes(hashed)
+	return nKey
+}
+
+func (userdata *User) namespaceKeys() ([]byte, []byte, error) {
+	return userdata.workingKeys().derived("namespace")
+}
+
+// helper method to load the user's list of filenames, along with its ciphertext
+func (userdata *User) loadNamespace() (*namespace, []byte, error) {
+	ciphertext, ok := datastoreGet(namespaceKeyGen(userdata.Username))
+	if !ok {
+		return &namespace{}, nil, nil
+	}
+	encKey, macKey, err := userdata.namespaceKeys()
+	if err != nil {
+		return nil, nil, err
+	}
+	namesBytes, err := VerifyDec(ciphertext, encKey, macKey)
+	if err != nil {
+		return nil, nil, errors.New(strings.ToTitle("verification failed"))
+	}
+	var names namespace
+	err = json.Unmarshal(namesBytes, &names)
+	if err != nil {
+		return nil, nil, errors.New(strings.ToTitle("verification failed"))
+	}
+	return &names, ciphertext, nil
+}
+
+// changeNamespace applies change to the user's list of filenames, which reports whether it
+// changed anything
+func (userdata *User) changeNamespace(change func(names *namespace) bool) error {
+	encKey, macKey, err := userdata.namespaceKeys()
+	if err != nil {
+		return err
+	}
+	for attempt := 0; attempt < swapAttempts; attempt++ {
+		names, old, err := userdata.loadNamespace()
+		if err != nil {
+			return err
+		}
+		if !change(names) {
+			// the list already says what it should
+			return nil
+		}
+		namesBytes, err := json.Marshal(names)
+		if err != nil {
+			return err
+		}
+		if compareAndSwap(namespaceKeyGen(userdata.Username), old, EncMacGen(namesBytes, encKey, macKey)) {
+			return nil
+		}
+	}
+	return errors.New(strings.ToTitle("file list is being changed by another session, try again"))
+}
+
+// updateNamespace adds filename to the user's list of filenames, or removes it if add is false
+func (userdata *User) updateNamespace(filename string, add bool) error {
+	return userdata.changeNamespace(func(names *namespace) bool {
+		var files []string
+		for _, name := range names.Files {
+			if name != filename {
+				files = append(files, name)
+			}
+		}
+		if add {
+			files = append(files, filename)
+		}
+		if len(files) == len(names.Files) {
+			return false
+		}
+		names.Files = files
+		return true
+	})
+}
+
+// addGroupName adds groupname to the user's list of groups
+func (userdata *User) addGroupName(groupname string) error {
+	return userdata.changeNamespace(func(names *namespace) bool {
+		for _, name := range names.Groups {
+			if name == groupname {
+				return false
+			}
+		}
+		names.Groups = append(names.Groups, groupname)
+		return true
+	})
+}
+
+// ListFiles lists the names of the files the user can currently access, in sorted order.
+func (userdata *User) ListFiles() ([]string, error) {
+	defer userdata.measure("ListFiles")()
+	if userdata == nil || userdata.Username == "" || userdata.FilestructMac == nil || userdata.FilestructEnc == nil {
+		return nil, errors.New(strings.ToTitle("ERROR"))
+	}
+	names, _, err := userdata.loadNamespace()
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, name := range names.Files {
+		pointer, _ := userdata.loadFileStruct(name)
+		if pointer != nil {
+			files = append(files, name)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// DeleteFile removes a file from the user's namespace. A recipient only gives up their own
+// access. The owner deletes the file itself, including every version kept of it, and must first
+// revoke everyone they shared it with.
+func (userdata *User) DeleteFile(filename string) error {
+	defer userdata.measure("DeleteFile")()
+	if userdata == nil || userdata.Username == "" || userdata.FilestructMac == nil || userdata.FilestructEnc == nil {
+		return errors.New(strings.ToTitle("ERROR"))
+	}
+	pointer, shared := userdata.loadFileStruct(filename)
+	if pointer == nil {
+		return errors.New(strings.ToTitle("Access not granted"))
+	}
+	storageKey := filestructKeyGen(userdata.Username, filename)
+	if shared {
+		datastoreDelete(storageKey)
+		return userdata.updateNamespace(filename, false)
+	}
+	entries, err := userdata.listAccess(filename)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 1 {
+		return errors.New(strings.ToTitle("revoke access before deleting a file"))
+	}
+	curFileStruct := *pointer
+	err = userdata.checkLease(curFileStruct)
+	if err != nil {
+		return err
+	}
+	header, _ := readFileHeader(curFileStruct)
+	if header != nil {
+		// everything the header can reach is garbage once the header itself is gone
+		header.discard(header.Versions)
+		for _, entry := range append(header.Garbage, header.chain()) {
+			entry.reclaim()
+		}
+	}
+	multiDelete([]uuid.UUID{curFileStruct.First, leaseKeyGen(curFileStruct),
+		generateSharetreeKey(userdata.Username, filename), storageKey})
+	userdata.clearShareLog(filename)
+	return userdata.updateNamespace(filename, false)
+}
@@ -0,0 +1,410 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Ownership of a file is the owner's filestruct together with the file's sharetree. To hand it
+// over, the current owner seals both to the new owner and signs them, then drops a notification
+// in the new owner's inbox. The owner keeps everything until the new owner installs the file in
+// their own namespace with AcceptOwnership, so a transfer that is declined or never accepted
+// leaves the file with its owner. Sharing or revoking in the meantime cancels the transfer, since
+// the new owner would get a stale sharetree.
+//
+// The new owner never touches the old owner's state. Instead they swap the transfer for a signed
+// note that they accepted it, and the old owner finishes the handoff: their next session clears
+// out their copies, like it finishes revocations, and so does any attempt to share or revoke the
+// file before then. The owner keeps a list of the transfers they have offered, and to whom, so
+// that a note from anyone else is ignored.
+//
+// An owner who stays on as a recipient also prepares the filestruct they will have afterwards,
+// encrypted under their own keys; finishing the handoff just moves it into place.
+
+type ownershiptransfer struct {
+	Filename string
+	File     filestruct
+	Tree     sharetree
+}
+
+// what the new owner leaves at the transfer's address once they have installed the file
+type transferaccepted struct {
+	Filename string
+	First    uuid.UUID
+}
+
+// handoffsKeyGen is where the user keeps the transfers they have offered, as a map from filename
+// to the new owner
+func handoffsKeyGen(username string) userlib.UUID {
+	p1 := userlib.Hash([]byte(username))
+	p2 := userlib.Hash([]byte("handoffs"))
+	hashed := userlib.Hash(concatenateByteArrays(p1, p2))[:16]
+	hKey, _ := uuid.FromBytes(hashed)
+	return hKey
+}
+
+// transferKeyGen is where a pending transfer of the user's file is, so they can cancel it
+func transferKeyGen(username string, filename string) userlib.UUID {
+	p1 := userlib.Hash([]byte(username))
+	p2 := userlib.Hash([]byte(filename))
+	p3 := userlib.Hash([]byte("transfer"))
+	hashed := userlib.Hash(concatenateByteArrays(concatenateByteArrays(p1, p2), p3))[:16]
+	tKey, _ := uuid.FromBytes(hashed)
+	return tKey
+}
+
+// keepKeyGen is where an owner who keeps access leaves their future filestruct
+func keepKeyGen(username string, filename string) userlib.UUID {
+	p1 := userlib.Hash([]byte(username))
+	p2 := userlib.Hash([]byte(filename))
+	p3 := userlib.Hash([]byte("transfer-keep"))
+	hashed := userlib.Hash(concatenateByteArrays(concatenateByteArrays(p1, p2), p3))[:16]
+	kKey, _ := uuid.FromBytes(hashed)
+	return kKey
+}
+
+// readHandoffs loads the transfers the user has offered, along with their ciphertext
+func (userdata *User) readHandoffs() (map[string]string, []byte, error) {
+	handoffs := make(map[string]string)
+	ciphertext, ok := datastoreGet(handoffsKeyGen(userdata.Username))
+	if !ok {
+		return handoffs, nil, nil
+	}
+	handoffsBytes, err := VerifyDec(ciphertext, userdata.SharetreeEnc, userdata.SharetreeMac)
+	if err != nil || json.Unmarshal(handoffsBytes, &handoffs) != nil {
+		return nil, nil, errors.New(strings.ToTitle("list of transfers has been tampered with"))
+	}
+	return handoffs, ciphertext, nil
+}
+
+// changeHandoffs applies change to the list of transfers and swaps it in, like changeJournal
+func (userdata *User) changeHandoffs(change func(handoffs map[string]string)) error {
+	for attempt := 0; attempt < swapAttempts; attempt++ {
+		handoffs, old, err := userdata.readHandoffs()
+		if err != nil {
+			return err
+		}
+		change(handoffs)
+		var value []byte
+		if len(handoffs) > 0 {
+			handoffsBytes, err := json.Marshal(handoffs)
+			if err != nil {
+				return err
+			}
+			value = EncMacGen(handoffsBytes, userdata.SharetreeEnc, userdata.SharetreeMac)
+		} else if old == nil {
+			return nil
+		}
+		if compareAndSwap(handoffsKeyGen(userdata.Username), old, value) {
+			return nil
+		}
+	}
+	return errors.New(strings.ToTitle("transfers are being changed by another session, try again"))
+}
+
+// transferAccepted reports whether newOwner has accepted the transfer of one of the user's files,
+// and whether the transfer is still there at all
+func (userdata *User) transferAccepted(filename string, newOwner string) (bool, bool) {
+	sealed, ok := datastoreGet(transferKeyGen(userdata.Username, filename))
+	if !ok {
+		return false, false
+	}
+	entry := userdata.openSealed(sealed)
+	if entry == nil || !userdata.verifyEntry(entry, newOwner, userdata.Username) {
+		return false, true
+	}
+	var accepted transferaccepted
+	if json.Unmarshal(entry.Content, &accepted) != nil || accepted.Filename != filename {
+		return false, true
+	}
+	pointer, shared := userdata.loadFileStruct(filename)
+	return pointer != nil && !shared && pointer.First == accepted.First, true
+}
+
+// completeHandoff clears out the user's copies of a file whose transfer was accepted. If they stay
+// on as a recipient, the filestruct they prepared takes the place of theirs.
+func (userdata *User) completeHandoff(filename string) error {
+	stale := []uuid.UUID{
+		transferKeyGen(userdata.Username, filename),
+		keepKeyGen(userdata.Username, filename),
+		generateSharetreeKey(userdata.Username, filename),
+		shareLogKeyGen(userdata.Username, filename),
+	}
+	kept, ok := datastoreGet(keepKeyGen(userdata.Username, filename))
+	if ok {
+		datastoreSet(filestructKeyGen(userdata.Username, filename), kept)
+	} else {
+		stale = append(stale, filestructKeyGen(userdata.Username, filename))
+	}
+	multiDelete(stale)
+	if !ok {
+		err := userdata.updateNamespace(filename, false)
+		if err != nil {
+			return err
+		}
+	}
+	return userdata.changeHandoffs(func(handoffs map[string]string) {
+		delete(handoffs, filename)
+	})
+}
+
+// withdrawTransfer withdraws the transfer of one of the user's files, along with the filestruct
+// they prepared for keeping access. A declined transfer leaves the latter behind.
+func (userdata *User) withdrawTransfer(filename string) error {
+	stale := []uuid.UUID{transferKeyGen(userdata.Username, filename)}
+	kept, ok := datastoreGet(keepKeyGen(userdata.Username, filename))
+	if ok {
+		stale = append(stale, keepKeyGen(userdata.Username, filename))
+		shareBytes, err := VerifyDec(kept, userdata.FilestructEnc, userdata.FilestructMac)
+		var keepShare sharestruct
+		if err == nil && unmarshalObject(shareBytes, &keepShare) == nil {
+			stale = append(stale, keepShare.F)
+		}
+	}
+	multiDelete(stale)
+	return userdata.changeHandoffs(func(handoffs map[string]string) {
+		delete(handoffs, filename)
+	})
+}
+
+// cancelTransfer is called before the owner changes who has access to a file. Any pending
+// transfer of the file is withdrawn, but one the new owner has already accepted is finished
+// instead, and the change refused since the file isn't the user's anymore.
+func (userdata *User) cancelTransfer(filename string) error {
+	handoffs, _, err := userdata.readHandoffs()
+	if err != nil {
+		return err
+	}
+	newOwner, ok := handoffs[filename]
+	if !ok {
+		return nil
+	}
+	accepted, _ := userdata.transferAccepted(filename, newOwner)
+	if !accepted {
+		return userdata.withdrawTransfer(filename)
+	}
+	err = userdata.completeHandoff(filename)
+	if err != nil {
+		return err
+	}
+	return errors.New(strings.ToTitle("the file has been handed over to " + newOwner))
+}
+
+// resumeHandoffs finishes every transfer that has been accepted since the user's last session,
+// and forgets those that were declined
+func (userdata *User) resumeHandoffs() error {
+	handoffs, _, err := userdata.readHandoffs()
+	if err != nil {
+		return err
+	}
+	for filename, newOwner := range handoffs {
+		accepted, pending := userdata.transferAccepted(filename, newOwner)
+		if accepted {
+			err = userdata.completeHandoff(filename)
+		} else if !pending {
+			err = userdata.withdrawTransfer(filename)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TransferOwnership hands a file the user owns to newOwner, who must already have access to it.
+// If keepAccess is set the user stays on as an ordinary recipient, otherwise the file is removed
+// from their namespace once newOwner accepts. Files shared with a group must have the group
+// revoked first, since groups belong to the user who created them.
+func (userdata *User) TransferOwnership(filename string, newOwner string, keepAccess bool) error {
+	defer userdata.measure("TransferOwnership")()
+	if userdata == nil || userdata.Username == "" || userdata.FilestructMac == nil || userdata.FilestructEnc == nil {
+		return errors.New(strings.ToTitle("ERROR"))
+	}
+	if newOwner == userdata.Username {
+		return errors.New(strings.ToTitle("user already owns this file"))
+	}
+	pointer, shared := userdata.loadFileStruct(filename)
+	if pointer == nil {
+		return errors.New(strings.ToTitle("Access not granted"))
+	}
+	if shared {
+		return errors.New(strings.ToTitle("only the owner can transfer a file"))
+	}
+	entries, err := userdata.listAccess(filename)
+	if err != nil {
+		return err
+	}
+	hasAccess := false
+	for _, entry := range entries {
+		if entry.Recipient == newOwner {
+			hasAccess = true
+		}
+		if strings.HasPrefix(entry.Recipient, GroupPrefix) {
+			return errors.New(strings.ToTitle("revoke group access before transferring a file"))
+		}
+	}
+	if !hasAccess {
+		return errors.New(strings.ToTitle("new owner does not have access to this file"))
+	}
+	// a new transfer replaces any earlier one
+	err = userdata.cancelTransfer(filename)
+	if err != nil {
+		return err
+	}
+
+	// the share log is folded into the sharetree first, since the new owner can't find its
+	// entries to delete them
+	var shareTree sharetree
+	pointer3 := userdata.loadShareTree(filename)
+	if pointer3 != nil {
+		shareTree = *pointer3
+		err = userdata.storeShareTree(filename, shareTree)
+		if err != nil {
+			return err
+		}
+	}
+	if record, ok := shareTree.Accessmap[userdata.Username]; ok {
+		record.InvitedBy = newOwner
+		shareTree.Accessmap[userdata.Username] = record
+	}
+
+	// to stay on as a recipient, the user adds a shared filestruct for themselves to the tree
+	// being handed over, though not to their own
+	if keepAccess {
+		newEncKey := userlib.RandomBytes(16)
+		newMacKey := userlib.RandomBytes(16)
+		filestructBytes, err := marshalObject(*pointer)
+		if err != nil {
+			return err
+		}
+		structUUID := uuid.New()
+		datastoreSet(structUUID, EncMacGen(filestructBytes, newEncKey, newMacKey))
+		entry := newShareEntry(userdata.Username, newOwner, structUUID, newEncKey, newMacKey)
+		shareTree.apply(entry)
+		shareBytes, err := marshalObject(sharestruct{F: structUUID, E: newEncKey, M: newMacKey, Sender: newOwner})
+		if err != nil {
+			return err
+		}
+		datastoreSet(keepKeyGen(userdata.Username, filename), EncMacGen(shareBytes, userdata.FilestructEnc, userdata.FilestructMac))
+	}
+
+	transferBytes, err := json.Marshal(ownershiptransfer{Filename: filename, File: *pointer, Tree: shareTree})
+	if err != nil {
+		return err
+	}
+	sealed, err := userdata.signAndSeal(newOwner, transferBytes)
+	if err != nil {
+		return err
+	}
+	transferPtr := transferKeyGen(userdata.Username, filename)
+	datastoreSet(transferPtr, sealed)
+	err = userdata.changeHandoffs(func(handoffs map[string]string) {
+		handoffs[filename] = newOwner
+	})
+	if err != nil {
+		datastoreDelete(transferPtr)
+		return err
+	}
+	err = userdata.deliverNotification(newOwner, notification{
+		Sender:     userdata.Username,
+		Invitation: transferPtr,
+		Filename:   filename,
+		Sent:       time.Now(),
+		Transfer:   true,
+	})
+	if err != nil {
+		_ = userdata.withdrawTransfer(filename)
+		return err
+	}
+	return nil
+}
+
+// AcceptOwnership completes a transfer started by TransferOwnership. filename is the name under
+// which the user already has access to the file; from then on they own it under that name.
+func (userdata *User) AcceptOwnership(senderUsername string, transferPtr uuid.UUID, filename string) error {
+	defer userdata.measure("AcceptOwnership")()
+	if userdata == nil || userdata.Username == "" || userdata.FilestructMac == nil || userdata.FilestructEnc == nil {
+		return errors.New(strings.ToTitle("ERROR"))
+	}
+	sealed, ok := datastoreGet(transferPtr)
+	if !ok {
+		return errors.New(strings.ToTitle("transfer not found"))
+	}
+	entry := userdata.openSealed(sealed)
+	if entry == nil || !userdata.verifyEntry(entry, senderUsername, userdata.Username) {
+		return errors.New(strings.ToTitle("invalid transfer"))
+	}
+	var transfer ownershiptransfer
+	err := json.Unmarshal(entry.Content, &transfer)
+	if err != nil {
+		return errors.New(strings.ToTitle("invalid transfer"))
+	}
+
+	// the transfer has to be for the file the user already has under this name. A user who
+	// installed it before but never got to accept it can try again.
+	pointer, _ := userdata.loadFileStruct(filename)
+	if pointer == nil || pointer.First != transfer.File.First {
+		return errors.New(strings.ToTitle("transfer does not match this file"))
+	}
+	previous, _ := datastoreGet(filestructKeyGen(userdata.Username, filename))
+
+	curFileStruct := transfer.File
+	curFileStruct.Owner = userdata.Username
+	curFileStruct.Shares = nil
+	filestructBytes, err := marshalObject(curFileStruct)
+	if err != nil {
+		return err
+	}
+	datastoreSet(filestructKeyGen(userdata.Username, filename),
+		EncMacGen(filestructBytes, userdata.FilestructEnc, userdata.FilestructMac))
+
+	shareTree := transfer.Tree
+	if shareTree.Sharemap != nil {
+		err = userdata.storeShareTree(filename, shareTree)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the old owner finishes the handoff once they find the transfer accepted
+	acceptedBytes, err := json.Marshal(transferaccepted{Filename: transfer.Filename, First: transfer.File.First})
+	if err != nil {
+		return err
+	}
+	accepted, err := userdata.signAndSeal(senderUsername, acceptedBytes)
+	if err != nil {
+		return err
+	}
+	if !compareAndSwap(transferPtr, sealed, accepted) {
+		// the old owner withdrew the transfer in the meantime, so the file stays theirs
+		datastoreSet(filestructKeyGen(userdata.Username, filename), previous)
+		datastoreDelete(generateSharetreeKey(userdata.Username, filename))
+		return errors.New(strings.ToTitle("transfer was withdrawn"))
+	}
+
+	// let every recipient know who owns the file now
+	for structUUID, keys := range shareTree.Filemap {
+		if len(keys) < 2 {
+			continue
+		}
+		branch := loadFileStruct2(structUUID, keys[0], keys[1])
+		if branch == nil {
+			continue
+		}
+		branch.Owner = userdata.Username
+		branchBytes, err := marshalObject(branch)
+		if err != nil {
+			return err
+		}
+		datastoreSet(structUUID, EncMacGen(branchBytes, keys[0], keys[1]))
+	}
+
+	// the file is the user's by now; a notification left behind only shows up as pending
+	_, _ = userdata.removeNotification(senderUsername, transferPtr)
+	return nil
+}
@@ -0,0 +1,297 @@
+package client
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// The Keystore is trusted to hand out the right public keys, but nothing stops it from handing
+// out different ones later. So the first time a user's keys are used, the fingerprint of their
+// first version is pinned, and from then on keys that don't match the pin are refused. Later
+// versions are chained from the first (see rotation.go), so they need no pins of their own. The
+// user's own keys are checked against the User struct instead.
+//
+// Pins are kept in 256 buckets, chosen by an HMAC of the pinned user's name, so the server can't
+// tell whom the user knows and pinning costs the same however many users there are. The pin index,
+// created by InitUser, records which buckets hold pins. Both are encrypted with keys derived from
+// the user's working keys (see epochs.go), so deleting a bucket, or the index, is noticed instead
+// of quietly sending the user back to trusting on first use.
+//
+// Fingerprint shows the fingerprint of the keys the Keystore currently has, for comparing out of
+// band. If a user's keys really did change, TrustKeys pins the new ones once the user has checked
+// the fingerprint.
+
+func (userdata *User) pinKeys() ([]byte, []byte, error) {
+	return userdata.workingKeys().derived("pins")
+}
+
+const pinBuckets = 256
+
+// the buckets that hold pins, one bit each
+type pinindex struct {
+	Used []byte
+}
+
+// the pins of the users whose names fall in one bucket, keyed by username
+type pinbucket struct {
+	Bucket int
+	Pins   map[string]string
+}
+
+func pinIndexKeyGen(username string) userlib.UUID {
+	p1 := userlib.Hash([]byte(username))
+	p2 := userlib.Hash([]byte("pins"))
+	hashed := userlib.Hash(concatenateByteArrays(p1, p2))[:16]
+	pKey, _ := uuid.FromBytes(hashed)
+	return pKey
+}
+
+// pinBucket returns the bucket username's pin goes in
+func pinBucket(username string, macKey []byte) (int, error) {
+	hashed, err := userlib.HMACEval(macKey, []byte("pin/"+username))
+	if err != nil {
+		return 0, err
+	}
+	return int(hashed[0]) % pinBuckets, nil
+}
+
+// pinBucketKeyGen returns where a bucket is stored
+func pinBucketKeyGen(bucket int, macKey []byte) (userlib.UUID, error) {
+	hashed, err := userlib.HMACEval(macKey, []byte("pins/"+strconv.Itoa(bucket)))
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return uuid.FromBytes(hashed[:16])
+}
+
+// helper method to store an empty pin index for a new user
+func (userdata *User) initPins() error {
+	encKey, macKey, err := userdata.pinKeys()
+	if err != nil {
+		return err
+	}
+	indexBytes, err := json.Marshal(pinindex{Used: make([]byte, pinBuckets/8)})
+	if err != nil {
+		return err
+	}
+	datastoreSet(pinIndexKeyGen(userdata.Username), EncMacGen(indexBytes, encKey, macKey))
+	return nil
+}
+
+// helper method to load the user's pin index, along with its stored bytes
+func (userdata *User) loadPinIndex(encKey []byte, macKey []byte) (*pinindex, []byte, error) {
+	ciphertext, ok := datastoreGet(pinIndexKeyGen(userdata.Username))
+	if !ok {
+		return nil, nil, errors.New(strings.ToTitle("pinned keys are missing"))
+	}
+	indexBytes, err := VerifyDec(ciphertext, encKey, macKey)
+	if err != nil {
+		return nil, nil, errors.New(strings.ToTitle("verification failed"))
+	}
+	var index pinindex
+	err = json.Unmarshal(indexBytes, &index)
+	if err != nil || len(index.Used) != pinBuckets/8 {
+		return nil, nil, errors.New(strings.ToTitle("verification failed"))
+	}
+	return &index, ciphertext, nil
+}
+
+// loadPinBucket loads a bucket of pins, along with its stored bytes. A bucket the index says is
+// in use must be there.
+func loadPinBucket(bucket int, address userlib.UUID, used bool, encKey []byte, macKey []byte) (*pinbucket, []byte, error) {
+	ciphertext, ok := datastoreGet(address)
+	if !ok {
+		if used {
+			return nil, nil, errors.New(strings.ToTitle("pinned keys are missing"))
+		}
+		return &pinbucket{Bucket: bucket, Pins: make(map[string]string)}, nil, nil
+	}
+	bucketBytes, err := VerifyDec(ciphertext, encKey, macKey)
+	if err != nil {
+		return nil, nil, errors.New(strings.ToTitle("verification failed"))
+	}
+	var pins pinbucket
+	err = json.Unmarshal(bucketBytes, &pins)
+	// the bucket names itself, so one bucket can't be moved to another's address
+	if err != nil || pins.Bucket != bucket {
+		return nil, nil, errors.New(strings.ToTitle("verification failed"))
+	}
+	if pins.Pins == nil {
+		pins.Pins = make(map[string]string)
+	}
+	return &pins, ciphertext, nil
+}
+
+// publicKeys fetches username's account keys from the Keystore, without checking any pin
+func publicKeys(username string) (userlib.PKEEncKey, userlib.DSVerifyKey, error) {
+	encKey, ok := userlib.KeystoreGet(username + "shareenc")
+	if !ok {
+		return userlib.PKEEncKey{}, userlib.DSVerifyKey{}, errors.New(strings.ToTitle("user not found"))
+	}
+	verifyKey, ok := userlib.KeystoreGet(username + "sharesign")
+	if !ok {
+		return userlib.PKEEncKey{}, userlib.DSVerifyKey{}, errors.New(strings.ToTitle("user not found"))
+	}
+	return encKey, verifyKey, nil
+}
+
+// keyFingerprint is the hash of a pair of public keys, written in groups of four hex digits
+func keyFingerprint(encKey userlib.PKEEncKey, verifyKey userlib.DSVerifyKey) (string, error) {
+	encBytes, err := json.Marshal(encKey)
+	if err != nil {
+		return "", err
+	}
+	verifyBytes, err := json.Marshal(verifyKey)
+	if err != nil {
+		return "", err
+	}
+	encoded := strings.ToUpper(hex.EncodeToString(userlib.Hash(concatenateByteArrays(encBytes, verifyBytes))[:16]))
+	var groups []string
+	for len(encoded) > 0 {
+		groups = append(groups, encoded[:4])
+		encoded = encoded[4:]
+	}
+	return strings.Join(groups, " "), nil
+}
+
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToUpper(strings.NewReplacer(" ", "", "-", "", ":", "").Replace(fingerprint))
+}
+
+// pin records fingerprint for username. Unless replace is set, a different fingerprint pinned
+// in the meantime wins and pin reports a key change.
+func (userdata *User) pin(username string, fingerprint string, replace bool) error {
+	encKey, macKey, err := userdata.pinKeys()
+	if err != nil {
+		return err
+	}
+	bucket, err := pinBucket(username, macKey)
+	if err != nil {
+		return err
+	}
+	address, err := pinBucketKeyGen(bucket, macKey)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; attempt < swapAttempts; attempt++ {
+		index, oldIndex, err := userdata.loadPinIndex(encKey, macKey)
+		if err != nil {
+			return err
+		}
+		used := index.Used[bucket/8]&(1<<(bucket%8)) != 0
+		pins, old, err := loadPinBucket(bucket, address, used, encKey, macKey)
+		if err != nil {
+			return err
+		}
+		pinned, ok := pins.Pins[username]
+		if ok && pinned != fingerprint && !replace {
+			return errors.New(strings.ToTitle("the keys of " + username + " have changed; compare fingerprints and call TrustKeys"))
+		}
+		if pinned != fingerprint {
+			pins.Pins[username] = fingerprint
+			bucketBytes, err := json.Marshal(pins)
+			if err != nil {
+				return err
+			}
+			if !compareAndSwap(address, old, EncMacGen(bucketBytes, encKey, macKey)) {
+				continue
+			}
+		}
+		// the bucket is written before the index marks it, so a session that stops in between
+		// leaves a bucket that is simply marked the next time
+		if used {
+			return nil
+		}
+		index.Used[bucket/8] |= 1 << (bucket % 8)
+		indexBytes, err := json.Marshal(index)
+		if err != nil {
+			return err
+		}
+		if compareAndSwap(pinIndexKeyGen(userdata.Username), oldIndex, EncMacGen(indexBytes, encKey, macKey)) {
+			return nil
+		}
+	}
+	return errors.New(strings.ToTitle("pinned keys are being changed by another session, try again"))
+}
+
+// peerKeys returns every version of username's account keys, oldest first (see rotation.go). The
+// first version is pinned on first use, later ones must follow from it, and the latest must be
+// the one in the key log.
+func (userdata *User) peerKeys(username string) ([]keyversion, error) {
+	versions, err := accountKeys(username)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint, err := keyFingerprint(versions[0].Enc, versions[0].Sign)
+	if err != nil {
+		return nil, err
+	}
+	if username == userdata.Username {
+		own, err := keyFingerprint(userdata.SharePublicKeyEnc, userdata.SharePublicKeySign)
+		if err != nil || own != fingerprint {
+			return nil, errors.New(strings.ToTitle("the keystore has the wrong keys for this user"))
+		}
+	}
+	latest := versions[len(versions)-1]
+	latestFingerprint, err := keyFingerprint(latest.Enc, latest.Sign)
+	if err != nil {
+		return nil, err
+	}
+	// keys that aren't in the key log are refused before they could be pinned (see keylog.go)
+	err = userdata.checkKeyLog(username, latestFingerprint)
+	if err != nil {
+		return nil, err
+	}
+	if username != userdata.Username {
+		err = userdata.pin(username, fingerprint, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return versions, nil
+}
+
+// Fingerprint returns the fingerprint of username's public keys as the Keystore has them now,
+// for comparing with the fingerprint they see for themselves. Rotating keys doesn't change it.
+func (userdata *User) Fingerprint(username string) (string, error) {
+	defer userdata.measure("Fingerprint")()
+	if userdata == nil || userdata.Username == "" {
+		return "", errors.New(strings.ToTitle("ERROR"))
+	}
+	return currentFingerprint(username)
+}
+
+// currentFingerprint is the fingerprint of username's public keys in the Keystore
+func currentFingerprint(username string) (string, error) {
+	encKey, verifyKey, err := publicKeys(username)
+	if err != nil {
+		return "", err
+	}
+	return keyFingerprint(encKey, verifyKey)
+}
+
+// TrustKeys pins username's current public keys, replacing any pinned before, as long as their
+// fingerprint is the one given.
+func (userdata *User) TrustKeys(username string, fingerprint string) error {
+	defer userdata.measure("TrustKeys")()
+	if userdata == nil || userdata.Username == "" || userdata.FilestructMac == nil || userdata.FilestructEnc == nil {
+		return errors.New(strings.ToTitle("ERROR"))
+	}
+	if username == userdata.Username {
+		return errors.New(strings.ToTitle("your own keys are always trusted"))
+	}
+	current, err := currentFingerprint(username)
+	if err != nil {
+		return err
+	}
+	if normalizeFingerprint(current) != normalizeFingerprint(fingerprint) {
+		return errors.New(strings.ToTitle("fingerprint doesn't match the keystore"))
+	}
+	return userdata.pin(username, current, true)
+}
@@ -0,0 +1,347 @@
+package client
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// The User struct is only stored encrypted under the password, so a forgotten password would
+// lose the account. A user can opt into recovery: a random recovery key encrypts a second copy
+// of the User struct, and each recovery code encrypts the recovery key. The codes themselves are
+// only ever shown to the user, so the Datastore holds nothing that opens the account without
+// one. RecoverAccount uses up a code to set a new password.
+//
+// The recovery key is also kept encrypted under keys derived from the account's root keys, so a
+// session logged in with the password can hand out new codes without invalidating anything else
+// that relies on the key. Being MACed, it can't be swapped for a key someone else knows, which
+// would hand them the User struct the next time it is stored for recovery.
+//
+// The whole recovery state is MACed under the account's keys as well, so entries can't be
+// dropped from it or added back. RecoverAccount checks it once the User struct is open, swaps
+// the used code out before the new password is stored, and marks the code used in the Keystore,
+// which can't be rolled back, so replaying an earlier state doesn't bring the code back either.
+
+// how many random bytes a recovery code encodes
+const recoveryCodeLen = 16
+
+type recoverystate struct {
+	// the recovery key, encrypted under keys derived from the account's root keys
+	Key []byte
+	// the User struct, encrypted under the recovery key
+	User []byte
+	// the recovery key encrypted under each code, keyed by an ID derived from the code
+	Codes map[string][]byte
+	// the recovery key escrowed with trustees, if it is (see escrow.go)
+	Escrow *escrow `json:",omitempty"`
+	// MACs everything above under a key derived from the account's root keys
+	Mac []byte `json:",omitempty"`
+}
+
+func recoveryKeyGen(username string) userlib.UUID {
+	p1 := userlib.Hash([]byte(username))
+	p2 := userlib.Hash([]byte("recovery"))
+	hashed := userlib.Hash(concatenateByteArrays(p1, p2))[:16]
+	rKey, _ := uuid.FromBytes(hashed)
+	return rKey
+}
+
+func userKeyGen(username string) userlib.UUID {
+	userkey, _ := uuid.FromBytes(userlib.Hash([]byte(username))[:16])
+	return userkey
+}
+
+// usedCodeName is where the Keystore marks a recovery code as used
+func usedCodeName(username string, id string) string {
+	return username + "/recovery-used/" + id
+}
+
+// helper method to load a user's recovery state along with what is stored, or nil if they never
+// set up recovery. The state isn't checked yet; that needs the account's keys.
+func loadRecovery(username string) (*recoverystate, []byte) {
+	stateBytes, ok := datastoreGet(recoveryKeyGen(username))
+	if !ok {
+		return nil, nil
+	}
+	var state recoverystate
+	err := json.Unmarshal(stateBytes, &state)
+	if err != nil {
+		return nil, nil
+	}
+	if state.Codes == nil {
+		state.Codes = make(map[string][]byte)
+	}
+	return &state, stateBytes
+}
+
+// recoveryMac computes the MAC of everything in state but the MAC itself
+func (userdata *User) recoveryMac(state *recoverystate) ([]byte, error) {
+	macKey, err := userlib.HashKDF(userdata.AccountMac, []byte("recovery-state-mac"))
+	if err != nil {
+		return nil, err
+	}
+	unsealed := *state
+	unsealed.Mac = nil
+	stateBytes, err := json.Marshal(unsealed)
+	if err != nil {
+		return nil, err
+	}
+	return userlib.HMACEval(macKey[:16], stateBytes)
+}
+
+func (userdata *User) recoveryValid(state *recoverystate) bool {
+	mac, err := userdata.recoveryMac(state)
+	return err == nil && len(state.Mac) == len(mac) && userlib.HMACEqual(mac, state.Mac)
+}
+
+func (userdata *User) sealRecovery(state *recoverystate) ([]byte, error) {
+	mac, err := userdata.recoveryMac(state)
+	if err != nil {
+		return nil, err
+	}
+	state.Mac = mac
+	return json.Marshal(state)
+}
+
+func (userdata *User) storeRecovery(state *recoverystate) error {
+	stateBytes, err := userdata.sealRecovery(state)
+	if err != nil {
+		return err
+	}
+	datastoreSet(recoveryKeyGen(userdata.Username), stateBytes)
+	return nil
+}
+
+func recoveryUserKeys(key []byte) ([]byte, []byte, error) {
+	encKey, err := userlib.HashKDF(key, []byte("recovery-user-enc"))
+	if err != nil {
+		return nil, nil, err
+	}
+	macKey, err := userlib.HashKDF(key, []byte("recovery-user-mac"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return encKey[:16], macKey[:16], nil
+}
+
+// codeKeys derives where a code's entry is kept and the keys it is encrypted with. The ID is
+// one-way, so it says nothing about the keys.
+func codeKeys(code string) (string, []byte, []byte, error) {
+	normalized := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(normalized)
+	if err != nil || len(secret) != recoveryCodeLen {
+		return "", nil, nil, errors.New(strings.ToTitle("invalid recovery code"))
+	}
+	id, err := userlib.HashKDF(secret, []byte("recovery-code-id"))
+	if err != nil {
+		return "", nil, nil, err
+	}
+	encKey, err := userlib.HashKDF(secret, []byte("recovery-code-enc"))
+	if err != nil {
+		return "", nil, nil, err
+	}
+	macKey, err := userlib.HashKDF(secret, []byte("recovery-code-mac"))
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return hex.EncodeToString(id[:16]), encKey[:16], macKey[:16], nil
+}
+
+// newRecoveryCode returns a random code, written in groups of four characters
+func newRecoveryCode() string {
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(userlib.RandomBytes(recoveryCodeLen))
+	var groups []string
+	for len(encoded) > 4 {
+		groups = append(groups, encoded[:4])
+		encoded = encoded[4:]
+	}
+	return strings.Join(append(groups, encoded), "-")
+}
+
+func (userdata *User) recoveryKeyKeys() ([]byte, []byte, error) {
+	encKey, err := userlib.HashKDF(userdata.AccountEnc, []byte("recovery-key-enc"))
+	if err != nil {
+		return nil, nil, err
+	}
+	macKey, err := userlib.HashKDF(userdata.AccountMac, []byte("recovery-key-mac"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return encKey[:16], macKey[:16], nil
+}
+
+// recoveryKey returns the user's recovery key along with their recovery state, creating both if
+// the user has none yet. Only sessions holding the account keys can open an existing key, and a
+// key that doesn't verify is refused rather than replaced, so it is never one someone else chose.
+func (userdata *User) recoveryKey() ([]byte, *recoverystate, error) {
+	if !userdata.holdsAccountKeys() {
+		return nil, nil, errors.New(strings.ToTitle("only a session logged in with the password can manage recovery"))
+	}
+	encKey, macKey, err := userdata.recoveryKeyKeys()
+	if err != nil {
+		return nil, nil, err
+	}
+	state, _ := loadRecovery(userdata.Username)
+	if state != nil {
+		if !userdata.recoveryValid(state) {
+			return nil, nil, errors.New(strings.ToTitle("invalid recovery state"))
+		}
+		key, err := VerifyDec(state.Key, encKey, macKey)
+		if err != nil || len(key) != 16 {
+			return nil, nil, errors.New(strings.ToTitle("invalid recovery state"))
+		}
+		return key, state, nil
+	}
+	key := userlib.RandomBytes(16)
+	return key, &recoverystate{Key: EncMacGen(key, encKey, macKey), Codes: make(map[string][]byte)}, nil
+}
+
+// sealRecoveryUser stores the current User struct under the recovery key
+func (userdata *User) sealRecoveryUser(key []byte, state *recoverystate) error {
+	encKey, macKey, err := recoveryUserKeys(key)
+	if err != nil {
+		return err
+	}
+	userBytes, err := json.Marshal(userdata)
+	if err != nil {
+		return err
+	}
+	state.User = EncMacGen(userBytes, encKey, macKey)
+	return nil
+}
+
+// GenerateRecoveryCodes sets up account recovery and returns n new recovery codes, each of which
+// can be used once with RecoverAccount. Codes generated earlier stop working.
+func (userdata *User) GenerateRecoveryCodes(n int) ([]string, error) {
+	defer userdata.measure("GenerateRecoveryCodes")()
+	if userdata == nil || userdata.Username == "" || userdata.FilestructMac == nil || userdata.FilestructEnc == nil {
+		return nil, errors.New(strings.ToTitle("ERROR"))
+	}
+	if n <= 0 {
+		return nil, errors.New(strings.ToTitle("ask for at least one recovery code"))
+	}
+	key, state, err := userdata.recoveryKey()
+	if err != nil {
+		return nil, err
+	}
+	err = userdata.sealRecoveryUser(key, state)
+	if err != nil {
+		return nil, err
+	}
+	codes := make([]string, n)
+	state.Codes = make(map[string][]byte)
+	for i := range codes {
+		codes[i] = newRecoveryCode()
+		id, encKey, macKey, err := codeKeys(codes[i])
+		if err != nil {
+			return nil, err
+		}
+		state.Codes[id] = EncMacGen(key, encKey, macKey)
+	}
+	err = userdata.storeRecovery(state)
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// InitUserWithRecovery creates a user like InitUser and also returns n recovery codes for them.
+func InitUserWithRecovery(username string, password string, n int) (*User, []string, error) {
+	userdata, err := InitUser(username, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	codes, err := userdata.GenerateRecoveryCodes(n)
+	if err != nil {
+		return nil, nil, err
+	}
+	return userdata, codes, nil
+}
+
+// restoreAccount opens the copy of the User struct kept for recovery and checks the recovery
+// state against the account's keys. Only once consume has used up whatever opened it and the
+// account's keys have loaded is the struct stored under the new password, so a recovery that
+// fails partway leaves the old password working.
+func restoreAccount(username string, state *recoverystate, key []byte, newPassword string,
+	consume func(udata *User) error) (*User, error) {
+	encKey, macKey, err := recoveryUserKeys(key)
+	if err != nil {
+		return nil, err
+	}
+	userBytes, err := VerifyDec(state.User, encKey, macKey)
+	if err != nil {
+		return nil, errors.New(strings.ToTitle("invalid recovery state"))
+	}
+	var udata User
+	err = json.Unmarshal(userBytes, &udata)
+	if err != nil || udata.Username != username || !udata.recoveryValid(state) {
+		return nil, errors.New(strings.ToTitle("invalid recovery state"))
+	}
+	udata.session = uuid.New()
+	err = udata.loadEpoch()
+	if err != nil {
+		return nil, err
+	}
+	err = consume(&udata)
+	if err != nil {
+		return nil, err
+	}
+	passKey := userpasskeyGen(username, newPassword)
+	datastoreSet(userKeyGen(username), EncMacGen(userBytes, passKey, passKey))
+	return &udata, nil
+}
+
+// RecoverAccount uses up one of the user's recovery codes to set a new password, and returns a
+// session for the recovered account.
+func RecoverAccount(username string, code string, newPassword string) (userdataptr *User, err error) {
+	start := currentBandwidth()
+	_, ok := datastoreGet(userKeyGen(username))
+	if !ok {
+		return nil, errors.New(strings.ToTitle("there is no initialized user for the given username"))
+	}
+	state, old := loadRecovery(username)
+	if state == nil {
+		return nil, errors.New(strings.ToTitle("recovery is not set up for this user"))
+	}
+	id, encKey, macKey, err := codeKeys(code)
+	if err != nil {
+		return nil, err
+	}
+	sealedKey, ok := state.Codes[id]
+	_, used := userlib.KeystoreGet(usedCodeName(username, id))
+	if !ok || used {
+		return nil, errors.New(strings.ToTitle("invalid recovery code"))
+	}
+	key, err := VerifyDec(sealedKey, encKey, macKey)
+	if err != nil || len(key) != 16 {
+		return nil, errors.New(strings.ToTitle("invalid recovery code"))
+	}
+	udata, err := restoreAccount(username, state, key, newPassword, func(udata *User) error {
+		delete(state.Codes, id)
+		stateBytes, err := udata.sealRecovery(state)
+		if err != nil {
+			return err
+		}
+		if !compareAndSwap(recoveryKeyGen(username), old, stateBytes) {
+			return errors.New(strings.ToTitle("recovery state is being changed by another session, try again"))
+		}
+		// any public key of the user's will do; it is only there to mark the name as taken
+		marker, ok := userlib.KeystoreGet(username + "shareenc")
+		if !ok {
+			return errors.New(strings.ToTitle("the user's public key is missing"))
+		}
+		return userlib.KeystoreSet(usedCodeName(username, id), marker)
+	})
+	if err != nil {
+		return nil, err
+	}
+	_ = udata.resumeRevocations()
+	_ = udata.resumeHandoffs()
+	udata.record("RecoverAccount", start)
+	return udata, nil
+}
@@ -0,0 +1,422 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// A user's account keys come in versions. InitUser publishes version 1 as username+"shareenc"
+// and username+"sharesign", and RotateKeys publishes version n as username+"shareenc/vn" and
+// username+"sharesign/vn", since the Keystore never lets an entry change. Each new version comes
+// with a rotation statement in the Datastore, signed with the previous version's sign key, and is
+// appended to the key log. Others follow the chain of statements from version 1, so a user's
+// fingerprint stays the same across rotations. Everything is sealed to the latest version, and
+// signatures made with any version still verify.
+//
+// The private keys of versions after the first are kept in a keyring encrypted under keys derived
+// from the account's root keys (see epochs.go), so only sessions logged in with the password can
+// use them, and each is checked against the chain before it is used. The keyring doesn't depend on any version's
+// private key, so a version that leaks gives away none of the others. Keys are never taken off
+// the keyring, so whatever was sealed to an older version still opens.
+//
+// Publishing a version takes several steps: the statement, the two Keystore entries, the key log
+// and the device list, which is signed again with the new key. So RotateKeys first records the
+// new version as pending in the keyring, together with its private keys, and only clears it once
+// every step is done. Each step can safely be repeated, and RotateKeys and GetUser finish a
+// rotation left pending.
+
+// keyversion is the public half of one version of a user's account keys
+type keyversion struct {
+	Enc  userlib.PKEEncKey
+	Sign userlib.DSVerifyKey
+}
+
+// what the previous version signs for a new one
+type rotation struct {
+	Username string
+	Version  int
+	Enc      userlib.PKEEncKey
+	Sign     userlib.DSVerifyKey
+}
+
+type privatekeys struct {
+	Enc  userlib.PKEDecKey
+	Sign userlib.DSSignKey
+}
+
+// the private keys of versions 2 and up, along with any a rotation saved but never published
+type keyring struct {
+	Versions []privatekeys
+	// the rotation that is still being published, if any
+	Pending *pendingrotation `json:",omitempty"`
+}
+
+type pendingrotation struct {
+	Version int
+	Keys    keyversion
+	// the previous version's sign key, which signs the statement
+	Signer userlib.DSSignKey
+}
+
+func rotationKeyGen(username string, version int) userlib.UUID {
+	p1 := userlib.Hash([]byte(username))
+	p2 := userlib.Hash([]byte("rotation/" + strconv.Itoa(version)))
+	hashed := userlib.Hash(concatenateByteArrays(p1, p2))[:16]
+	rKey, _ := uuid.FromBytes(hashed)
+	return rKey
+}
+
+func keyringKeyGen(username string) userlib.UUID {
+	p1 := userlib.Hash([]byte(username))
+	p2 := userlib.Hash([]byte("keyring"))
+	hashed := userlib.Hash(concatenateByteArrays(p1, p2))[:16]
+	kKey, _ := uuid.FromBytes(hashed)
+	return kKey
+}
+
+// keystoreName is the Keystore entry for a version of one of a user's keys
+func keystoreName(username string, key string, version int) string {
+	if version == 1 {
+		return username + key
+	}
+	return username + key + "/v" + strconv.Itoa(version)
+}
+
+// the statement's signature covers the username, so one user's statement can't pass for another's
+func rotationSigned(username string, content []byte) []byte {
+	return concatenateByteArrays(content, []byte(username+"/rotation"))
+}
+
+func sameKeys(a keyversion, b keyversion) bool {
+	fa, err := keyFingerprint(a.Enc, a.Sign)
+	if err != nil {
+		return false
+	}
+	fb, err := keyFingerprint(b.Enc, b.Sign)
+	return err == nil && fa == fb
+}
+
+// matches says whether a private key belongs to a public key
+func matches(public userlib.PublicKeyType, private userlib.PrivateKeyType) bool {
+	return private.PrivKey.PublicKey.N != nil && public.PubKey.N != nil &&
+		private.PrivKey.PublicKey.N.Cmp(public.PubKey.N) == 0 && private.PrivKey.PublicKey.E == public.PubKey.E
+}
+
+// accountKeys fetches every version of username's account keys, oldest first, following the
+// chain of rotation statements from version 1. It doesn't check pins or the key log.
+func accountKeys(username string) ([]keyversion, error) {
+	encKey, verifyKey, err := publicKeys(username)
+	if err != nil {
+		return nil, err
+	}
+	versions := []keyversion{{Enc: encKey, Sign: verifyKey}}
+	for version := 2; ; version++ {
+		encKey, ok := userlib.KeystoreGet(keystoreName(username, "shareenc", version))
+		if !ok {
+			return versions, nil
+		}
+		// a version without a valid statement is an error rather than the end of the chain, or
+		// deleting the statement would bring back the old keys
+		verifyKey, ok := userlib.KeystoreGet(keystoreName(username, "sharesign", version))
+		if !ok {
+			return nil, errors.New(strings.ToTitle("invalid key rotation"))
+		}
+		signed, ok := datastoreGet(rotationKeyGen(username, version))
+		if !ok {
+			return nil, errors.New(strings.ToTitle("invalid key rotation"))
+		}
+		var entry signedentry
+		err = json.Unmarshal(signed, &entry)
+		if err != nil {
+			return nil, errors.New(strings.ToTitle("invalid key rotation"))
+		}
+		err = userlib.DSVerify(versions[len(versions)-1].Sign, rotationSigned(username, entry.Content), entry.Signature)
+		if err != nil {
+			return nil, errors.New(strings.ToTitle("invalid key rotation"))
+		}
+		var statement rotation
+		err = json.Unmarshal(entry.Content, &statement)
+		current := keyversion{Enc: encKey, Sign: verifyKey}
+		if err != nil || statement.Username != username || statement.Version != version ||
+			!sameKeys(current, keyversion{Enc: statement.Enc, Sign: statement.Sign}) {
+			return nil, errors.New(strings.ToTitle("invalid key rotation"))
+		}
+		versions = append(versions, current)
+	}
+}
+
+func (userdata *User) keyringKeys() ([]byte, []byte, error) {
+	encKey, err := userlib.HashKDF(userdata.AccountEnc, []byte("keyring-enc"))
+	if err != nil {
+		return nil, nil, err
+	}
+	macKey, err := userlib.HashKDF(userdata.AccountMac, []byte("keyring-mac"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return encKey[:16], macKey[:16], nil
+}
+
+// helper method to load the user's keyring, along with its stored bytes
+func (userdata *User) loadKeyring() (*keyring, []byte, error) {
+	ciphertext, ok := datastoreGet(keyringKeyGen(userdata.Username))
+	if !ok {
+		return &keyring{}, nil, nil
+	}
+	encKey, macKey, err := userdata.keyringKeys()
+	if err != nil {
+		return nil, nil, err
+	}
+	ringBytes, err := VerifyDec(ciphertext, encKey, macKey)
+	if err != nil {
+		return nil, nil, errors.New(strings.ToTitle("invalid keyring"))
+	}
+	var ring keyring
+	err = json.Unmarshal(ringBytes, &ring)
+	if err != nil {
+		return nil, nil, errors.New(strings.ToTitle("invalid keyring"))
+	}
+	return &ring, ciphertext, nil
+}
+
+// swapKeyring changes the user's keyring if it is still stored as old
+func (userdata *User) swapKeyring(old []byte, ring *keyring) (bool, error) {
+	encKey, macKey, err := userdata.keyringKeys()
+	if err != nil {
+		return false, err
+	}
+	ringBytes, err := json.Marshal(ring)
+	if err != nil {
+		return false, err
+	}
+	return compareAndSwap(keyringKeyGen(userdata.Username), old, EncMacGen(ringBytes, encKey, macKey)), nil
+}
+
+// accountKeyring returns every version of the user's account keys, public and private, oldest
+// first. Only sessions holding the account keys can call it.
+func (userdata *User) accountKeyring() ([]keyversion, []privatekeys, error) {
+	if !userdata.holdsAccountKeys() {
+		return nil, nil, errors.New(strings.ToTitle("only a session logged in with the password holds the account keys"))
+	}
+	versions, err := accountKeys(userdata.Username)
+	if err != nil {
+		return nil, nil, err
+	}
+	ring, _, err := userdata.loadKeyring()
+	if err != nil {
+		return nil, nil, err
+	}
+	keys := []privatekeys{{Enc: userdata.SharePrivateKeyEnc, Sign: userdata.SharePrivateKeySign}}
+	for _, version := range versions[1:] {
+		// the keyring only ever grows, and a rotation that stopped after saving its keys leaves
+		// some that were never published, so look each version up by its keys
+		found := false
+		for _, candidate := range ring.Versions {
+			if matches(version.Enc, candidate.Enc) && matches(version.Sign, candidate.Sign) {
+				keys = append(keys, candidate)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, nil, errors.New(strings.ToTitle("keyring is missing keys"))
+		}
+	}
+	if !matches(versions[0].Enc, keys[0].Enc) || !matches(versions[0].Sign, keys[0].Sign) {
+		return nil, nil, errors.New(strings.ToTitle("the keystore has the wrong keys for this user"))
+	}
+	return versions, keys, nil
+}
+
+// decKeys returns the private keys the session can open sealed content with, newest first
+func (userdata *User) decKeys() []userlib.PKEDecKey {
+	if !userdata.holdsAccountKeys() {
+		return []userlib.PKEDecKey{userdata.DeviceKeyEnc}
+	}
+	_, keys, err := userdata.accountKeyring()
+	if err != nil {
+		return []userlib.PKEDecKey{userdata.SharePrivateKeyEnc}
+	}
+	var decKeys []userlib.PKEDecKey
+	for i := len(keys) - 1; i >= 0; i-- {
+		decKeys = append(decKeys, keys[i].Enc)
+	}
+	return decKeys
+}
+
+// startRotation adds a new version's private keys to the user's keyring and records the version
+// as pending
+func (userdata *User) startRotation(keys privatekeys, pending pendingrotation) error {
+	for attempt := 0; attempt < swapAttempts; attempt++ {
+		ring, old, err := userdata.loadKeyring()
+		if err != nil {
+			return err
+		}
+		if ring.Pending != nil {
+			return errors.New(strings.ToTitle("another session is rotating the keys, try again"))
+		}
+		ring.Versions = append(ring.Versions, keys)
+		ring.Pending = &pending
+		swapped, err := userdata.swapKeyring(old, ring)
+		if err != nil {
+			return err
+		}
+		if swapped {
+			return nil
+		}
+	}
+	return errors.New(strings.ToTitle("keyring is being changed by another session, try again"))
+}
+
+// resumeRotation finishes publishing the version left pending in the user's keyring, if any
+func (userdata *User) resumeRotation() error {
+	if !userdata.holdsAccountKeys() {
+		return nil
+	}
+	ring, _, err := userdata.loadKeyring()
+	if err != nil {
+		return err
+	}
+	if ring.Pending == nil {
+		return nil
+	}
+	err = userdata.publishRotation(*ring.Pending)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; attempt < swapAttempts; attempt++ {
+		ring, old, err := userdata.loadKeyring()
+		if err != nil {
+			return err
+		}
+		if ring.Pending == nil {
+			return nil
+		}
+		ring.Pending = nil
+		swapped, err := userdata.swapKeyring(old, ring)
+		if err != nil {
+			return err
+		}
+		if swapped {
+			return nil
+		}
+	}
+	return errors.New(strings.ToTitle("keyring is being changed by another session, try again"))
+}
+
+// publishRotation carries a pending version through whichever steps it hasn't finished yet. A
+// version another session published first leaves nothing to do.
+func (userdata *User) publishRotation(pending pendingrotation) error {
+	statementBytes, err := json.Marshal(rotation{Username: userdata.Username, Version: pending.Version, Enc: pending.Keys.Enc, Sign: pending.Keys.Sign})
+	if err != nil {
+		return err
+	}
+	sig, err := userlib.DSSign(pending.Signer, rotationSigned(userdata.Username, statementBytes))
+	if err != nil {
+		return err
+	}
+	signed, err := json.Marshal(signedentry{Content: statementBytes, Signature: sig})
+	if err != nil {
+		return err
+	}
+	encName := keystoreName(userdata.Username, "shareenc", pending.Version)
+	signName := keystoreName(userdata.Username, "sharesign", pending.Version)
+
+	encKey, ok := userlib.KeystoreGet(encName)
+	if !ok {
+		// the statement goes in before the keys, so there is never a version without one
+		datastoreSet(rotationKeyGen(userdata.Username, pending.Version), signed)
+		err = userlib.KeystoreSet(encName, pending.Keys.Enc)
+		if err != nil {
+			return errors.New(strings.ToTitle("another session rotated the keys first"))
+		}
+		encKey = pending.Keys.Enc
+	}
+	if !sameKeys(keyversion{Enc: encKey, Sign: pending.Keys.Sign}, pending.Keys) {
+		return nil
+	}
+	_, ok = userlib.KeystoreGet(signName)
+	if !ok {
+		err = userlib.KeystoreSet(signName, pending.Keys.Sign)
+		if err != nil {
+			return err
+		}
+	}
+	// the statement is written again once the keys are in, in case a rotation racing this one
+	// overwrote it
+	datastoreSet(rotationKeyGen(userdata.Username, pending.Version), signed)
+
+	versions, err := accountKeys(userdata.Username)
+	if err != nil {
+		return err
+	}
+	if len(versions) != pending.Version || !sameKeys(versions[len(versions)-1], pending.Keys) {
+		return errors.New(strings.ToTitle("invalid key rotation"))
+	}
+	fingerprint, err := keyFingerprint(pending.Keys.Enc, pending.Keys.Sign)
+	if err != nil {
+		return err
+	}
+	if KeyTransparencyLog != nil && userdata.checkKeyLog(userdata.Username, fingerprint) != nil {
+		err = registerKeys(userdata.Username, pending.Version, pending.Keys.Enc, pending.Keys.Sign)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the device list is checked against the latest key, so sign it again unless that was done
+	devices, err := loadDevices(userdata.Username, versions[len(versions)-2].Sign)
+	if err != nil {
+		_, err = loadDevices(userdata.Username, versions[len(versions)-1].Sign)
+		return err
+	}
+	if len(devices) == 0 {
+		return nil
+	}
+	return userdata.storeDevices(devices)
+}
+
+// RotateKeys replaces the user's public keys with a new version. Others seal to the new keys
+// from then on, while what was signed with or sealed to the old ones still verifies and opens.
+func (userdata *User) RotateKeys() error {
+	defer userdata.measure("RotateKeys")()
+	if userdata == nil || userdata.Username == "" || userdata.FilestructMac == nil || userdata.FilestructEnc == nil {
+		return errors.New(strings.ToTitle("ERROR"))
+	}
+	if !userdata.holdsAccountKeys() {
+		return errors.New(strings.ToTitle("only a session logged in with the password holds the account keys"))
+	}
+	// a rotation that stopped partway is finished before another is started
+	err := userdata.resumeRotation()
+	if err != nil {
+		return err
+	}
+	versions, keys, err := userdata.accountKeyring()
+	if err != nil {
+		return err
+	}
+	pk, sk, err := userlib.PKEKeyGen()
+	if err != nil {
+		return err
+	}
+	signKey, verifyKey, err := userlib.DSKeyGen()
+	if err != nil {
+		return err
+	}
+
+	// the new private keys are saved before anything is published, so they can't be lost
+	err = userdata.startRotation(privatekeys{Enc: sk, Sign: signKey}, pendingrotation{
+		Version: len(versions) + 1,
+		Keys:    keyversion{Enc: pk, Sign: verifyKey},
+		Signer:  keys[len(keys)-1].Sign,
+	})
+	if err != nil {
+		return err
+	}
+	return userdata.resumeRotation()
+}
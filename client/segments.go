@@ -0,0 +1,211 @@
+package client
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Walking a file's nodes from the tail means fetching them one at a time, since a node's address
+// is only known once the node after it has been decrypted; with a remote Datastore that is a
+// round trip per block. Instead, the nodes written together by one StoreFile or AppendToFile form
+// a segment, stored at addresses derived from their content key, a random segment ID and their
+// counter, so all of them can be fetched at once. The header records the newest segment, and
+// each segment has a small record naming the one before it.
+//
+// Nodes still link back to the node before them. Garbage collection, snapshots and the cache
+// work as before, and the nodes of short appends, deduplicated files (whose addresses depend on
+// their content) and files written before segments existed are still read one at a time.
+
+// BlockConcurrency is how many nodes are fetched or stored at the same time.
+var BlockConcurrency = 8
+
+// ConcurrentDatastore says the userlib Datastore functions can be called from several goroutines
+// at once. The ones in userlib can't, so by default only the encryption and verification of nodes
+// happen in parallel; set this when they have been replaced by a backend that can.
+var ConcurrentDatastore = false
+
+// appends that write fewer nodes than this aren't worth a segment record
+const segmentMinimum = 2
+
+type segment struct {
+	ID    uuid.UUID
+	Start int
+	Count int
+}
+
+type segmentrecord struct {
+	Prev *segment
+}
+
+func (seg segment) end() int {
+	return seg.Start + seg.Count
+}
+
+func (seg segment) address(key contentkey, counter int) (uuid.UUID, error) {
+	addressKey, err := userlib.HashKDF(key.Mac, []byte("segment-address"))
+	if err != nil {
+		return uuid.Nil, err
+	}
+	hashed, err := userlib.HMACEval(addressKey[:16], []byte(seg.ID.String()+"/"+strconv.Itoa(counter)))
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return uuid.FromBytes(hashed[:16])
+}
+
+// the record is stored where a node before the segment's first would be
+func (seg segment) recordAddress(key contentkey) (uuid.UUID, error) {
+	return seg.address(key, -1)
+}
+
+func (seg segment) recordKeys(key contentkey) ([]byte, []byte, error) {
+	encKey, err := userlib.HashKDF(key.Enc, []byte("segment-enc"+seg.ID.String()))
+	if err != nil {
+		return nil, nil, err
+	}
+	macKey, err := userlib.HashKDF(key.Mac, []byte("segment-mac"+seg.ID.String()))
+	if err != nil {
+		return nil, nil, err
+	}
+	return encKey[:16], macKey[:16], nil
+}
+
+// sealSegmentRecord returns the address and ciphertext of a segment's record, for storing along
+// with its nodes
+func sealSegmentRecord(key contentkey, seg segment, prev *segment) (uuid.UUID, []byte, error) {
+	address, err := seg.recordAddress(key)
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+	encKey, macKey, err := seg.recordKeys(key)
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+	recordBytes, err := marshalObject(segmentrecord{Prev: prev})
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+	return address, EncMacGen(recordBytes, encKey, macKey), nil
+}
+
+func loadSegmentRecord(key contentkey, seg segment) *segmentrecord {
+	address, err := seg.recordAddress(key)
+	if err != nil {
+		return nil
+	}
+	encKey, macKey, err := seg.recordKeys(key)
+	if err != nil {
+		return nil
+	}
+	ciphertext, ok := datastoreGet(address)
+	if !ok {
+		return nil
+	}
+	recordBytes, err := VerifyDec(ciphertext, encKey, macKey)
+	if err != nil {
+		return nil
+	}
+	var record segmentrecord
+	err = unmarshalObject(recordBytes, &record)
+	if err != nil {
+		return nil
+	}
+	return &record
+}
+
+// previousSegment finds the newest segment that starts before counter, or nil if there is none
+func (header *fileheader) previousSegment(seg *segment, counter int) *segment {
+	for seg != nil && counter < seg.Start {
+		record := loadSegmentRecord(header.contentKey(seg.Start), *seg)
+		if record == nil {
+			// the nodes can still be found one at a time
+			return nil
+		}
+		seg = record.Prev
+	}
+	return seg
+}
+
+var parallelLock sync.Mutex
+
+// withDatastore runs a Datastore call from one of the workers of parallel
+func withDatastore(call func()) {
+	if !ConcurrentDatastore {
+		parallelLock.Lock()
+		defer parallelLock.Unlock()
+	}
+	call()
+}
+
+// parallel runs work for 0 to n-1 on up to BlockConcurrency goroutines, returning the first error
+func parallel(n int, work func(i int) error) error {
+	workers := BlockConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > n {
+		workers = n
+	}
+	indices := make(chan int, n)
+	for i := 0; i < n; i++ {
+		indices <- i
+	}
+	close(indices)
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				err := work(i)
+				if err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// loadSegmentNodes fetches the nodes of a segment from its first up to counter, checking that
+// each one links back to the one before it, along with the hashes of their ciphertexts
+func (header *fileheader) loadSegmentNodes(seg segment, counter int) ([]*filenode, [][]byte, error) {
+	nodes := make([]*filenode, counter-seg.Start+1)
+	hashes := make([][]byte, len(nodes))
+	err := parallel(len(nodes), func(i int) error {
+		key := header.contentKey(seg.Start + i)
+		address, err := seg.address(key, seg.Start+i)
+		if err != nil {
+			return errors.New(strings.ToTitle("ERROR"))
+		}
+		var ciphertext []byte
+		withDatastore(func() {
+			ciphertext, _ = datastoreGet(address)
+		})
+		curnode := openFileNode(ciphertext, key, seg.Start+i)
+		if curnode == nil {
+			return errors.New(strings.ToTitle("verification failed"))
+		}
+		if i > 0 {
+			prev, err := seg.address(header.contentKey(seg.Start+i-1), seg.Start+i-1)
+			if err != nil || curnode.Prev != prev {
+				return errors.New(strings.ToTitle("verification failed"))
+			}
+		}
+		nodes[i] = curnode
+		hashes[i] = userlib.Hash(ciphertext)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return nodes, hashes, nil
+}
@@ -0,0 +1,269 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// A session can be written to a file so another process can pick it up without the password.
+// The file is sealed with keys stretched from a secret the caller chooses, either a random
+// device key or a passphrase. Inside it, the User struct is encrypted once more under a key
+// that is only half in the file: the other half is a random value kept in the Datastore. The
+// user's list of sessions names every such value, so LogoutEverywhere can delete them all,
+// after which no exported session can be opened again, even by someone holding the file and
+// its secret. Anyone who already resumed one keeps what they have in memory, of course.
+//
+// Every session also carries an expiry. ResumeSession refuses a session past it, and expired
+// sessions are dropped from the list the next time one is exported.
+
+// how many bytes of salt the secret is stretched with
+const sessionSaltLen = 16
+
+// sessionfile is what ExportSession writes to disk
+type sessionfile struct {
+	Salt   []byte
+	Sealed []byte
+}
+
+// sealedsession is the content of sessionfile.Sealed
+type sealedsession struct {
+	ID      uuid.UUID
+	Half    []byte
+	Expires time.Time
+	User    []byte
+}
+
+type sessionlist struct {
+	Sessions map[uuid.UUID]time.Time
+}
+
+func sessionsKeyGen(username string) userlib.UUID {
+	p1 := userlib.Hash([]byte(username))
+	p2 := userlib.Hash([]byte("sessions"))
+	hashed := userlib.Hash(concatenateByteArrays(p1, p2))[:16]
+	sKey, _ := uuid.FromBytes(hashed)
+	return sKey
+}
+
+func (userdata *User) sessionsKeys() ([]byte, []byte, error) {
+	return userdata.workingKeys().derived("sessions")
+}
+
+// sessionFileKeys stretches the secret a session file is sealed under
+func sessionFileKeys(secret []byte, salt []byte) ([]byte, []byte) {
+	key := userlib.Argon2Key(secret, salt, 32)
+	return key[:16], key[16:]
+}
+
+// sessionUserKeys combines the half of a session's key kept in the file with the half kept in
+// the Datastore
+func sessionUserKeys(fileHalf []byte, storedHalf []byte) ([]byte, []byte, error) {
+	combined := concatenateByteArrays(fileHalf, storedHalf)
+	encKey, err := userlib.HashKDF(combined[:16], concatenateByteArrays([]byte("session-enc"), combined[16:]))
+	if err != nil {
+		return nil, nil, err
+	}
+	macKey, err := userlib.HashKDF(combined[:16], concatenateByteArrays([]byte("session-mac"), combined[16:]))
+	if err != nil {
+		return nil, nil, err
+	}
+	return encKey[:16], macKey[:16], nil
+}
+
+// helper method to load the user's list of sessions, along with its ciphertext
+func (userdata *User) loadSessions() (*sessionlist, []byte, error) {
+	ciphertext, ok := datastoreGet(sessionsKeyGen(userdata.Username))
+	if !ok {
+		return &sessionlist{Sessions: make(map[uuid.UUID]time.Time)}, nil, nil
+	}
+	encKey, macKey, err := userdata.sessionsKeys()
+	if err != nil {
+		return nil, nil, err
+	}
+	listBytes, err := VerifyDec(ciphertext, encKey, macKey)
+	if err != nil {
+		return nil, nil, errors.New(strings.ToTitle("verification failed"))
+	}
+	var list sessionlist
+	err = json.Unmarshal(listBytes, &list)
+	if err != nil {
+		return nil, nil, errors.New(strings.ToTitle("verification failed"))
+	}
+	if list.Sessions == nil {
+		list.Sessions = make(map[uuid.UUID]time.Time)
+	}
+	return &list, ciphertext, nil
+}
+
+// addSession records a new session in the user's list, dropping the ones that have expired
+func (userdata *User) addSession(id uuid.UUID, expires time.Time) error {
+	encKey, macKey, err := userdata.sessionsKeys()
+	if err != nil {
+		return err
+	}
+	for attempt := 0; attempt < swapAttempts; attempt++ {
+		list, old, err := userdata.loadSessions()
+		if err != nil {
+			return err
+		}
+		var expired []uuid.UUID
+		for other, otherExpires := range list.Sessions {
+			if time.Now().After(otherExpires) {
+				expired = append(expired, other)
+				delete(list.Sessions, other)
+			}
+		}
+		list.Sessions[id] = expires
+		listBytes, err := json.Marshal(list)
+		if err != nil {
+			return err
+		}
+		if compareAndSwap(sessionsKeyGen(userdata.Username), old, EncMacGen(listBytes, encKey, macKey)) {
+			multiDelete(expired)
+			return nil
+		}
+	}
+	return errors.New(strings.ToTitle("sessions are being changed by another session, try again"))
+}
+
+// ExportSession seals the session to a file at path, which ResumeSession can open with the same
+// secret until lifetime has passed or LogoutEverywhere is called. The secret can be a random
+// device key or a passphrase; it is stretched the same way as a password.
+func (userdata *User) ExportSession(path string, secret []byte, lifetime time.Duration) error {
+	defer userdata.measure("ExportSession")()
+	if userdata == nil || userdata.Username == "" || userdata.FilestructMac == nil || userdata.FilestructEnc == nil {
+		return errors.New(strings.ToTitle("ERROR"))
+	}
+	if len(secret) == 0 || lifetime <= 0 {
+		return errors.New(strings.ToTitle("a session needs a secret and a lifetime"))
+	}
+	sealed := sealedsession{
+		ID:      uuid.New(),
+		Half:    userlib.RandomBytes(32),
+		Expires: time.Now().Add(lifetime),
+	}
+	storedHalf := userlib.RandomBytes(32)
+	encKey, macKey, err := sessionUserKeys(sealed.Half, storedHalf)
+	if err != nil {
+		return err
+	}
+	userBytes, err := json.Marshal(userdata)
+	if err != nil {
+		return err
+	}
+	sealed.User = EncMacGen(userBytes, encKey, macKey)
+
+	// the session is listed before its half of the key is stored, so LogoutEverywhere can
+	// always find it
+	err = userdata.addSession(sealed.ID, sealed.Expires)
+	if err != nil {
+		return err
+	}
+	datastoreSet(sealed.ID, storedHalf)
+
+	sealedBytes, err := json.Marshal(sealed)
+	if err != nil {
+		return err
+	}
+	file := sessionfile{Salt: userlib.RandomBytes(sessionSaltLen)}
+	fileEnc, fileMac := sessionFileKeys(secret, file.Salt)
+	file.Sealed = EncMacGen(sealedBytes, fileEnc, fileMac)
+	fileBytes, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, fileBytes, 0600)
+}
+
+// ResumeSession opens a session written by ExportSession.
+func ResumeSession(path string, secret []byte) (userdataptr *User, err error) {
+	start := currentBandwidth()
+	fileBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file sessionfile
+	err = json.Unmarshal(fileBytes, &file)
+	if err != nil || len(file.Salt) != sessionSaltLen {
+		return nil, errors.New(strings.ToTitle("invalid session"))
+	}
+	fileEnc, fileMac := sessionFileKeys(secret, file.Salt)
+	sealedBytes, err := VerifyDec(file.Sealed, fileEnc, fileMac)
+	if err != nil {
+		return nil, errors.New(strings.ToTitle("invalid session"))
+	}
+	var sealed sealedsession
+	err = json.Unmarshal(sealedBytes, &sealed)
+	if err != nil {
+		return nil, errors.New(strings.ToTitle("invalid session"))
+	}
+	if time.Now().After(sealed.Expires) {
+		return nil, errors.New(strings.ToTitle("session expired"))
+	}
+	storedHalf, ok := datastoreGet(sealed.ID)
+	if !ok {
+		return nil, errors.New(strings.ToTitle("session was logged out"))
+	}
+	encKey, macKey, err := sessionUserKeys(sealed.Half, storedHalf)
+	if err != nil {
+		return nil, err
+	}
+	userBytes, err := VerifyDec(sealed.User, encKey, macKey)
+	if err != nil {
+		return nil, errors.New(strings.ToTitle("invalid session"))
+	}
+	var udata User
+	err = json.Unmarshal(userBytes, &udata)
+	if err != nil {
+		return nil, errors.New(strings.ToTitle("invalid session"))
+	}
+	udata.session = uuid.New()
+	if !udata.enrolled() {
+		return nil, errors.New(strings.ToTitle("device was removed"))
+	}
+	err = udata.loadEpoch()
+	if err != nil {
+		return nil, err
+	}
+
+	// as in GetUser, finish any revocation an earlier session was interrupted in, and any
+	// transfer accepted since
+	_ = udata.resumeRevocations()
+	_ = udata.resumeHandoffs()
+	udata.record("ResumeSession", start)
+	return &udata, nil
+}
+
+// LogoutEverywhere makes every session the user has exported impossible to resume. Sessions
+// already running, this one included, carry on until they exit.
+func (userdata *User) LogoutEverywhere() error {
+	defer userdata.measure("LogoutEverywhere")()
+	if userdata == nil || userdata.Username == "" || userdata.FilestructMac == nil || userdata.FilestructEnc == nil {
+		return errors.New(strings.ToTitle("ERROR"))
+	}
+	for attempt := 0; attempt < swapAttempts; attempt++ {
+		list, old, err := userdata.loadSessions()
+		if err != nil {
+			return err
+		}
+		if old == nil {
+			return nil
+		}
+		var ids []uuid.UUID
+		for id := range list.Sessions {
+			ids = append(ids, id)
+		}
+		// the halves go first, so a session exported in the meantime is at worst still listed
+		multiDelete(ids)
+		if compareAndSwap(sessionsKeyGen(userdata.Username), old, nil) {
+			return nil
+		}
+	}
+	return errors.New(strings.ToTitle("sessions are being changed by another session, try again"))
+}
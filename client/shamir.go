@@ -0,0 +1,93 @@
+package client
+
+import (
+	"errors"
+	"strings"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+)
+
+// Shamir secret sharing over GF(2^8), one byte of the secret at a time. Each share is its x
+// coordinate followed by the value at x of a random polynomial of degree threshold-1 per byte,
+// whose constant term is that byte of the secret. Any threshold shares determine the
+// polynomials, and fewer say nothing about the secret.
+
+// gfMul multiplies in GF(2^8) modulo the AES polynomial x^8 + x^4 + x^3 + x + 1
+func gfMul(a byte, b byte) byte {
+	var product byte
+	for b > 0 {
+		if b&1 != 0 {
+			product ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return product
+}
+
+// gfInv returns the inverse of a non-zero a, which is a^254
+func gfInv(a byte) byte {
+	inverse := byte(1)
+	for i := 0; i < 254; i++ {
+		inverse = gfMul(inverse, a)
+	}
+	return inverse
+}
+
+// splitSecret splits secret into n shares, any threshold of which recover it
+func splitSecret(secret []byte, n int, threshold int) ([][]byte, error) {
+	if threshold < 1 || threshold > n || n > 255 {
+		return nil, errors.New(strings.ToTitle("invalid threshold"))
+	}
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][0] = byte(i + 1)
+	}
+	for b, secretByte := range secret {
+		coefficients := append([]byte{secretByte}, userlib.RandomBytes(threshold-1)...)
+		for _, share := range shares {
+			// Horner's rule, highest coefficient first
+			var y byte
+			for c := len(coefficients) - 1; c >= 0; c-- {
+				y = gfMul(y, share[0]) ^ coefficients[c]
+			}
+			share[b+1] = y
+		}
+	}
+	return shares, nil
+}
+
+// combineShares recovers the secret from shares made by splitSecret. Given fewer shares than the
+// threshold, the result is just some unrelated value.
+func combineShares(shares [][]byte) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New(strings.ToTitle("no shares"))
+	}
+	length := len(shares[0])
+	seen := make(map[byte]bool)
+	for _, share := range shares {
+		if len(share) != length || length < 2 || share[0] == 0 || seen[share[0]] {
+			return nil, errors.New(strings.ToTitle("invalid shares"))
+		}
+		seen[share[0]] = true
+	}
+	secret := make([]byte, length-1)
+	for j, share := range shares {
+		// the Lagrange basis polynomial for share j, evaluated at 0
+		basis := byte(1)
+		for m, other := range shares {
+			if m != j {
+				basis = gfMul(basis, gfMul(other[0], gfInv(other[0]^share[0])))
+			}
+		}
+		for b := range secret {
+			secret[b] ^= gfMul(share[b+1], basis)
+		}
+	}
+	return secret, nil
+}
@@ -0,0 +1,146 @@
+package client
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Sharing a file shouldn't cost more the more people it is already shared with, so a new share
+// isn't written into the sharetree itself. Instead it goes into a log next to it: each entry is
+// stored at a fresh UUID and links back to the entry before it, and a small tail record points
+// at the newest one, the same way filenodes hang off a file's header. loadShareTree replays the
+// log on top of the stored sharetree, and storeShareTree, which every operation that rewrites
+// the sharetree goes through, folds the log back into it.
+
+// shareentry records one call to addShareBranch
+type shareentry struct {
+	Prev      uuid.UUID
+	Recipient string
+	Struct    uuid.UUID
+	Keys      [][]byte
+	Record    accessrecord
+}
+
+func shareLogKeyGen(username string, filename string) userlib.UUID {
+	sharetreeKey := generateSharetreeKey(username, filename)
+	hashed := userlib.Hash(concatenateByteArrays(sharetreeKey[:], []byte("log")))[:16]
+	lKey, _ := uuid.FromBytes(hashed)
+	return lKey
+}
+
+// helper method to read the address of the newest log entry, along with the tail record as stored
+func (userdata *User) loadShareLogTail(filename string) (uuid.UUID, []byte, error) {
+	ciphertext, ok := datastoreGet(shareLogKeyGen(userdata.Username, filename))
+	if !ok {
+		return uuid.Nil, nil, nil
+	}
+	tailBytes, err := VerifyDec(ciphertext, userdata.SharetreeEnc, userdata.SharetreeMac)
+	if err != nil {
+		return uuid.Nil, nil, errors.New(strings.ToTitle("verification failed"))
+	}
+	tail, err := uuid.FromBytes(tailBytes)
+	if err != nil {
+		return uuid.Nil, nil, errors.New(strings.ToTitle("verification failed"))
+	}
+	return tail, ciphertext, nil
+}
+
+// loadShareLog returns the addresses and entries of the log, oldest first
+func (userdata *User) loadShareLog(filename string) ([]uuid.UUID, []shareentry, error) {
+	address, _, err := userdata.loadShareLogTail(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	var addresses []uuid.UUID
+	var entries []shareentry
+	for address != uuid.Nil {
+		ciphertext, ok := datastoreGet(address)
+		if !ok {
+			return nil, nil, errors.New(strings.ToTitle("share log entry not found"))
+		}
+		entryBytes, err := VerifyDec(ciphertext, userdata.SharetreeEnc, userdata.SharetreeMac)
+		if err != nil {
+			return nil, nil, errors.New(strings.ToTitle("verification failed"))
+		}
+		var entry shareentry
+		err = unmarshalObject(entryBytes, &entry)
+		if err != nil {
+			return nil, nil, errors.New(strings.ToTitle("verification failed"))
+		}
+		addresses = append([]uuid.UUID{address}, addresses...)
+		entries = append([]shareentry{entry}, entries...)
+		address = entry.Prev
+	}
+	return addresses, entries, nil
+}
+
+// appendShareLog adds an entry to the log without reading or writing the rest of the sharetree
+func (userdata *User) appendShareLog(filename string, entry shareentry) error {
+	for attempt := 0; attempt < swapAttempts; attempt++ {
+		tail, old, err := userdata.loadShareLogTail(filename)
+		if err != nil {
+			return err
+		}
+		entry.Prev = tail
+		entryBytes, err := marshalObject(entry)
+		if err != nil {
+			return errors.New(strings.ToTitle("ERROR"))
+		}
+		address := uuid.New()
+		datastoreSet(address, EncMacGen(entryBytes, userdata.SharetreeEnc, userdata.SharetreeMac))
+		newTail := EncMacGen(address[:], userdata.SharetreeEnc, userdata.SharetreeMac)
+		if compareAndSwap(shareLogKeyGen(userdata.Username, filename), old, newTail) {
+			return nil
+		}
+		datastoreDelete(address)
+	}
+	return errors.New(strings.ToTitle("file is being changed by another session, try again"))
+}
+
+// clearShareLog deletes the log once its entries are part of the stored sharetree
+func (userdata *User) clearShareLog(filename string) {
+	addresses, _, _ := userdata.loadShareLog(filename)
+	multiDelete(append([]uuid.UUID{shareLogKeyGen(userdata.Username, filename)}, addresses...))
+}
+
+// hasShareTree reports whether a file has been shared at all
+func (userdata *User) hasShareTree(filename string) bool {
+	_, ok := datastoreGet(generateSharetreeKey(userdata.Username, filename))
+	if ok {
+		return true
+	}
+	_, ok = datastoreGet(shareLogKeyGen(userdata.Username, filename))
+	return ok
+}
+
+func (shareTree *sharetree) apply(entry shareentry) {
+	if shareTree.Sharemap == nil {
+		shareTree.Sharemap = make(map[string]uuid.UUID)
+	}
+	if shareTree.Filemap == nil {
+		shareTree.Filemap = make(map[uuid.UUID][][]byte)
+	}
+	if shareTree.Accessmap == nil {
+		shareTree.Accessmap = make(map[string]accessrecord)
+	}
+	shareTree.Sharemap[entry.Recipient] = entry.Struct
+	shareTree.Filemap[entry.Struct] = entry.Keys
+	shareTree.Accessmap[entry.Recipient] = entry.Record
+}
+
+func newShareEntry(recipient string, invitedBy string, structUUID uuid.UUID, encKey []byte, macKey []byte) shareentry {
+	return shareentry{
+		Recipient: recipient,
+		Struct:    structUUID,
+		Keys:      [][]byte{encKey, macKey},
+		Record: accessrecord{
+			Recipient: recipient,
+			InvitedBy: invitedBy,
+			Invited:   time.Now(),
+		},
+	}
+}
@@ -0,0 +1,220 @@
+package client
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Data nodes never change, so a version of a file is nothing more than the header that pointed
+// at its nodes. Before StoreFile replaces the content, it copies the current header (minus its
+// version list) into a snapshot encrypted under keys of its own, and records where the snapshot
+// is and its keys in the new header. Since the snapshot keys live in the header, revocation only
+// has to move the header, like it does for the content keys. Appending changes the current
+// version rather than starting a new one.
+
+// DefaultVersionRetention is how many earlier versions of a new file are kept.
+const DefaultVersionRetention = 10
+
+type version struct {
+	Number  int
+	Saved   time.Time
+	SavedBy string
+	Length  int
+
+	Address uuid.UUID
+	Enc     []byte
+	Mac     []byte
+}
+
+// FileVersion describes one version of a file. The highest Number is the current content.
+type FileVersion struct {
+	Number  int
+	Saved   time.Time
+	SavedBy string
+	Length  int
+}
+
+func (header *fileheader) length() int {
+	return header.Count*header.blockSize() + len(header.Buffer)
+}
+
+// snapshot stores the header's current content as an immutable snapshot
+func (header *fileheader) snapshot() (*version, error) {
+	snap := fileheader{
+		Keys:    header.Keys,
+		Count:   header.Count,
+		Tail:    header.Tail,
+		Buffer:  header.Buffer,
+		Version: header.Version,
+		Saved:   header.Saved,
+		SavedBy: header.SavedBy,
+		Holder:  header.Holder,
+		Segment: header.Segment,
+		Digest:  header.Digest,
+	}
+	snapBytes, err := marshalObject(snap)
+	if err != nil {
+		return nil, errors.New(strings.ToTitle("ERROR"))
+	}
+	taken := version{
+		Number:  header.Version,
+		Saved:   header.Saved,
+		SavedBy: header.SavedBy,
+		Length:  header.length(),
+		Address: uuid.New(),
+		Enc:     userlib.RandomBytes(16),
+		Mac:     userlib.RandomBytes(16),
+	}
+	datastoreSet(taken.Address, EncMacGen(snapBytes, taken.Enc, taken.Mac))
+	return &taken, nil
+}
+
+// trimVersions splits the header's versions into the ones to keep and the ones past Retain
+func (header *fileheader) trimVersions() ([]version, []version) {
+	if len(header.Versions) <= header.Retain {
+		return header.Versions, nil
+	}
+	cut := len(header.Versions) - header.Retain
+	return header.Versions[cut:], header.Versions[:cut]
+}
+
+// helper method to load the header a version was snapshotted from
+func loadSnapshot(entry version) *fileheader {
+	ciphertext, ok := datastoreGet(entry.Address)
+	if !ok {
+		return nil
+	}
+	snapBytes, err := VerifyDec(ciphertext, entry.Enc, entry.Mac)
+	if err != nil {
+		return nil
+	}
+	var snap fileheader
+	err = unmarshalObject(snapBytes, &snap)
+	if err != nil || len(snap.Keys) == 0 || snap.Version != entry.Number {
+		return nil
+	}
+	return &snap
+}
+
+// ListVersions lists the versions of a file that can still be loaded, oldest first, ending
+// with the current one.
+func (userdata *User) ListVersions(filename string) ([]FileVersion, error) {
+	defer userdata.measure("ListVersions")()
+	if userdata == nil || userdata.Username == "" || userdata.FilestructMac == nil || userdata.FilestructEnc == nil {
+		return nil, errors.New(strings.ToTitle("ERROR"))
+	}
+	pointer, _ := userdata.loadFileStruct(filename)
+	if pointer == nil {
+		return nil, errors.New(strings.ToTitle("Access not granted"))
+	}
+	header := loadFileHeader(*pointer)
+	if header == nil {
+		return nil, errors.New(strings.ToTitle("verification failed"))
+	}
+	var versions []FileVersion
+	for _, entry := range header.Versions {
+		versions = append(versions, FileVersion{
+			Number:  entry.Number,
+			Saved:   entry.Saved,
+			SavedBy: entry.SavedBy,
+			Length:  entry.Length,
+		})
+	}
+	return append(versions, FileVersion{
+		Number:  header.Version,
+		Saved:   header.Saved,
+		SavedBy: header.SavedBy,
+		Length:  header.length(),
+	}), nil
+}
+
+// LoadFileVersion returns the content of a file as it was in the given version.
+func (userdata *User) LoadFileVersion(filename string, v int) ([]byte, error) {
+	defer userdata.measure("LoadFileVersion")()
+	return userdata.loadFileVersion(filename, v)
+}
+
+// loadFileVersion is LoadFileVersion without measuring it, for RestoreVersion
+func (userdata *User) loadFileVersion(filename string, v int) ([]byte, error) {
+	if userdata == nil || userdata.Username == "" || userdata.FilestructMac == nil || userdata.FilestructEnc == nil {
+		return nil, errors.New(strings.ToTitle("ERROR"))
+	}
+	pointer, _ := userdata.loadFileStruct(filename)
+	if pointer == nil {
+		return nil, errors.New(strings.ToTitle("Access not granted"))
+	}
+	header := loadFileHeader(*pointer)
+	if header == nil {
+		return nil, errors.New(strings.ToTitle("verification failed"))
+	}
+	if v == header.Version {
+		return header.content()
+	}
+	for _, entry := range header.Versions {
+		if entry.Number != v {
+			continue
+		}
+		snap := loadSnapshot(entry)
+		if snap == nil {
+			return nil, errors.New(strings.ToTitle("verification failed"))
+		}
+		return snap.content()
+	}
+	return nil, errors.New(strings.ToTitle("version " + strconv.Itoa(v) + " is not available"))
+}
+
+// RestoreVersion makes an earlier version the current content of a file. Like any other
+// StoreFile, this keeps what was there before as a new version, so it can be undone.
+func (userdata *User) RestoreVersion(filename string, v int) error {
+	defer userdata.measure("RestoreVersion")()
+	content, err := userdata.loadFileVersion(filename, v)
+	if err != nil {
+		return err
+	}
+	return userdata.storeFile(filename, content)
+}
+
+// SetVersionRetention sets how many earlier versions of a file are kept, deleting any beyond
+// that straight away. Zero keeps none, and StoreFile then deletes the old content as soon as it
+// has been replaced.
+func (userdata *User) SetVersionRetention(filename string, retain int) error {
+	defer userdata.measure("SetVersionRetention")()
+	if userdata == nil || userdata.Username == "" || userdata.FilestructMac == nil || userdata.FilestructEnc == nil {
+		return errors.New(strings.ToTitle("ERROR"))
+	}
+	if retain < 0 {
+		return errors.New(strings.ToTitle("retention cannot be negative"))
+	}
+	for attempt := 0; attempt < swapAttempts; attempt++ {
+		pointer, _ := userdata.loadFileStruct(filename)
+		if pointer == nil {
+			return errors.New(strings.ToTitle("Access not granted"))
+		}
+		curFileStruct := *pointer
+		err := userdata.checkLease(curFileStruct)
+		if err != nil {
+			return err
+		}
+		header, old := readFileHeader(curFileStruct)
+		if header == nil {
+			return errors.New(strings.ToTitle("verification failed"))
+		}
+		header.Retain = retain
+		var dropped []version
+		header.Versions, dropped = header.trimVersions()
+		header.discard(dropped)
+		swapped, err := swapFileHeader(curFileStruct, old, *header)
+		if err != nil {
+			return err
+		}
+		if swapped {
+			return collectGarbage(curFileStruct)
+		}
+	}
+	return errors.New(strings.ToTitle("file is being changed by another session, try again"))
+}
@@ -0,0 +1,71 @@
+package client_test
+
+import (
+	"strings"
+	"testing"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+
+	"github.com/cs161-staff/project2-starter-code/client"
+)
+
+// These benchmarks compare the JSON and binary encodings of file objects. Besides time, they
+// report how many bytes each operation moves to and from the Datastore.
+
+var benchmarkContent = []byte(strings.Repeat(contentFour, 12))
+
+func benchmarkEncodings(b *testing.B, run func(b *testing.B)) {
+	for _, legacy := range []bool{true, false} {
+		name := "binary"
+		if legacy {
+			name = "json"
+		}
+		b.Run(name, func(b *testing.B) {
+			client.WriteLegacyEncoding = legacy
+			defer func() { client.WriteLegacyEncoding = false }()
+			userlib.DatastoreClear()
+			userlib.KeystoreClear()
+			run(b)
+		})
+	}
+}
+
+func BenchmarkStoreFile(b *testing.B) {
+	benchmarkEncodings(b, func(b *testing.B) {
+		alice, err := client.InitUser("alice", defaultPassword)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ResetTimer()
+		userlib.DatastoreResetBandwidth()
+		for i := 0; i < b.N; i++ {
+			err = alice.StoreFile("aliceFile.txt", benchmarkContent)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(userlib.DatastoreGetBandwidth())/float64(b.N), "datastore-B/op")
+	})
+}
+
+func BenchmarkLoadFile(b *testing.B) {
+	benchmarkEncodings(b, func(b *testing.B) {
+		alice, err := client.InitUser("alice", defaultPassword)
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = alice.StoreFile("aliceFile.txt", benchmarkContent)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ResetTimer()
+		userlib.DatastoreResetBandwidth()
+		for i := 0; i < b.N; i++ {
+			_, err = alice.LoadFile("aliceFile.txt")
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(userlib.DatastoreGetBandwidth())/float64(b.N), "datastore-B/op")
+	})
+}
@@ -4,10 +4,15 @@ import (
 	// Some imports use an underscore to prevent the compiler from complaining
 	// about unused imports.
 	_ "encoding/hex"
-	_ "errors"
-	_ "strconv"
-	_ "strings"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	// A "dot" import is used here so that the functions in the ginko and gomega
 	// modules can be used without an identifier. For example, Describe() and
@@ -20,6 +25,15 @@ import (
 	"github.com/cs161-staff/project2-starter-code/client"
 )
 
+// unreachableKeyLog is a key log whose server stops taking new entries
+type unreachableKeyLog struct {
+	client.KeyLog
+}
+
+func (log unreachableKeyLog) Append(entry []byte) (int, error) {
+	return 0, errors.New("key log unreachable")
+}
+
 func TestSetupAndExecution(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Client Tests")
@@ -73,6 +87,7 @@ var _ = Describe("Client Tests", func() {
 		// We also initialize
 		userlib.DatastoreClear()
 		userlib.KeystoreClear()
+		client.KeyTransparencyLog = client.NewLocalKeyLog(nil)
 	})
 
 	Describe("Custom Test Suite #1: further functionality", func() {
@@ -585,4 +600,3261 @@ var _ = Describe("Client Tests", func() {
 		})
 
 	})
+
+	Describe("Efficient Revocation Tests", func() {
+
+		Specify("Revoking access costs the same for short and long files", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice stores a short and a long file and shares both with Bob and Charles.")
+			longContent := strings.Repeat(contentFour, 20)
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(dorisFile, []byte(longContent))
+			Expect(err).To(BeNil())
+			for _, filename := range []string{aliceFile, dorisFile} {
+				invite, err := alice.CreateInvitation(filename, "bob")
+				Expect(err).To(BeNil())
+				err = bob.AcceptInvitation("alice", invite, "bob"+filename)
+				Expect(err).To(BeNil())
+				invite, err = alice.CreateInvitation(filename, "charles")
+				Expect(err).To(BeNil())
+				err = charles.AcceptInvitation("alice", invite, "charles"+filename)
+				Expect(err).To(BeNil())
+			}
+
+			userlib.DebugMsg("Revoking Bob from both files.")
+			userlib.DatastoreResetBandwidth()
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			shortCost := userlib.DatastoreGetBandwidth()
+			userlib.DatastoreResetBandwidth()
+			err = alice.RevokeAccess(dorisFile, "bob")
+			Expect(err).To(BeNil())
+			longCost := userlib.DatastoreGetBandwidth()
+			Expect(longCost).To(BeNumerically("~", shortCost, 200))
+
+			userlib.DebugMsg("Bob lost access, Charles sees later appends.")
+			_, err = bob.LoadFile("bob" + dorisFile)
+			Expect(err).ToNot(BeNil())
+			err = alice.AppendToFile(dorisFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err := charles.LoadFile("charles" + dorisFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(longContent + contentTwo)))
+			err = charles.StoreFile("charles"+aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentThree)))
+		})
+
+		Specify("Revoking access to a file whose only key was never used", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice shares an empty file with Bob and revokes him twice over.")
+			err = alice.StoreFile(aliceFile, []byte(emptyString))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+
+			invite, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile+"2")
+			Expect(err).To(BeNil())
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("The file still reads and appends under its new key.")
+			err = alice.AppendToFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			_, err = bob.LoadFile(bobFile + "2")
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("A revoked user can't replace the file's data nodes", func() {
+			// everything is written as JSON, so the test can open what Bob can open
+			client.WriteLegacyEncoding = true
+			defer func() { client.WriteLegacyEncoding = false }()
+			nodeKeys := func(enc []byte, mac []byte, counter int) ([]byte, []byte) {
+				encKey, err := userlib.HashKDF(enc, []byte("enc-key"+strconv.Itoa(counter)))
+				Expect(err).To(BeNil())
+				macKey, err := userlib.HashKDF(mac, []byte("mac-key"+strconv.Itoa(counter)))
+				Expect(err).To(BeNil())
+				return encKey[:16], macKey[:16]
+			}
+
+			userlib.DebugMsg("Initializing users Alice, Bob, and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice shares a file with Bob and Charles.")
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob keeps the file's keys from his copy.")
+			var share struct {
+				F    userlib.UUID
+				E, M []byte
+			}
+			for _, value := range userlib.DatastoreGetMap() {
+				plaintext, err := client.VerifyDec(value, bob.FilestructEnc, bob.FilestructMac)
+				if err == nil && json.Unmarshal(plaintext, &share) == nil && share.E != nil {
+					break
+				}
+			}
+			Expect(share.E).ToNot(BeNil())
+			value, ok := userlib.DatastoreGet(share.F)
+			Expect(ok).To(BeTrue())
+			plaintext, err := client.VerifyDec(value, share.E, share.M)
+			Expect(err).To(BeNil())
+			var file struct {
+				RootEnc, RootMac []byte
+				First            userlib.UUID
+			}
+			Expect(json.Unmarshal(plaintext, &file)).To(BeNil())
+			value, ok = userlib.DatastoreGet(file.First)
+			Expect(ok).To(BeTrue())
+			encKey, macKey := nodeKeys(file.RootEnc, file.RootMac, 0)
+			plaintext, err = client.VerifyDec(value, encKey, macKey)
+			Expect(err).To(BeNil())
+			var header struct {
+				Keys []struct {
+					Enc, Mac []byte
+				}
+				Count int
+				Tail  userlib.UUID
+			}
+			Expect(json.Unmarshal(plaintext, &header)).To(BeNil())
+			tailEnc, tailMac := nodeKeys(header.Keys[0].Enc, header.Keys[0].Mac, header.Count-1)
+			value, ok = userlib.DatastoreGet(header.Tail)
+			Expect(ok).To(BeTrue())
+			plaintext, err = client.VerifyDec(value, tailEnc, tailMac)
+			Expect(err).To(BeNil())
+			var tail struct {
+				Prev userlib.UUID
+				Data []byte
+			}
+			Expect(json.Unmarshal(plaintext, &tail)).To(BeNil())
+
+			userlib.DebugMsg("Alice revokes Bob, who then rewrites the last data node under its old keys.")
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			tail.Data = []byte("HACKEDHACK")
+			forged, err := json.Marshal(tail)
+			Expect(err).To(BeNil())
+			userlib.DatastoreSet(header.Tail, client.EncMacGen(forged, tailEnc, tailMac))
+
+			userlib.DebugMsg("Alice and Charles notice instead of reading Bob's node.")
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+			_, err = charles.LoadFile(charlesFile)
+			Expect(err).ToNot(BeNil())
+		})
+
+	})
+
+	Describe("Crash Consistency Tests", func() {
+
+		Specify("Resuming a revocation interrupted at any point", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			datastoreSet := userlib.DatastoreSet
+			defer func() { userlib.DatastoreSet = datastoreSet }()
+
+			// the first write records the revocation in the journal; a crash before it leaves nothing to resume
+			for crashAt := 2; crashAt <= 9; crashAt++ {
+				filename := strconv.Itoa(crashAt) + aliceFile
+				userlib.DebugMsg("Sharing %s with Bob and Charles.", filename)
+				err = alice.StoreFile(filename, []byte(contentFour))
+				Expect(err).To(BeNil())
+				invite, err := alice.CreateInvitation(filename, "bob")
+				Expect(err).To(BeNil())
+				err = bob.AcceptInvitation("alice", invite, filename)
+				Expect(err).To(BeNil())
+				invite, err = alice.CreateInvitation(filename, "charles")
+				Expect(err).To(BeNil())
+				err = charles.AcceptInvitation("alice", invite, filename)
+				Expect(err).To(BeNil())
+
+				userlib.DebugMsg("Revoking Bob, crashing on Datastore write %d.", crashAt)
+				writes := 0
+				userlib.DatastoreSet = func(key userlib.UUID, value []byte) {
+					writes++
+					if writes == crashAt {
+						panic("crash")
+					}
+					datastoreSet(key, value)
+				}
+				func() {
+					defer func() { recover() }()
+					alice.RevokeAccess(filename, "bob")
+				}()
+				userlib.DatastoreSet = datastoreSet
+
+				userlib.DebugMsg("Logging in again finishes the revocation.")
+				aliceLaptop, err = client.GetUser("alice", defaultPassword)
+				Expect(err).To(BeNil())
+				data, err := aliceLaptop.LoadFile(filename)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(contentFour)))
+				data, err = charles.LoadFile(filename)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(contentFour)))
+				_, err = bob.LoadFile(filename)
+				Expect(err).ToNot(BeNil())
+				entries, err := aliceLaptop.ListAccess(filename)
+				Expect(err).To(BeNil())
+				Expect(entries).To(HaveLen(2))
+			}
+		})
+
+	})
+
+	Describe("Concurrent Append Tests", func() {
+
+		Specify("Appends from two sessions racing on the same file", func() {
+			userlib.DebugMsg("Initializing user Alice on her phone and laptop, and Bob.")
+			alicePhone, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alicePhone.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alicePhone.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			// the phone reads the file's filestruct and then its header; the other append lands
+			// right after that, before the phone writes anything back
+			datastoreGet := userlib.DatastoreGet
+			defer func() { userlib.DatastoreGet = datastoreGet }()
+			interleave := func(other func()) {
+				reads := 0
+				userlib.DatastoreGet = func(key userlib.UUID) ([]byte, bool) {
+					value, ok := datastoreGet(key)
+					reads++
+					if reads == 2 {
+						userlib.DatastoreGet = datastoreGet
+						other()
+					}
+					return value, ok
+				}
+			}
+
+			userlib.DebugMsg("The laptop appends while the phone is in the middle of appending.")
+			interleave(func() {
+				Expect(aliceLaptop.AppendToFile(aliceFile, []byte(contentTwo))).To(BeNil())
+			})
+			err = alicePhone.AppendToFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+
+			userlib.DebugMsg("Bob appends while the phone is in the middle of appending.")
+			interleave(func() {
+				Expect(bob.AppendToFile(bobFile, []byte(contentOne))).To(BeNil())
+			})
+			err = alicePhone.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err = aliceLaptop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree + contentOne + contentTwo)))
+		})
+
+		Specify("An append landing in the middle of a revocation is kept", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			for _, recipient := range []*client.User{bob, charles} {
+				invite, err := alice.CreateInvitation(aliceFile, recipient.Username)
+				Expect(err).To(BeNil())
+				err = recipient.AcceptInvitation("alice", invite, recipient.Username+aliceFile)
+				Expect(err).To(BeNil())
+			}
+
+			// the revocation journals its plan, copies the header, and journals the copy; Charles
+			// appends right after the copy, before anyone is switched over to it
+			datastoreSet := userlib.DatastoreSet
+			defer func() { userlib.DatastoreSet = datastoreSet }()
+			writes := 0
+			userlib.DatastoreSet = func(key userlib.UUID, value []byte) {
+				writes++
+				datastoreSet(key, value)
+				if writes == 2 {
+					userlib.DatastoreSet = datastoreSet
+					Expect(charles.AppendToFile("charles"+aliceFile, []byte(contentTwo))).To(BeNil())
+				}
+			}
+
+			userlib.DebugMsg("Alice revokes Bob while Charles appends.")
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			Expect(writes).To(BeNumerically(">=", 2))
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+
+			userlib.DebugMsg("Charles keeps appending to the new header.")
+			err = charles.AppendToFile("charles"+aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+			_, err = bob.LoadFile("bob" + aliceFile)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("An append that keeps losing the race reports a conflict", func() {
+			userlib.DebugMsg("Initializing user Alice.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			compareAndSwap := client.DatastoreCompareAndSwap
+			defer func() { client.DatastoreCompareAndSwap = compareAndSwap }()
+			client.DatastoreCompareAndSwap = func(key userlib.UUID, old []byte, value []byte) bool {
+				return false
+			}
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).ToNot(BeNil())
+			client.DatastoreCompareAndSwap = compareAndSwap
+
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+	})
+
+	Describe("File Lease Tests", func() {
+
+		Specify("Leases block other sessions until released", func() {
+			userlib.DebugMsg("Initializing user Alice on her phone and laptop, and Bob.")
+			alicePhone, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alicePhone.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alicePhone.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice's phone locks the file.")
+			err = alicePhone.LockFile(aliceFile, time.Minute)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Her laptop and Bob cannot change the file or take the lock.")
+			err = aliceLaptop.StoreFile(aliceFile, []byte(contentTwo))
+			Expect(err).ToNot(BeNil())
+			err = aliceLaptop.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).ToNot(BeNil())
+			err = aliceLaptop.RevokeAccess(aliceFile, "bob")
+			Expect(err).ToNot(BeNil())
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).ToNot(BeNil())
+			err = bob.LockFile(bobFile, time.Minute)
+			Expect(err).ToNot(BeNil())
+			err = bob.UnlockFile(bobFile)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Everyone can still read it, and the phone can still write.")
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			err = alicePhone.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Once the phone unlocks the file, Bob can append again.")
+			err = alicePhone.UnlockFile(aliceFile)
+			Expect(err).To(BeNil())
+			err = bob.AppendToFile(bobFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			data, err = aliceLaptop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+		})
+
+		Specify("A recipient's lease doesn't hold off the owner's revocation", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			for _, recipient := range []*client.User{bob, charles} {
+				invite, err := alice.CreateInvitation(aliceFile, recipient.Username)
+				Expect(err).To(BeNil())
+				err = recipient.AcceptInvitation("alice", invite, recipient.Username+aliceFile)
+				Expect(err).To(BeNil())
+			}
+
+			userlib.DebugMsg("Bob locks the file and keeps renewing his lease.")
+			err = bob.LockFile("bob"+aliceFile, time.Minute)
+			Expect(err).To(BeNil())
+			err = bob.LockFile("bob"+aliceFile, client.MaxLeaseDuration)
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Alice revokes Bob anyway, which releases his lease.")
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			_, err = bob.LoadFile("bob" + aliceFile)
+			Expect(err).ToNot(BeNil())
+			err = bob.LockFile("bob"+aliceFile, time.Minute)
+			Expect(err).ToNot(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("A lease held by Charles doesn't stop Alice from revoking him either.")
+			err = charles.LockFile("charles"+aliceFile, time.Minute)
+			Expect(err).To(BeNil())
+			err = alice.RevokeAccess(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			_, err = charles.LoadFile("charles" + aliceFile)
+			Expect(err).ToNot(BeNil())
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+		})
+
+		Specify("The owner's lease still holds after a device is removed", func() {
+			userlib.DebugMsg("Initializing Alice on her phone and desktop with a laptop added, and Bob.")
+			alicePhone, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			aliceDesktop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			aliceLaptop, err = aliceDesktop.AddDevice("laptop")
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alicePhone.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alicePhone.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice's phone locks the file, then the desktop removes the laptop.")
+			err = alicePhone.LockFile(aliceFile, time.Minute)
+			Expect(err).To(BeNil())
+			err = aliceDesktop.RemoveDevice("laptop")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("The lease still holds off the desktop and Bob.")
+			err = aliceDesktop.RevokeAccess(aliceFile, "bob")
+			Expect(err).ToNot(BeNil())
+			err = aliceDesktop.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).ToNot(BeNil())
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("The phone can still write, and once it unlocks the desktop can revoke.")
+			err = alicePhone.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = alicePhone.UnlockFile(aliceFile)
+			Expect(err).To(BeNil())
+			err = aliceDesktop.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Stale leases expire", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			err = bob.LockFile(bobFile, client.MaxLeaseDuration+time.Second)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Bob locks the file briefly and never unlocks it.")
+			err = bob.LockFile(bobFile, 50*time.Millisecond)
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).ToNot(BeNil())
+
+			time.Sleep(100 * time.Millisecond)
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = alice.LockFile(aliceFile, time.Minute)
+			Expect(err).To(BeNil())
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+		})
+
+	})
+
+	Describe("Version History Tests", func() {
+
+		Specify("Recovering from an accidental overwrite", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob overwrites the file by accident.")
+			err = bob.StoreFile(bobFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			versions, err := alice.ListVersions(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(versions).To(HaveLen(2))
+			Expect(versions[0].Number).To(Equal(1))
+			Expect(versions[0].SavedBy).To(Equal("alice"))
+			Expect(versions[0].Length).To(Equal(len(contentOne + contentTwo)))
+			Expect(versions[1].Number).To(Equal(2))
+			Expect(versions[1].SavedBy).To(Equal("bob"))
+
+			userlib.DebugMsg("Alice revokes Bob; the history survives.")
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			data, err := charles.LoadFileVersion(charlesFile, 1)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+			_, err = bob.LoadFileVersion(bobFile, 1)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Charles restores the first version.")
+			err = charles.RestoreVersion(charlesFile, 1)
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+			data, err = alice.LoadFileVersion(aliceFile, 2)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentThree)))
+			versions, err = alice.ListVersions(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(versions).To(HaveLen(3))
+			Expect(versions[2].SavedBy).To(Equal("charles"))
+			_, err = alice.LoadFileVersion(aliceFile, 4)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Keeping only as many versions as the retention allows", func() {
+			userlib.DebugMsg("Initializing user Alice.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			for i := 1; i <= client.DefaultVersionRetention+3; i++ {
+				err = alice.StoreFile(aliceFile, []byte(strconv.Itoa(i)))
+				Expect(err).To(BeNil())
+			}
+			versions, err := alice.ListVersions(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(versions).To(HaveLen(client.DefaultVersionRetention + 1))
+			Expect(versions[0].Number).To(Equal(3))
+
+			userlib.DebugMsg("Alice keeps only the previous version.")
+			err = alice.SetVersionRetention(aliceFile, -1)
+			Expect(err).ToNot(BeNil())
+			err = alice.SetVersionRetention(aliceFile, 1)
+			Expect(err).To(BeNil())
+			versions, err = alice.ListVersions(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(versions).To(HaveLen(2))
+			_, err = alice.LoadFileVersion(aliceFile, 11)
+			Expect(err).ToNot(BeNil())
+			data, err := alice.LoadFileVersion(aliceFile, 12)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte("12")))
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			versions, err = alice.ListVersions(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(versions).To(HaveLen(2))
+			Expect(versions[0].Number).To(Equal(13))
+		})
+
+	})
+
+	Describe("Garbage Collection Tests", func() {
+
+		datastoreSize := func() int {
+			size := 0
+			for _, value := range userlib.DatastoreGetMap() {
+				size += len(value)
+			}
+			return size
+		}
+
+		Specify("Overwriting a file without keeping versions", func() {
+			userlib.DebugMsg("Initializing user Alice.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentFour))
+			Expect(err).To(BeNil())
+			err = alice.SetVersionRetention(aliceFile, 0)
+			Expect(err).To(BeNil())
+			entries := len(userlib.DatastoreGetMap())
+			size := datastoreSize()
+
+			userlib.DebugMsg("Overwriting the file 20 times.")
+			for i := 0; i < 20; i++ {
+				err = alice.StoreFile(aliceFile, []byte(contentFour))
+				Expect(err).To(BeNil())
+			}
+			Expect(len(userlib.DatastoreGetMap())).To(Equal(entries))
+			Expect(datastoreSize()).To(BeNumerically("~", size, 100))
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentFour)))
+		})
+
+		Specify("Overwriting a file past its retention", func() {
+			userlib.DebugMsg("Initializing user Alice.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentFour))
+			Expect(err).To(BeNil())
+			single := len(userlib.DatastoreGetMap())
+			for i := 0; i < client.DefaultVersionRetention; i++ {
+				err = alice.StoreFile(aliceFile, []byte(contentFour))
+				Expect(err).To(BeNil())
+			}
+			entries := len(userlib.DatastoreGetMap())
+
+			userlib.DebugMsg("Overwriting the file 20 more times.")
+			for i := 0; i < 20; i++ {
+				err = alice.StoreFile(aliceFile, []byte(contentFour))
+				Expect(err).To(BeNil())
+			}
+			Expect(len(userlib.DatastoreGetMap())).To(Equal(entries))
+			versions, err := alice.ListVersions(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(versions).To(HaveLen(client.DefaultVersionRetention + 1))
+			data, err := alice.LoadFileVersion(aliceFile, versions[0].Number)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentFour)))
+
+			userlib.DebugMsg("Dropping the history reclaims the snapshots and their filenodes.")
+			err = alice.SetVersionRetention(aliceFile, 0)
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap())).To(Equal(single))
+		})
+
+		Specify("Collecting what an interrupted overwrite left behind", func() {
+			userlib.DebugMsg("Initializing user Alice.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentFour))
+			Expect(err).To(BeNil())
+			err = alice.SetVersionRetention(aliceFile, 0)
+			Expect(err).To(BeNil())
+			entries := len(userlib.DatastoreGetMap())
+
+			userlib.DebugMsg("Alice's client crashes while deleting the old content.")
+			datastoreDelete := userlib.DatastoreDelete
+			defer func() { userlib.DatastoreDelete = datastoreDelete }()
+			deletes := 0
+			userlib.DatastoreDelete = func(key userlib.UUID) {
+				deletes++
+				if deletes == 1 {
+					panic("crash")
+				}
+				datastoreDelete(key)
+			}
+			func() {
+				defer func() { recover() }()
+				alice.StoreFile(aliceFile, []byte(contentOne))
+			}()
+			userlib.DatastoreDelete = datastoreDelete
+			Expect(len(userlib.DatastoreGetMap())).To(BeNumerically(">", entries))
+
+			err = alice.CollectGarbage(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap())).To(Equal(entries - len(contentFour)/10 + len(contentOne)/10))
+			err = alice.StoreFile(aliceFile, []byte(contentFour))
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap())).To(Equal(entries))
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentFour)))
+		})
+
+	})
+
+	Describe("Deduplication Tests", func() {
+
+		Specify("Identical content is stored once and kept while still in use", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice turns on deduplication for two files.")
+			for _, filename := range []string{aliceFile, bobFile} {
+				err = alice.StoreFile(filename, []byte{})
+				Expect(err).To(BeNil())
+				err = alice.SetDeduplication(filename, true)
+				Expect(err).To(BeNil())
+				err = alice.SetVersionRetention(filename, 0)
+				Expect(err).To(BeNil())
+			}
+			err = alice.StoreFile(aliceFile, []byte(contentFour))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Storing the same content again adds no filenodes.")
+			entries := len(userlib.DatastoreGetMap())
+			err = alice.StoreFile(aliceFile, []byte(contentFour))
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap())).To(Equal(entries))
+
+			userlib.DebugMsg("The other file is in Alice's domain too, so it shares all of them.")
+			err = alice.StoreFile(bobFile, []byte(contentFour))
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap())).To(BeNumerically("<", entries+len(contentFour)/10))
+
+			userlib.DebugMsg("Appending to one file doesn't change the other.")
+			err = alice.AppendToFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			data, err := alice.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentFour)))
+
+			userlib.DebugMsg("Sharing and revoking still works.")
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentFour + contentOne + contentTwo + contentThree)))
+
+			userlib.DebugMsg("Overwriting a file keeps the filenodes an earlier version still uses.")
+			err = alice.SetVersionRetention(aliceFile, 1)
+			Expect(err).To(BeNil())
+			for i := 0; i < 2; i++ {
+				err = alice.StoreFile(aliceFile, []byte(contentFour))
+				Expect(err).To(BeNil())
+			}
+			entries = len(userlib.DatastoreGetMap())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			versions, err := alice.ListVersions(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(versions).To(HaveLen(2))
+			data, err = alice.LoadFileVersion(aliceFile, versions[0].Number)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentFour)))
+			Expect(len(userlib.DatastoreGetMap())).To(BeNumerically(">", entries))
+
+			userlib.DebugMsg("Restoring that version adds no filenodes.")
+			entries = len(userlib.DatastoreGetMap())
+			kept := entries
+			err = alice.RestoreVersion(aliceFile, versions[0].Number)
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap())).To(BeNumerically("<=", entries+1))
+
+			userlib.DebugMsg("Once no version uses them, they are deleted.")
+			err = alice.SetVersionRetention(aliceFile, 0)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap())).To(BeNumerically("<", kept-len(contentFour)/10))
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			data, err = alice.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentFour)))
+
+			userlib.DebugMsg("Revoking Bob gave Alice a fresh domain, so a file she deduplicates now shares nothing with the one Bob knew.")
+			err = alice.StoreFile(charlesFile, []byte{})
+			Expect(err).To(BeNil())
+			err = alice.SetDeduplication(charlesFile, true)
+			Expect(err).To(BeNil())
+			entries = len(userlib.DatastoreGetMap())
+			err = alice.StoreFile(charlesFile, []byte(contentFour))
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap())).To(BeNumerically(">=", entries+len(contentFour)/10))
+
+			userlib.DebugMsg("The revoked file moved to the fresh domain with her.")
+			entries = len(userlib.DatastoreGetMap())
+			err = alice.StoreFile(aliceFile, []byte(contentFour))
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap())).To(BeNumerically("<", entries+len(contentFour)/10))
+		})
+
+	})
+
+	Describe("Compression Tests", func() {
+
+		Specify("Compressed files cost less and read back the same", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			text := strings.Repeat(contentOne+contentTwo+contentThree, 100)
+
+			userlib.DebugMsg("Alice stores the same text with and without compression.")
+			userlib.DatastoreResetBandwidth()
+			err = alice.StoreFile(aliceFile, []byte(text))
+			Expect(err).To(BeNil())
+			plainCost := userlib.DatastoreGetBandwidth()
+
+			err = alice.StoreFile(bobFile, []byte{})
+			Expect(err).To(BeNil())
+			err = alice.SetCompression(bobFile, true)
+			Expect(err).To(BeNil())
+			userlib.DatastoreResetBandwidth()
+			err = alice.StoreFile(bobFile, []byte(text))
+			Expect(err).To(BeNil())
+			Expect(userlib.DatastoreGetBandwidth()).To(BeNumerically("<", plainCost/4))
+
+			data, err := alice.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(text)))
+
+			userlib.DebugMsg("Appending across block boundaries, sharing and revoking.")
+			invite, err := alice.CreateInvitation(bobFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			err = bob.AppendToFile(bobFile, []byte(text))
+			Expect(err).To(BeNil())
+			err = alice.RevokeAccess(bobFile, "bob")
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(bobFile, []byte(contentFour))
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(text + text + contentFour)))
+
+			userlib.DebugMsg("Turning compression off again keeps every version readable.")
+			err = alice.SetCompression(bobFile, false)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			versions, err := alice.ListVersions(bobFile)
+			Expect(err).To(BeNil())
+			Expect(versions[len(versions)-2].Length).To(Equal(len(text + text + contentFour)))
+			data, err = alice.LoadFileVersion(bobFile, versions[len(versions)-2].Number)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(text + text + contentFour)))
+		})
+
+	})
+
+	Describe("Storage Encoding Tests", func() {
+
+		Specify("Files written as JSON stay usable and the binary encoding costs less", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob with the legacy encoding.")
+			client.WriteLegacyEncoding = true
+			defer func() { client.WriteLegacyEncoding = false }()
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			userlib.DatastoreResetBandwidth()
+			err = alice.StoreFile(aliceFile, []byte(contentFour))
+			Expect(err).To(BeNil())
+			jsonCost := userlib.DatastoreGetBandwidth()
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Switching to the binary encoding, everything written before still reads.")
+			client.WriteLegacyEncoding = false
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentFour)))
+			err = bob.AppendToFile(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentFour + contentOne)))
+
+			userlib.DebugMsg("Storing the same content in the binary encoding moves fewer bytes.")
+			userlib.DatastoreResetBandwidth()
+			err = alice.StoreFile(charlesFile, []byte(contentFour))
+			Expect(err).To(BeNil())
+			Expect(userlib.DatastoreGetBandwidth()).To(BeNumerically("<", jsonCost))
+
+			userlib.DebugMsg("Revoking Bob rewrites the file in the binary encoding.")
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentFour + contentOne)))
+		})
+
+	})
+
+	Describe("Bandwidth Efficiency Tests", func() {
+
+		Specify("Each operation reports what it read and wrote", func() {
+			userlib.DebugMsg("Initializing user Alice.")
+			userlib.DatastoreResetBandwidth()
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			Expect(alice.LastBandwidth().Total()).To(Equal(userlib.DatastoreGetBandwidth()))
+
+			userlib.DebugMsg("Storing, appending and loading match the Datastore's own count.")
+			userlib.DatastoreResetBandwidth()
+			err = alice.StoreFile(aliceFile, []byte(contentFour))
+			Expect(err).To(BeNil())
+			Expect(alice.LastBandwidth().Total()).To(Equal(userlib.DatastoreGetBandwidth()))
+			Expect(alice.LastBandwidth().Written).To(BeNumerically(">", len(contentFour)))
+
+			userlib.DatastoreResetBandwidth()
+			err = alice.AppendToFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			Expect(alice.LastBandwidth().Total()).To(Equal(userlib.DatastoreGetBandwidth()))
+
+			userlib.DatastoreResetBandwidth()
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(alice.LastBandwidth().Total()).To(Equal(userlib.DatastoreGetBandwidth()))
+			Expect(alice.LastBandwidth().Written).To(Equal(0))
+
+			userlib.DebugMsg("A report is made for every operation.")
+			var reported []string
+			client.BandwidthReport = func(username string, operation string, usage client.Bandwidth) {
+				reported = append(reported, username+" "+operation)
+			}
+			defer func() { client.BandwidthReport = nil }()
+			err = alice.RestoreVersion(aliceFile, 1)
+			Expect(err).To(BeNil())
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(reported).To(Equal([]string{"alice RestoreVersion", "alice LoadFile"}))
+		})
+
+		Specify("Operations running at the same time on one session each record their own cost", func() {
+			userlib.DebugMsg("Initializing Alice with a long file, a short file and a phone.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			long := strings.Repeat(contentFour, 20)
+			err = alice.StoreFile(aliceFile, []byte(long))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			_, err = alice.AddDevice("phone")
+			Expect(err).To(BeNil())
+			aliceDesktop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			var reportLock sync.Mutex
+			var loads []client.Bandwidth
+			client.BandwidthReport = func(username string, operation string, usage client.Bandwidth) {
+				reportLock.Lock()
+				defer reportLock.Unlock()
+				if operation == "LoadFile" {
+					loads = append(loads, usage)
+				}
+			}
+			defer func() { client.BandwidthReport = nil }()
+
+			// hold the first load at its second read, just after it has checked the session's
+			// keys are up to date, until the second load is done
+			paused := make(chan bool)
+			resume := make(chan bool)
+			reads := 0
+			datastoreGet := userlib.DatastoreGet
+			defer func() { userlib.DatastoreGet = datastoreGet }()
+			userlib.DatastoreGet = func(key userlib.UUID) ([]byte, bool) {
+				reads++
+				if reads == 2 {
+					paused <- true
+					<-resume
+				}
+				return datastoreGet(key)
+			}
+
+			userlib.DebugMsg("Alice starts loading the long file.")
+			done := make(chan error)
+			go func() {
+				data, err := alice.LoadFile(aliceFile)
+				if err == nil && string(data) != long {
+					err = errors.New("wrong content")
+				}
+				done <- err
+			}()
+			<-paused
+
+			userlib.DebugMsg("Meanwhile her desktop removes the phone, and she loads the short file.")
+			err = aliceDesktop.RemoveDevice("phone")
+			Expect(err).To(BeNil())
+			data, err := alice.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			close(resume)
+			Expect(<-done).To(BeNil())
+
+			userlib.DebugMsg("Each load reported what it cost.")
+			Expect(loads).To(HaveLen(2))
+			Expect(loads[0].Read).To(BeNumerically("<", len(long)))
+			Expect(loads[1].Read).To(BeNumerically(">=", len(long)))
+		})
+
+		Specify("Appending costs the same however long the file is and however widely it is shared", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			ownerCost := alice.LastBandwidth().Total()
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			recipientCost := bob.LastBandwidth().Total()
+
+			userlib.DebugMsg("The file grows a thousandfold and is shared with five more users.")
+			for i := 0; i < 100; i++ {
+				err = alice.AppendToFile(aliceFile, []byte(contentFour))
+				Expect(err).To(BeNil())
+			}
+			for _, name := range []string{"charles", "doris", "eve", "frank", "grace"} {
+				_, err = client.InitUser(name, defaultPassword)
+				Expect(err).To(BeNil())
+				_, err = alice.CreateInvitation(aliceFile, name)
+				Expect(err).To(BeNil())
+			}
+
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			Expect(alice.LastBandwidth().Total()).To(BeNumerically("~", ownerCost, 200))
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			Expect(bob.LastBandwidth().Total()).To(BeNumerically("~", recipientCost, 200))
+		})
+
+		Specify("Sharing costs the same however long the file is and however widely it is shared", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, Charles, Horace and four more.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			horace, err = client.InitUser("horace", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			others := []string{"doris", "eve", "frank", "grace"}
+			users := make(map[string]*client.User)
+			for _, name := range others {
+				users[name], err = client.InitUser(name, defaultPassword)
+				Expect(err).To(BeNil())
+			}
+
+			// a pin bucket costs more to read when someone else's pin happens to share it, so
+			// every pin is made before anything is measured
+			userlib.DebugMsg("Alice pins everyone's keys, and Horace pins hers.")
+			for _, name := range append([]string{"bob", "charles", "horace"}, others...) {
+				fingerprint, err := alice.Fingerprint(name)
+				Expect(err).To(BeNil())
+				err = alice.TrustKeys(name, fingerprint)
+				Expect(err).To(BeNil())
+			}
+			fingerprint, err := horace.Fingerprint("alice")
+			Expect(err).To(BeNil())
+			err = horace.TrustKeys("alice", fingerprint)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice shares two short files with Charles and Bob, and the second with Horace.")
+			for _, filename := range []string{aliceFile, dorisFile} {
+				err = alice.StoreFile(filename, []byte(contentOne))
+				Expect(err).To(BeNil())
+				invite, err := alice.CreateInvitation(filename, "charles")
+				Expect(err).To(BeNil())
+				err = charles.AcceptInvitation("alice", invite, filename)
+				Expect(err).To(BeNil())
+				invite, err = alice.CreateInvitation(filename, "bob")
+				Expect(err).To(BeNil())
+				err = bob.AcceptInvitation("alice", invite, filename)
+				Expect(err).To(BeNil())
+			}
+			invite, err := alice.CreateInvitation(dorisFile, "horace")
+			Expect(err).To(BeNil())
+			inviteCost := alice.LastBandwidth().Total()
+			err = horace.AcceptInvitation("alice", invite, dorisFile)
+			Expect(err).To(BeNil())
+			acceptCost := horace.LastBandwidth().Total()
+
+			userlib.DebugMsg("The first file grows a thousandfold and is shared with four more users.")
+			for i := 0; i < 100; i++ {
+				err = alice.AppendToFile(aliceFile, []byte(contentFour))
+				Expect(err).To(BeNil())
+			}
+			for _, name := range others {
+				invite, err := alice.CreateInvitation(aliceFile, name)
+				Expect(err).To(BeNil())
+				err = users[name].AcceptInvitation("alice", invite, name+"File.txt")
+				Expect(err).To(BeNil())
+			}
+
+			userlib.DebugMsg("Sharing it with Horace costs what sharing the short file did.")
+			invite, err = alice.CreateInvitation(aliceFile, "horace")
+			Expect(err).To(BeNil())
+			Expect(alice.LastBandwidth().Total()).To(BeNumerically("~", inviteCost, 100))
+			err = horace.AcceptInvitation("alice", invite, horaceFile)
+			Expect(err).To(BeNil())
+			Expect(horace.LastBandwidth().Total()).To(BeNumerically("~", acceptCost, 100))
+
+			userlib.DebugMsg("Everyone sees the whole file, and revoking still works.")
+			data, err := horace.LoadFile(horaceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + strings.Repeat(contentFour, 100))))
+			entries, err := alice.ListAccess(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(8))
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			_, err = bob.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+			entries, err = alice.ListAccess(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(7))
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err = horace.LoadFile(horaceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + strings.Repeat(contentFour, 100) + contentTwo)))
+		})
+
+	})
+
+	Describe("Block Cache Tests", func() {
+
+		Specify("Cached files are re-read cheaply and always reflect changes", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob, Alice caching what she reads.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.EnableCache(1000, "")
+			Expect(err).To(BeNil())
+			longContent := strings.Repeat(contentFour, 10)
+			err = alice.StoreFile(aliceFile, []byte(longContent))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("The second load only checks the filestruct and header.")
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(longContent)))
+			firstCost := alice.LastBandwidth().Total()
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(longContent)))
+			Expect(alice.LastBandwidth().Total()).To(BeNumerically("<", firstCost/10))
+			cachedCost := alice.LastBandwidth().Total()
+
+			userlib.DebugMsg("Bob appends; Alice only downloads the new nodes.")
+			err = bob.AppendToFile(bobFile, []byte(contentFour))
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(longContent + contentFour)))
+			Expect(alice.LastBandwidth().Total()).To(BeNumerically("<", cachedCost+firstCost/5))
+
+			userlib.DebugMsg("Bob overwrites the file and Alice sees the new content.")
+			err = bob.StoreFile(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("After revoking Bob, Alice still reads the latest content.")
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+
+			userlib.DebugMsg("A tiny cache still returns the right content.")
+			err = alice.EnableCache(3, "")
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(longContent))
+			Expect(err).To(BeNil())
+			for i := 0; i < 2; i++ {
+				data, err = alice.LoadFile(aliceFile)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(longContent)))
+			}
+		})
+
+		Specify("The disk cache is shared by sessions and ignored when tampered with", func() {
+			dir, err := os.MkdirTemp("", "blockcache")
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(dir)
+
+			userlib.DebugMsg("Alice loads a file on her laptop with a disk cache.")
+			aliceLaptop, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = aliceLaptop.EnableCache(1000, dir)
+			Expect(err).To(BeNil())
+			longContent := strings.Repeat(contentFour, 10)
+			err = aliceLaptop.StoreFile(aliceFile, []byte(longContent))
+			Expect(err).To(BeNil())
+			_, err = aliceLaptop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			firstCost := aliceLaptop.LastBandwidth().Total()
+
+			userlib.DebugMsg("A new session using the same directory doesn't download the nodes again.")
+			aliceDesktop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = aliceDesktop.EnableCache(1000, dir)
+			Expect(err).To(BeNil())
+			data, err := aliceDesktop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(longContent)))
+			Expect(aliceDesktop.LastBandwidth().Total()).To(BeNumerically("<", firstCost/10))
+
+			userlib.DebugMsg("Every cached file is scrambled; loading falls back to the Datastore.")
+			names, err := filepath.Glob(filepath.Join(dir, "*"))
+			Expect(err).To(BeNil())
+			Expect(names).ToNot(BeEmpty())
+			for _, name := range names {
+				contents, err := os.ReadFile(name)
+				Expect(err).To(BeNil())
+				contents[len(contents)/2] ^= 0xff
+				err = os.WriteFile(name, contents, 0600)
+				Expect(err).To(BeNil())
+			}
+			alicePhone, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alicePhone.EnableCache(1000, dir)
+			Expect(err).To(BeNil())
+			data, err = alicePhone.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(longContent)))
+
+			userlib.DebugMsg("Bob can't use Alice's cache to read her file.")
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = bob.EnableCache(1000, dir)
+			Expect(err).To(BeNil())
+			_, err = bob.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+		})
+
+	})
+
+	Describe("Parallel Block Tests", func() {
+
+		Specify("Nodes are fetched concurrently, up to the limit", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			// a slow backend that can serve several calls at once, counting how many it serves
+			var lock sync.Mutex
+			inFlight, maxInFlight := 0, 0
+			slow := func(call func()) {
+				lock.Lock()
+				inFlight++
+				if inFlight > maxInFlight {
+					maxInFlight = inFlight
+				}
+				lock.Unlock()
+				time.Sleep(time.Millisecond)
+				lock.Lock()
+				call()
+				inFlight--
+				lock.Unlock()
+			}
+			datastoreGet := userlib.DatastoreGet
+			datastoreSet := userlib.DatastoreSet
+			defer func() {
+				userlib.DatastoreGet = datastoreGet
+				userlib.DatastoreSet = datastoreSet
+				client.ConcurrentDatastore = false
+				client.BlockConcurrency = 8
+			}()
+			userlib.DatastoreGet = func(key userlib.UUID) (value []byte, ok bool) {
+				slow(func() { value, ok = datastoreGet(key) })
+				return value, ok
+			}
+			userlib.DatastoreSet = func(key userlib.UUID, value []byte) {
+				slow(func() { datastoreSet(key, value) })
+			}
+			client.ConcurrentDatastore = true
+			client.BlockConcurrency = 4
+
+			userlib.DebugMsg("Loading a long file fetches its nodes in parallel.")
+			longContent := strings.Repeat(contentFour, 4)
+			err = alice.StoreFile(aliceFile, []byte(longContent))
+			Expect(err).To(BeNil())
+			maxInFlight = 0
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(longContent)))
+			Expect(maxInFlight).To(BeNumerically(">", 1))
+			Expect(maxInFlight).To(BeNumerically("<=", 4))
+
+			userlib.DebugMsg("With a limit of one, everything happens in order.")
+			client.BlockConcurrency = 1
+			maxInFlight = 0
+			err = alice.AppendToFile(aliceFile, []byte(longContent))
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(longContent + longContent)))
+			Expect(maxInFlight).To(Equal(1))
+			client.BlockConcurrency = 4
+
+			userlib.DebugMsg("Short and long appends, sharing and revoking mix freely.")
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			expected := longContent + longContent
+			for i := 0; i < 5; i++ {
+				err = bob.AppendToFile(bobFile, []byte(contentOne))
+				Expect(err).To(BeNil())
+				expected += contentOne
+			}
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(longContent))
+			Expect(err).To(BeNil())
+			expected += longContent
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(expected)))
+			versions, err := alice.ListVersions(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(versions[len(versions)-1].Length).To(Equal(len(expected)))
+		})
+
+		Specify("Nodes of a segment that are swapped around are detected", func() {
+			userlib.DebugMsg("Initializing user Alice.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			existing := make(map[userlib.UUID]bool)
+			for key := range userlib.DatastoreGetMap() {
+				existing[key] = true
+			}
+			err = alice.StoreFile(aliceFile, []byte(contentFour))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Swapping two of the file's data nodes, which all have the same size.")
+			bySize := make(map[int][]userlib.UUID)
+			for key, value := range userlib.DatastoreGetMap() {
+				if !existing[key] {
+					bySize[len(value)] = append(bySize[len(value)], key)
+				}
+			}
+			var nodes []userlib.UUID
+			for _, keys := range bySize {
+				if len(keys) > len(nodes) {
+					nodes = keys
+				}
+			}
+			Expect(len(nodes)).To(Equal(len(contentFour) / 10))
+			first, _ := userlib.DatastoreGet(nodes[0])
+			second, _ := userlib.DatastoreGet(nodes[1])
+			userlib.DatastoreSet(nodes[0], second)
+			userlib.DatastoreSet(nodes[1], first)
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+		})
+
+	})
+
+	Describe("Batch Operation Tests", func() {
+
+		Specify("Storing, appending and revoking write in batches", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, Charles, Doris and Eve.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			recipients := []string{"bob", "charles", "doris", "eve"}
+			users := make(map[string]*client.User)
+			for _, name := range recipients {
+				users[name], err = client.InitUser(name, defaultPassword)
+				Expect(err).To(BeNil())
+			}
+
+			// record every batch, and count the writes that happen outside of one
+			var gets, sets, deletes []int
+			singles := 0
+			inBatch := false
+			datastoreSet := userlib.DatastoreSet
+			multiGet := client.DatastoreMultiGet
+			multiSet := client.DatastoreMultiSet
+			multiDelete := client.DatastoreMultiDelete
+			defer func() {
+				userlib.DatastoreSet = datastoreSet
+				client.DatastoreMultiGet = multiGet
+				client.DatastoreMultiSet = multiSet
+				client.DatastoreMultiDelete = multiDelete
+			}()
+			userlib.DatastoreSet = func(key userlib.UUID, value []byte) {
+				if !inBatch {
+					singles++
+				}
+				datastoreSet(key, value)
+			}
+			client.DatastoreMultiGet = func(keys []userlib.UUID) map[userlib.UUID][]byte {
+				gets = append(gets, len(keys))
+				return multiGet(keys)
+			}
+			client.DatastoreMultiSet = func(entries map[userlib.UUID][]byte) {
+				sets = append(sets, len(entries))
+				inBatch = true
+				multiSet(entries)
+				inBatch = false
+			}
+			client.DatastoreMultiDelete = func(keys []userlib.UUID) {
+				deletes = append(deletes, len(keys))
+				multiDelete(keys)
+			}
+			reset := func() {
+				gets, sets, deletes = nil, nil, nil
+				singles = 0
+			}
+
+			userlib.DebugMsg("StoreFile writes every node in one batch.")
+			err = alice.StoreFile(aliceFile, []byte(contentFour))
+			Expect(err).To(BeNil())
+			Expect(sets).To(Equal([]int{len(contentFour)/10 + 1}))
+			shortSingles := singles
+			reset()
+			err = alice.StoreFile(bobFile, []byte(strings.Repeat(contentFour, 10)))
+			Expect(err).To(BeNil())
+			Expect(sets).To(Equal([]int{len(contentFour) + 1}))
+			Expect(singles).To(Equal(shortSingles))
+
+			userlib.DebugMsg("AppendToFile does too.")
+			reset()
+			err = alice.AppendToFile(aliceFile, []byte(contentFour))
+			Expect(err).To(BeNil())
+			Expect(sets).To(HaveLen(1))
+			Expect(singles).To(BeNumerically("<=", 1))
+
+			userlib.DebugMsg("Overwriting deletes the old content in one batch once it is no longer kept.")
+			err = alice.SetVersionRetention(bobFile, 0)
+			Expect(err).To(BeNil())
+			reset()
+			err = alice.StoreFile(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			Expect(deletes).To(Equal([]int{len(contentFour) + 1}))
+
+			userlib.DebugMsg("Revoking switches every remaining recipient over in one batch.")
+			for _, name := range recipients {
+				invite, err := alice.CreateInvitation(aliceFile, name)
+				Expect(err).To(BeNil())
+				err = users[name].AcceptInvitation("alice", invite, aliceFile)
+				Expect(err).To(BeNil())
+			}
+			reset()
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			Expect(gets).To(Equal([]int{len(recipients) - 1}))
+			// the sharetree, Alice's filestruct and each remaining recipient's
+			Expect(sets).To(Equal([]int{len(recipients) + 1}))
+			revokeSingles := singles
+
+			userlib.DebugMsg("The number of single writes doesn't depend on the number of recipients.")
+			err = alice.StoreFile(charlesFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(charlesFile, "bob")
+			Expect(err).To(BeNil())
+			err = users["bob"].AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitation(charlesFile, "charles")
+			Expect(err).To(BeNil())
+			err = users["charles"].AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+			reset()
+			err = alice.RevokeAccess(charlesFile, "bob")
+			Expect(err).To(BeNil())
+			Expect(singles).To(Equal(revokeSingles))
+
+			userlib.DebugMsg("Everyone left still sees the file.")
+			for _, name := range recipients[1:] {
+				data, err := users[name].LoadFile(aliceFile)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(contentFour + contentFour)))
+			}
+			_, err = users["bob"].LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+		})
+
+	})
+
+	Describe("File Listing Tests", func() {
+
+		Specify("ListFiles and DeleteFile keep track of the user's files", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			files, err := alice.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(files).To(BeEmpty())
+
+			userlib.DebugMsg("Alice stores two files and shares one with Bob.")
+			err = alice.StoreFile(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentFour))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			files, err = alice.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(files).To(Equal([]string{aliceFile, bobFile}))
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			files, err = aliceLaptop.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(files).To(Equal([]string{aliceFile, bobFile}))
+			files, err = bob.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(files).To(Equal([]string{bobFile}))
+
+			userlib.DebugMsg("Alice can't delete a file she still shares.")
+			err = alice.DeleteFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Bob deletes his copy; Alice keeps hers.")
+			err = bob.DeleteFile(bobFile)
+			Expect(err).To(BeNil())
+			files, err = bob.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(files).To(BeEmpty())
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+
+			userlib.DebugMsg("Once Bob is revoked, Alice deletes the file and every version of it.")
+			before := len(userlib.DatastoreGetMap())
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = alice.DeleteFile(aliceFile)
+			Expect(err).To(BeNil())
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+			files, err = alice.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(files).To(Equal([]string{bobFile}))
+			// the header, both versions' nodes and the snapshot are gone
+			Expect(len(userlib.DatastoreGetMap())).To(BeNumerically("<=", before-len(contentFour)/10-3))
+
+			userlib.DebugMsg("The name can be used again.")
+			err = alice.StoreFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentThree)))
+		})
+
+	})
+
+	Describe("Session Export Tests", func() {
+
+		Specify("Exported sessions resume until they expire or are logged out", func() {
+			userlib.DebugMsg("Initializing user Alice and storing a file.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			dir := GinkgoT().TempDir()
+			laptop := filepath.Join(dir, "laptop")
+			phone := filepath.Join(dir, "phone")
+			deviceKey := userlib.RandomBytes(32)
+			err = alice.ExportSession(laptop, deviceKey, time.Hour)
+			Expect(err).To(BeNil())
+			err = alice.ExportSession(phone, []byte("correct horse battery staple"), time.Hour)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Both sessions resume with their secret and nothing else.")
+			aliceLaptop, err = client.ResumeSession(laptop, deviceKey)
+			Expect(err).To(BeNil())
+			err = aliceLaptop.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			alicePhone, err = client.ResumeSession(phone, []byte("correct horse battery staple"))
+			Expect(err).To(BeNil())
+			data, err := alicePhone.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+
+			_, err = client.ResumeSession(laptop, userlib.RandomBytes(32))
+			Expect(err).ToNot(BeNil())
+			_, err = client.ResumeSession(phone, []byte("correct horse battery"))
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("A session file that was tampered with doesn't resume.")
+			fileBytes, err := os.ReadFile(laptop)
+			Expect(err).To(BeNil())
+			tampered := filepath.Join(dir, "tampered")
+			fileBytes[len(fileBytes)/2] ^= 1
+			err = os.WriteFile(tampered, fileBytes, 0600)
+			Expect(err).To(BeNil())
+			_, err = client.ResumeSession(tampered, deviceKey)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("An expired session doesn't resume.")
+			short := filepath.Join(dir, "short")
+			err = alice.ExportSession(short, deviceKey, time.Millisecond)
+			Expect(err).To(BeNil())
+			time.Sleep(5 * time.Millisecond)
+			_, err = client.ResumeSession(short, deviceKey)
+			Expect(err).ToNot(BeNil())
+			err = alice.ExportSession(short, deviceKey, 0)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("LogoutEverywhere stops every exported session from resuming.")
+			err = alicePhone.LogoutEverywhere()
+			Expect(err).To(BeNil())
+			_, err = client.ResumeSession(laptop, deviceKey)
+			Expect(err).ToNot(BeNil())
+			_, err = client.ResumeSession(phone, []byte("correct horse battery staple"))
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Running sessions carry on, and new sessions can be exported.")
+			data, err = aliceLaptop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+			err = alice.ExportSession(laptop, deviceKey, time.Hour)
+			Expect(err).To(BeNil())
+			aliceDesktop, err = client.ResumeSession(laptop, deviceKey)
+			Expect(err).To(BeNil())
+			data, err = aliceDesktop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+		})
+
+	})
+
+	Describe("Device Management Tests", func() {
+
+		Specify("Devices use their own keys and lose access to new invitations once removed", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob, and enrolling two of Alice's devices.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			aliceLaptop, err = alice.AddDevice("laptop")
+			Expect(err).To(BeNil())
+			alicePhone, err = alice.AddDevice("phone")
+			Expect(err).To(BeNil())
+
+			_, err = alice.AddDevice("laptop")
+			Expect(err).ToNot(BeNil())
+			_, err = aliceLaptop.AddDevice("tablet")
+			Expect(err).ToNot(BeNil())
+			err = aliceLaptop.RemoveDevice("phone")
+			Expect(err).ToNot(BeNil())
+
+			devices, err := alicePhone.ListDevices()
+			Expect(err).To(BeNil())
+			Expect(devices).To(HaveLen(2))
+			Expect(devices[0].Name).To(Equal("laptop"))
+			Expect(devices[1].Name).To(Equal("phone"))
+
+			userlib.DebugMsg("A device accepts an invitation with its own key.")
+			err = bob.StoreFile(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := bob.CreateInvitation(bobFile, "alice")
+			Expect(err).To(BeNil())
+			pending, err := alicePhone.PendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(pending).To(HaveLen(1))
+			err = aliceLaptop.AcceptInvitation("bob", invite, aliceFile)
+			Expect(err).To(BeNil())
+			data, err := alicePhone.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("Invitations signed by a device verify against Alice's device list.")
+			err = aliceLaptop.StoreFile(charlesFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			invite, err = aliceLaptop.CreateInvitation(charlesFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+			data, err = bob.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+
+			userlib.DebugMsg("Alice loses her laptop and removes it.")
+			laptopSession := filepath.Join(GinkgoT().TempDir(), "laptop")
+			deviceKey := userlib.RandomBytes(32)
+			err = aliceLaptop.ExportSession(laptopSession, deviceKey, time.Hour)
+			Expect(err).To(BeNil())
+			_, err = client.ResumeSession(laptopSession, deviceKey)
+			Expect(err).To(BeNil())
+			err = alice.RemoveDevice("laptop")
+			Expect(err).To(BeNil())
+			err = alice.RemoveDevice("laptop")
+			Expect(err).ToNot(BeNil())
+			devices, err = alice.ListDevices()
+			Expect(err).To(BeNil())
+			Expect(devices).To(HaveLen(1))
+			_, err = client.ResumeSession(laptopSession, deviceKey)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("New invitations can't be opened by the laptop, only by the phone and the password.")
+			err = bob.StoreFile(dorisFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			invite, err = bob.CreateInvitation(dorisFile, "alice")
+			Expect(err).To(BeNil())
+			err = aliceLaptop.AcceptInvitation("bob", invite, dorisFile)
+			Expect(err).ToNot(BeNil())
+			pending, err = aliceLaptop.PendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(pending).To(BeEmpty())
+			err = alicePhone.AcceptInvitation("bob", invite, dorisFile)
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile(dorisFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentThree)))
+
+			userlib.DebugMsg("The laptop can no longer store or share anything in Alice's name.")
+			err = aliceLaptop.StoreFile(eveFile, []byte(contentTwo))
+			Expect(err).ToNot(BeNil())
+			_, err = aliceLaptop.CreateInvitation(charlesFile, "bob")
+			Expect(err).ToNot(BeNil())
+			pending, err = bob.PendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(pending).To(BeEmpty())
+		})
+
+		Specify("A removed device can't open files stored after it was removed", func() {
+			userlib.DebugMsg("Initializing Alice with a laptop and a phone.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			aliceLaptop, err = alice.AddDevice("laptop")
+			Expect(err).To(BeNil())
+			alicePhone, err = alice.AddDevice("phone")
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			data, err := aliceLaptop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("Alice removes the laptop, which is told nothing about it.")
+			before := make(map[userlib.UUID][]byte)
+			for key, value := range userlib.DatastoreGetMap() {
+				before[key] = value
+			}
+			err = alice.RemoveDevice("laptop")
+			Expect(err).To(BeNil())
+			// the hint that tells sessions the keys changed is the only entry going from 1 to 2;
+			// putting it back makes the laptop carry on with the keys it has, as a laptop
+			// running a client of its own would
+			var hints []userlib.UUID
+			for key, value := range userlib.DatastoreGetMap() {
+				if string(before[key]) == "1" && string(value) == "2" {
+					hints = append(hints, key)
+				}
+			}
+			Expect(hints).To(HaveLen(1))
+			userlib.DatastoreSet(hints[0], []byte("1"))
+
+			userlib.DebugMsg("What Alice stores from now on is out of the laptop's reach.")
+			err = alice.StoreFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			_, err = aliceLaptop.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+			err = aliceLaptop.AppendToFile(bobFile, []byte(contentThree))
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("And whatever the laptop stores never reaches Alice.")
+			err = aliceLaptop.StoreFile(charlesFile, []byte(contentThree))
+			Expect(err).ToNot(BeNil())
+			_, err = alice.LoadFile(charlesFile)
+			Expect(err).ToNot(BeNil())
+			files, err := alice.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(files).To(Equal([]string{aliceFile, bobFile}))
+
+			userlib.DebugMsg("Once the hint is back, the phone picks up the new keys and the laptop can't.")
+			userlib.DatastoreSet(hints[0], []byte("2"))
+			data, err = alicePhone.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+			data, err = alicePhone.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			_, err = aliceLaptop.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+		})
+
+	})
+
+	Describe("Account Recovery Tests", func() {
+
+		Specify("A recovery code sets a new password once", func() {
+			userlib.DebugMsg("Initializing Alice with three recovery codes, and Bob without any.")
+			var codes []string
+			alice, codes, err = client.InitUserWithRecovery("alice", defaultPassword, 3)
+			Expect(err).To(BeNil())
+			Expect(codes).To(HaveLen(3))
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Nothing in Datastore opens the account without a code.")
+			_, err = client.RecoverAccount("alice", "", "new password")
+			Expect(err).ToNot(BeNil())
+			_, err = client.RecoverAccount("alice", "AAAA-AAAA-AAAA-AAAA-AAAA-AAAA-AA", "new password")
+			Expect(err).ToNot(BeNil())
+			_, err = client.RecoverAccount("bob", codes[0], "new password")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Alice forgets her password and recovers with a code.")
+			aliceLaptop, err = client.RecoverAccount("alice", strings.ToLower(codes[1]), "new password")
+			Expect(err).To(BeNil())
+			data, err := aliceLaptop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			err = aliceLaptop.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+
+			_, err = client.GetUser("alice", defaultPassword)
+			Expect(err).ToNot(BeNil())
+			alicePhone, err = client.GetUser("alice", "new password")
+			Expect(err).To(BeNil())
+			data, err = alicePhone.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("A code only works once, but the others still do.")
+			_, err = client.RecoverAccount("alice", codes[1], "another password")
+			Expect(err).ToNot(BeNil())
+			_, err = client.RecoverAccount("alice", codes[2], "another password")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Generating new codes replaces the old ones; devices can't.")
+			_, err = aliceLaptop.AddDevice("laptop")
+			Expect(err).To(BeNil())
+			laptop, err := alicePhone.AddDevice("tablet")
+			Expect(err).To(BeNil())
+			_, err = laptop.GenerateRecoveryCodes(2)
+			Expect(err).ToNot(BeNil())
+			newCodes, err := alicePhone.GenerateRecoveryCodes(2)
+			Expect(err).To(BeNil())
+			_, err = client.RecoverAccount("alice", codes[0], "another password")
+			Expect(err).ToNot(BeNil())
+			aliceDesktop, err = client.RecoverAccount("alice", newCodes[0], "third password")
+			Expect(err).To(BeNil())
+			data, err = aliceDesktop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+		Specify("A recovery key that was swapped is refused", func() {
+			userlib.DebugMsg("Initializing Alice and Bob, each with recovery codes.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			var codes []string
+			recoveryState := func(generate func()) userlib.UUID {
+				before := make(map[userlib.UUID]bool)
+				for key := range userlib.DatastoreGetMap() {
+					before[key] = true
+				}
+				generate()
+				var added []userlib.UUID
+				for key := range userlib.DatastoreGetMap() {
+					if !before[key] {
+						added = append(added, key)
+					}
+				}
+				Expect(added).To(HaveLen(1))
+				return added[0]
+			}
+			aliceState := recoveryState(func() {
+				codes, err = alice.GenerateRecoveryCodes(2)
+				Expect(err).To(BeNil())
+			})
+			bobState := recoveryState(func() {
+				_, err = bob.GenerateRecoveryCodes(1)
+				Expect(err).To(BeNil())
+			})
+
+			userlib.DebugMsg("The Datastore swaps the key in Alice's recovery state for another.")
+			var state, other map[string]interface{}
+			err = json.Unmarshal(userlib.DatastoreGetMap()[aliceState], &state)
+			Expect(err).To(BeNil())
+			err = json.Unmarshal(userlib.DatastoreGetMap()[bobState], &other)
+			Expect(err).To(BeNil())
+			state["Key"] = other["Key"]
+			tampered, err := json.Marshal(state)
+			Expect(err).To(BeNil())
+			userlib.DatastoreSet(aliceState, tampered)
+
+			userlib.DebugMsg("Alice's session refuses it rather than storing her account under it.")
+			_, err = alice.GenerateRecoveryCodes(2)
+			Expect(err).ToNot(BeNil())
+			Expect(userlib.DatastoreGetMap()[aliceState]).To(Equal(tampered))
+
+			userlib.DebugMsg("Her codes don't open a tampered state either, and her password still works.")
+			_, err = client.RecoverAccount("alice", codes[0], "new password")
+			Expect(err).ToNot(BeNil())
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("A used code stays used when the recovery state is replayed", func() {
+			userlib.DebugMsg("Initializing Alice with three recovery codes and Bob as her trustee.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			before := make(map[userlib.UUID]bool)
+			for key := range userlib.DatastoreGetMap() {
+				before[key] = true
+			}
+			codes, err := alice.GenerateRecoveryCodes(3)
+			Expect(err).To(BeNil())
+			var added []userlib.UUID
+			for key := range userlib.DatastoreGetMap() {
+				if !before[key] {
+					added = append(added, key)
+				}
+			}
+			Expect(added).To(HaveLen(1))
+			aliceState := added[0]
+			err = alice.EscrowAccountKey([]string{"bob"}, 1)
+			Expect(err).To(BeNil())
+			escrowed := userlib.DatastoreGetMap()[aliceState]
+
+			userlib.DebugMsg("A recovery that loses the race to swap the state leaves everything as it was.")
+			compareAndSwap := client.DatastoreCompareAndSwap
+			client.DatastoreCompareAndSwap = func(key userlib.UUID, old []byte, value []byte) bool {
+				return false
+			}
+			_, err = client.RecoverAccount("alice", codes[0], "new password")
+			client.DatastoreCompareAndSwap = compareAndSwap
+			Expect(err).ToNot(BeNil())
+			_, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice recovers with a code; the Datastore then replays the state from before.")
+			aliceLaptop, err = client.RecoverAccount("alice", codes[0], "new password")
+			Expect(err).To(BeNil())
+			userlib.DatastoreSet(aliceState, escrowed)
+			_, err = client.RecoverAccount("alice", codes[0], "another password")
+			Expect(err).ToNot(BeNil())
+			aliceLaptop, err = client.GetUser("alice", "new password")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Stripping the escrow out of the state is noticed.")
+			var state map[string]interface{}
+			err = json.Unmarshal(escrowed, &state)
+			Expect(err).To(BeNil())
+			delete(state, "Escrow")
+			stripped, err := json.Marshal(state)
+			Expect(err).To(BeNil())
+			userlib.DatastoreSet(aliceState, stripped)
+			_, err = client.RecoverAccount("alice", codes[1], "another password")
+			Expect(err).ToNot(BeNil())
+			_, err = aliceLaptop.GenerateRecoveryCodes(1)
+			Expect(err).ToNot(BeNil())
+			aliceLaptop, err = client.GetUser("alice", "new password")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("The state as it was still opens with an unused code.")
+			userlib.DatastoreSet(aliceState, escrowed)
+			_, err = client.RecoverAccount("alice", codes[1], "another password")
+			Expect(err).To(BeNil())
+		})
+
+	})
+
+	Describe("Key Escrow Tests", func() {
+
+		Specify("Any two of three trustees can restore Alice's account", func() {
+			userlib.DebugMsg("Initializing Alice and her trustees Bob, Charles and Doris.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+			eve, err = client.InitUser("eve", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			err = alice.EscrowAccountKey([]string{"bob", "charles", "doris"}, 4)
+			Expect(err).ToNot(BeNil())
+			err = alice.EscrowAccountKey([]string{"bob", "bob"}, 1)
+			Expect(err).ToNot(BeNil())
+			err = alice.EscrowAccountKey([]string{"bob", "charles", "doris"}, 2)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("One share isn't enough, and only trustees have one.")
+			recovery, err := client.StartEscrowRecovery("alice")
+			Expect(err).To(BeNil())
+			err = eve.ReleaseEscrowShare("alice", recovery.ID)
+			Expect(err).ToNot(BeNil())
+			err = doris.ReleaseEscrowShare("alice", recovery.ID)
+			Expect(err).To(BeNil())
+			_, err = recovery.Complete("new password")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("A request whose key was swapped is refused by trustees.")
+			other, err := client.StartEscrowRecovery("alice")
+			Expect(err).To(BeNil())
+			userlib.DatastoreSet(recovery.ID, userlib.DatastoreGetMap()[other.ID])
+			err = bob.ReleaseEscrowShare("alice", recovery.ID)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Two trustees release their shares and Alice sets a new password.")
+			recovery, err = client.StartEscrowRecovery("alice")
+			Expect(err).To(BeNil())
+			err = bob.ReleaseEscrowShare("alice", recovery.ID)
+			Expect(err).To(BeNil())
+			err = doris.ReleaseEscrowShare("alice", recovery.ID)
+			Expect(err).To(BeNil())
+			aliceLaptop, err = recovery.Complete("new password")
+			Expect(err).To(BeNil())
+			data, err := aliceLaptop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			_, err = client.GetUser("alice", defaultPassword)
+			Expect(err).ToNot(BeNil())
+			alicePhone, err = client.GetUser("alice", "new password")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Escrowing again with other trustees leaves the old shares useless.")
+			err = alicePhone.EscrowAccountKey([]string{"bob", "eve"}, 2)
+			Expect(err).To(BeNil())
+			recovery, err = client.StartEscrowRecovery("alice")
+			Expect(err).To(BeNil())
+			err = charles.ReleaseEscrowShare("alice", recovery.ID)
+			Expect(err).ToNot(BeNil())
+			err = bob.ReleaseEscrowShare("alice", recovery.ID)
+			Expect(err).To(BeNil())
+			_, err = recovery.Complete("third password")
+			Expect(err).ToNot(BeNil())
+			err = eve.ReleaseEscrowShare("alice", recovery.ID)
+			Expect(err).To(BeNil())
+			aliceDesktop, err = recovery.Complete("third password")
+			Expect(err).To(BeNil())
+			data, err = aliceDesktop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+		Specify("A recovery key that was swapped is never escrowed", func() {
+			userlib.DebugMsg("Initializing Alice, Bob and Charles; Alice and Charles set up recovery.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			before := make(map[userlib.UUID]bool)
+			for key := range userlib.DatastoreGetMap() {
+				before[key] = true
+			}
+			_, err = alice.GenerateRecoveryCodes(1)
+			Expect(err).To(BeNil())
+			var aliceState userlib.UUID
+			for key := range userlib.DatastoreGetMap() {
+				if !before[key] {
+					aliceState = key
+					before[key] = true
+				}
+			}
+			_, err = charles.GenerateRecoveryCodes(1)
+			Expect(err).To(BeNil())
+			var charlesState userlib.UUID
+			for key := range userlib.DatastoreGetMap() {
+				if !before[key] {
+					charlesState = key
+				}
+			}
+
+			userlib.DebugMsg("The Datastore swaps the key in Alice's recovery state for another.")
+			var state, other map[string]interface{}
+			err = json.Unmarshal(userlib.DatastoreGetMap()[aliceState], &state)
+			Expect(err).To(BeNil())
+			err = json.Unmarshal(userlib.DatastoreGetMap()[charlesState], &other)
+			Expect(err).To(BeNil())
+			state["Key"] = other["Key"]
+			tampered, err := json.Marshal(state)
+			Expect(err).To(BeNil())
+			userlib.DatastoreSet(aliceState, tampered)
+
+			userlib.DebugMsg("Escrowing refuses it, and no trustee is handed a share.")
+			entries := len(userlib.DatastoreGetMap())
+			err = alice.EscrowAccountKey([]string{"bob", "charles"}, 1)
+			Expect(err).ToNot(BeNil())
+			Expect(len(userlib.DatastoreGetMap())).To(Equal(entries))
+			Expect(userlib.DatastoreGetMap()[aliceState]).To(Equal(tampered))
+			_, err = client.StartEscrowRecovery("alice")
+			Expect(err).ToNot(BeNil())
+		})
+
+	})
+
+	Describe("Key Pinning Tests", func() {
+
+		Specify("Changed keys are refused until the new fingerprint is trusted", func() {
+			// without the key log, only the pins notice the Keystore changing keys
+			client.KeyTransparencyLog = nil
+			userlib.DebugMsg("Initializing users Alice, Bob and Eve.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			eve, err = client.InitUser("eve", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice and Bob see the same fingerprint for Bob's keys.")
+			fingerprint, err := alice.Fingerprint("bob")
+			Expect(err).To(BeNil())
+			own, err := bob.Fingerprint("bob")
+			Expect(err).To(BeNil())
+			Expect(fingerprint).To(Equal(own))
+			other, err := alice.Fingerprint("eve")
+			Expect(err).To(BeNil())
+			Expect(other).ToNot(Equal(fingerprint))
+			_, err = alice.Fingerprint("nobody")
+			Expect(err).ToNot(BeNil())
+
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("The Keystore swaps in Eve's keys for Bob's.")
+			keystore := userlib.KeystoreGetMap()
+			bobEnc, bobSign := keystore["bobshareenc"], keystore["bobsharesign"]
+			keystore["bobshareenc"], keystore["bobsharesign"] = keystore["eveshareenc"], keystore["evesharesign"]
+			err = alice.StoreFile(aliceFile+"2", []byte(contentTwo))
+			Expect(err).To(BeNil())
+			_, err = alice.CreateInvitation(aliceFile+"2", "bob")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Trusting the new keys takes their fingerprint.")
+			err = alice.TrustKeys("bob", fingerprint)
+			Expect(err).ToNot(BeNil())
+			err = alice.TrustKeys("bob", other)
+			Expect(err).To(BeNil())
+			_, err = alice.CreateInvitation(aliceFile+"2", "bob")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Once the real keys are back, Alice has to trust them again.")
+			keystore["bobshareenc"], keystore["bobsharesign"] = bobEnc, bobSign
+			_, err = alice.CreateInvitation(aliceFile+"2", "bob")
+			Expect(err).ToNot(BeNil())
+			err = alice.TrustKeys("bob", strings.ToLower(fingerprint))
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitation(aliceFile+"2", "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile+"2")
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile(bobFile + "2")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+		})
+
+		Specify("Pins that go missing are noticed", func() {
+			client.KeyTransparencyLog = nil
+			userlib.DebugMsg("Initializing users Alice, Bob and Eve.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			eve, err = client.InitUser("eve", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice pins Bob's keys, which adds a bucket and changes the pin index.")
+			before := make(map[userlib.UUID][]byte)
+			for key, value := range userlib.DatastoreGetMap() {
+				before[key] = value
+			}
+			fingerprint, err := alice.Fingerprint("bob")
+			Expect(err).To(BeNil())
+			err = alice.TrustKeys("bob", fingerprint)
+			Expect(err).To(BeNil())
+			var added, changed []userlib.UUID
+			for key, value := range userlib.DatastoreGetMap() {
+				previous, ok := before[key]
+				if !ok {
+					added = append(added, key)
+				} else if string(previous) != string(value) {
+					changed = append(changed, key)
+				}
+			}
+			Expect(added).To(HaveLen(1))
+			Expect(changed).To(HaveLen(1))
+
+			userlib.DebugMsg("The Keystore swaps in Eve's keys for Bob's.")
+			keystore := userlib.KeystoreGetMap()
+			keystore["bobshareenc"], keystore["bobsharesign"] = keystore["eveshareenc"], keystore["evesharesign"]
+
+			userlib.DebugMsg("Deleting the bucket or rolling back the index doesn't bring back trust on first use.")
+			bucket := userlib.DatastoreGetMap()[added[0]]
+			userlib.DatastoreDelete(added[0])
+			_, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).ToNot(BeNil())
+			userlib.DatastoreSet(added[0], bucket)
+			userlib.DatastoreDelete(changed[0])
+			_, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).ToNot(BeNil())
+			userlib.DatastoreSet(changed[0], before[changed[0]])
+			_, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).ToNot(BeNil())
+		})
+
+	})
+
+	Describe("Key Transparency Tests", func() {
+
+		Specify("Keys must be in the log, and the log can only grow", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, Charles and Eve.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			eve, err = client.InitUser("eve", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Keys the log doesn't have are refused even on first contact.")
+			keystore := userlib.KeystoreGetMap()
+			bobEnc, bobSign := keystore["bobshareenc"], keystore["bobsharesign"]
+			keystore["bobshareenc"], keystore["bobsharesign"] = keystore["eveshareenc"], keystore["evesharesign"]
+			err = charles.StoreFile(charlesFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			_, err = charles.CreateInvitation(charlesFile, "bob")
+			Expect(err).ToNot(BeNil())
+			keystore["bobshareenc"], keystore["bobsharesign"] = bobEnc, bobSign
+
+			userlib.DebugMsg("A log that drops entries or reorders them is refused.")
+			real := client.KeyTransparencyLog.(*client.LocalKeyLog)
+			entries := real.Entries()
+			client.KeyTransparencyLog = client.NewLocalKeyLog(entries[:2])
+			_, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).ToNot(BeNil())
+			client.KeyTransparencyLog = client.NewLocalKeyLog([][]byte{entries[0], entries[1], entries[3], entries[2]})
+			_, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).ToNot(BeNil())
+			client.KeyTransparencyLog = client.NewLocalKeyLog([][]byte{entries[0], entries[1], entries[3], entries[2], entries[0]})
+			_, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Bob notices when the log leaves out his keys.")
+			client.KeyTransparencyLog = client.NewLocalKeyLog([][]byte{entries[0], entries[2], entries[3], entries[0]})
+			_, err = client.GetUser("bob", defaultPassword)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("The real log keeps working as it grows.")
+			client.KeyTransparencyLog = real
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitation(aliceFile, "doris")
+			Expect(err).To(BeNil())
+			err = doris.AcceptInvitation("alice", invite, dorisFile)
+			Expect(err).To(BeNil())
+			bob, err = client.GetUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+		Specify("A log head that goes missing is noticed", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice logs in again and sees Bob's registration, which changes only her log head.")
+			before := make(map[userlib.UUID][]byte)
+			for key, value := range userlib.DatastoreGetMap() {
+				before[key] = value
+			}
+			alice, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			var changed []userlib.UUID
+			for key, value := range userlib.DatastoreGetMap() {
+				if string(before[key]) != string(value) {
+					changed = append(changed, key)
+				}
+			}
+			Expect(changed).To(HaveLen(1))
+
+			userlib.DebugMsg("Deleting the head doesn't let a log that rewrote its history through.")
+			entries := client.KeyTransparencyLog.(*client.LocalKeyLog).Entries()
+			client.KeyTransparencyLog = client.NewLocalKeyLog([][]byte{entries[1], entries[0]})
+			_, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).ToNot(BeNil())
+			userlib.DatastoreDelete(changed[0])
+			_, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).ToNot(BeNil())
+			_, err = client.GetUser("alice", defaultPassword)
+			Expect(err).ToNot(BeNil())
+		})
+
+	})
+
+	Describe("Key Rotation Tests", func() {
+
+		Specify("Rotated keys are used from then on and old signatures still verify", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, Charles and Eve.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			eve, err = client.InitUser("eve", defaultPassword)
+			Expect(err).To(BeNil())
+			aliceLaptop, err = alice.AddDevice("laptop")
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			fingerprint, err := alice.Fingerprint("bob")
+			Expect(err).To(BeNil())
+			oldInvite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice and Bob rotate their keys; Alice's laptop can't.")
+			err = bob.RotateKeys()
+			Expect(err).To(BeNil())
+			err = alice.RotateKeys()
+			Expect(err).To(BeNil())
+			err = aliceLaptop.RotateKeys()
+			Expect(err).ToNot(BeNil())
+			keystore := userlib.KeystoreGetMap()
+			Expect(keystore).To(HaveKey("bobshareenc/v2"))
+			Expect(keystore).To(HaveKey("alicesharesign/v2"))
+			Expect(keystore).ToNot(HaveKey("alicesharesign/v3"))
+			Expect(alice.Fingerprint("bob")).To(Equal(fingerprint))
+
+			userlib.DebugMsg("The invitation from before the rotation still opens and verifies.")
+			err = bob.AcceptInvitation("alice", oldInvite, bobFile)
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("Bob rotates again and logs in afresh; his new invitation reaches Alice's laptop.")
+			err = bob.RotateKeys()
+			Expect(err).To(BeNil())
+			Expect(keystore).To(HaveKey("bobsharesign/v3"))
+			bob, err = client.GetUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = bob.StoreFile(bobFile+"2", []byte(contentTwo))
+			Expect(err).To(BeNil())
+			invite, err := bob.CreateInvitation(bobFile+"2", "alice")
+			Expect(err).To(BeNil())
+			err = aliceLaptop.AcceptInvitation("bob", invite, aliceFile+"2")
+			Expect(err).To(BeNil())
+			data, err = aliceLaptop.LoadFile(aliceFile + "2")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+			err = bob.AppendToFile(bobFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentThree)))
+
+			userlib.DebugMsg("A version without a statement signed by the one before is refused.")
+			keystore["charlesshareenc/v2"] = keystore["eveshareenc"]
+			keystore["charlessharesign/v2"] = keystore["evesharesign"]
+			_, err = alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("A rotation that stops partway is finished later", func() {
+			userlib.DebugMsg("Initializing Alice with a laptop, and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			aliceLaptop, err = alice.AddDevice("laptop")
+			Expect(err).To(BeNil())
+			err = bob.StoreFile(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice's keys are published, but the key log can't be reached.")
+			log := client.KeyTransparencyLog
+			client.KeyTransparencyLog = unreachableKeyLog{log}
+			err = alice.RotateKeys()
+			client.KeyTransparencyLog = log
+			Expect(err).ToNot(BeNil())
+			Expect(userlib.KeystoreGetMap()).To(HaveKey("aliceshareenc/v2"))
+			_, err = bob.CreateInvitation(bobFile, "alice")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Logging in again finishes the rotation, device list included.")
+			alice, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			invite, err := bob.CreateInvitation(bobFile, "alice")
+			Expect(err).To(BeNil())
+			err = aliceLaptop.AcceptInvitation("bob", invite, aliceFile)
+			Expect(err).To(BeNil())
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("Rotating again picks up where that left off.")
+			err = alice.RotateKeys()
+			Expect(err).To(BeNil())
+			Expect(userlib.KeystoreGetMap()).To(HaveKey("alicesharesign/v3"))
+			invite, err = bob.CreateInvitation(bobFile, "alice")
+			Expect(err).To(BeNil())
+			err = aliceLaptop.AcceptInvitation("bob", invite, aliceFile+"2")
+			Expect(err).To(BeNil())
+		})
+
+	})
+
+	Describe("Access Listing Tests", func() {
+
+		Specify("Listing access as the owner and as a recipient", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, and Charlie.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice storing file %s, checking that only Alice has access.", aliceFile)
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			entries, err := alice.ListAccess(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].Recipient).To(Equal("alice"))
+			Expect(entries[0].Permission).To(Equal(client.PermissionOwner))
+
+			userlib.DebugMsg("Alice shares with Bob, Bob shares with Charles.")
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			invite, err = bob.CreateInvitation(bobFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("bob", invite, charlesFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Checking Alice's view of the file's access.")
+			entries, err = alice.ListAccess(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(3))
+			Expect(entries[1].Recipient).To(Equal("bob"))
+			Expect(entries[1].InvitedBy).To(Equal("alice"))
+			Expect(entries[1].Permission).To(Equal(client.PermissionReadWrite))
+			Expect(entries[1].Invited.IsZero()).To(BeFalse())
+			Expect(entries[2].Recipient).To(Equal("charles"))
+			Expect(entries[2].InvitedBy).To(Equal("bob"))
+
+			userlib.DebugMsg("Checking that Charles can see who owns the file.")
+			entries, err = charles.ListAccess(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(entries[0].Recipient).To(Equal("alice"))
+			Expect(entries[0].Permission).To(Equal(client.PermissionOwner))
+			Expect(entries[1].Recipient).To(Equal("charles"))
+			Expect(entries[1].InvitedBy).To(Equal("bob"))
+
+			userlib.DebugMsg("Alice revokes Bob; only Alice remains.")
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			entries, err = alice.ListAccess(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(1))
+			_, err = charles.ListAccess(charlesFile)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Sub-shares made at the same time are all listed", func() {
+			userlib.DebugMsg("Initializing Alice, Bob on his phone and laptop, Charles and Doris.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			bobLaptop, err := client.GetUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			// whatever Alice's invitation adds includes the filestruct Bob records sub-shares in
+			before := make(map[userlib.UUID]bool)
+			for key := range userlib.DatastoreGetMap() {
+				before[key] = true
+			}
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			added := make(map[userlib.UUID]bool)
+			for key := range userlib.DatastoreGetMap() {
+				if !before[key] {
+					added[key] = true
+				}
+			}
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob's laptop invites Doris while his phone is inviting Charles.")
+			compareAndSwap := client.DatastoreCompareAndSwap
+			defer func() { client.DatastoreCompareAndSwap = compareAndSwap }()
+			client.DatastoreCompareAndSwap = func(key userlib.UUID, old []byte, value []byte) bool {
+				if added[key] {
+					client.DatastoreCompareAndSwap = compareAndSwap
+					_, err := bobLaptop.CreateInvitation(bobFile, "doris")
+					Expect(err).To(BeNil())
+				}
+				return compareAndSwap(key, old, value)
+			}
+			_, err = bob.CreateInvitation(bobFile, "charles")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice sees both of them.")
+			entries, err := alice.ListAccess(aliceFile)
+			Expect(err).To(BeNil())
+			var recipients []string
+			for _, entry := range entries {
+				recipients = append(recipients, entry.Recipient)
+			}
+			Expect(recipients).To(ConsistOf("alice", "bob", "charles", "doris"))
+		})
+
+	})
+
+	Describe("Invitation Inbox Tests", func() {
+
+		Specify("Sharing a file with nothing but usernames", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Checking that Bob's inbox starts empty.")
+			pending, err := bob.PendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(pending).To(BeEmpty())
+
+			userlib.DebugMsg("Alice shares two files with Bob.")
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(charlesFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			_, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			_, err = alice.CreateInvitation(charlesFile, "bob")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob finds both invitations in his inbox.")
+			pending, err = bob.PendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(pending).To(HaveLen(2))
+			Expect(pending[0].Sender).To(Equal("alice"))
+			Expect(pending[0].Filename).To(Equal(aliceFile))
+			Expect(pending[1].Filename).To(Equal(charlesFile))
+
+			userlib.DebugMsg("Bob accepts the first and declines the second.")
+			err = bob.AcceptInvitation(pending[0].Sender, pending[0].Invitation, bobFile)
+			Expect(err).To(BeNil())
+			err = bob.DeclineInvitation(pending[1].Sender, pending[1].Invitation)
+			Expect(err).To(BeNil())
+
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			err = bob.AcceptInvitation(pending[1].Sender, pending[1].Invitation, charlesFile)
+			Expect(err).ToNot(BeNil())
+			err = bob.DeclineInvitation(pending[1].Sender, pending[1].Invitation)
+			Expect(err).ToNot(BeNil())
+
+			pending, err = bob.PendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(pending).To(BeEmpty())
+		})
+
+		Specify("Declining an invitation drops the user from the access list", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, Charles and Doris.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice invites Bob and Charles; Charles accepts and invites Doris.")
+			bobInvite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+			dorisInvite, err := charles.CreateInvitation(charlesFile, "doris")
+			Expect(err).To(BeNil())
+			entries, err := alice.ListAccess(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(4))
+
+			userlib.DebugMsg("Bob and Doris decline; only Alice and Charles are listed.")
+			err = bob.DeclineInvitation("alice", bobInvite)
+			Expect(err).To(BeNil())
+			err = doris.DeclineInvitation("charles", dorisInvite)
+			Expect(err).To(BeNil())
+			for _, lister := range []func() ([]client.AccessEntry, error){
+				func() ([]client.AccessEntry, error) { return alice.ListAccess(aliceFile) },
+				func() ([]client.AccessEntry, error) { return charles.ListAccess(charlesFile) },
+			} {
+				entries, err = lister()
+				Expect(err).To(BeNil())
+				Expect(entries).To(HaveLen(2))
+				Expect(entries[0].Recipient).To(Equal("alice"))
+				Expect(entries[1].Recipient).To(Equal("charles"))
+			}
+			err = alice.TransferOwnership(aliceFile, "bob", false)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Alice can still revoke Charles and write to the file.")
+			err = alice.RevokeAccess(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			entries, err = alice.ListAccess(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(1))
+		})
+
+		Specify("Inbox entries cannot be read by others or forged", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			_, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Charles sees nothing in his own inbox.")
+			pending, err := charles.PendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(pending).To(BeEmpty())
+
+			userlib.DebugMsg("Injecting a junk entry into Bob's inbox.")
+			datastore := userlib.DatastoreGetMap()
+			for key, value := range datastore {
+				if len(value) > 2 && value[0] == '[' {
+					datastore[key] = append([]byte(`["AAAA",`), value[1:]...)
+				}
+			}
+			pending, err = bob.PendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(pending).To(HaveLen(1))
+			Expect(pending[0].Sender).To(Equal("alice"))
+		})
+
+		Specify("Invitations arriving while the inbox is being changed are kept", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(dorisFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = bob.StoreFile(bobFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			err = bob.StoreFile(eveFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			first, err := alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+
+			// the other session gets in right before the inbox is swapped
+			compareAndSwap := client.DatastoreCompareAndSwap
+			defer func() { client.DatastoreCompareAndSwap = compareAndSwap }()
+			interleave := func(other func()) {
+				client.DatastoreCompareAndSwap = func(key userlib.UUID, old []byte, value []byte) bool {
+					if len(old) > 0 && old[0] == '[' {
+						client.DatastoreCompareAndSwap = compareAndSwap
+						other()
+					}
+					return compareAndSwap(key, old, value)
+				}
+			}
+
+			userlib.DebugMsg("Alice and Bob invite Charles at the same time.")
+			interleave(func() {
+				_, err := bob.CreateInvitation(bobFile, "charles")
+				Expect(err).To(BeNil())
+			})
+			_, err = alice.CreateInvitation(dorisFile, "charles")
+			Expect(err).To(BeNil())
+			pending, err := charles.PendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(pending).To(HaveLen(3))
+
+			userlib.DebugMsg("Bob invites Charles while Charles declines Alice's first invitation.")
+			interleave(func() {
+				_, err := bob.CreateInvitation(eveFile, "charles")
+				Expect(err).To(BeNil())
+			})
+			err = charles.DeclineInvitation("alice", first)
+			Expect(err).To(BeNil())
+			pending, err = charles.PendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(pending).To(HaveLen(3))
+			for _, invitation := range pending {
+				Expect(invitation.Invitation).ToNot(Equal(first))
+			}
+		})
+
+	})
+
+	Describe("Group Sharing Tests", func() {
+
+		Specify("Sharing with a group, adding and removing members", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, Charles, and Doris.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+			_, err = client.InitUser(client.GroupPrefix+"team", defaultPassword)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Alice creates group team with Bob and Charles.")
+			err = alice.CreateGroup("team")
+			Expect(err).To(BeNil())
+			err = alice.CreateGroup("team")
+			Expect(err).ToNot(BeNil())
+			err = alice.AddMember("team", "bob")
+			Expect(err).To(BeNil())
+			err = alice.AddMember("team", "charles")
+			Expect(err).To(BeNil())
+			err = alice.AddMember("team", "charles")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Alice shares %s with the group.", aliceFile)
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, client.GroupPrefix+"team")
+			Expect(err).To(BeNil())
+			_, err = alice.CreateInvitation(aliceFile, client.GroupPrefix+"team")
+			Expect(err).ToNot(BeNil())
+			_, err = alice.CreateInvitation(aliceFile, client.GroupPrefix+"nobody")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Bob and Charles accept the group invitation.")
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			pending, err := charles.PendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(pending).To(HaveLen(1))
+			Expect(pending[0].Invitation).To(Equal(invite))
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+			err = doris.AcceptInvitation("alice", invite, dorisFile)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Bob appends and Charles sees the change.")
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err := charles.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+			_, err = bob.CreateInvitation(bobFile, "doris")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Doris joins the group later and picks up the file from her inbox.")
+			err = alice.AddMember("team", "doris")
+			Expect(err).To(BeNil())
+			pending, err = doris.PendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(pending).To(HaveLen(1))
+			err = doris.AcceptInvitation(pending[0].Sender, pending[0].Invitation, dorisFile)
+			Expect(err).To(BeNil())
+			data, err = doris.LoadFile(dorisFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+
+			entries, err := alice.ListAccess(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(5))
+			Expect(entries[1].Recipient).To(Equal(client.GroupPrefix + "team"))
+			Expect(entries[2].InvitedBy).To(Equal(client.GroupPrefix + "team"))
+
+			userlib.DebugMsg("Alice removes Bob from the group.")
+			err = alice.RemoveMember("team", "bob")
+			Expect(err).To(BeNil())
+			err = alice.RemoveMember("team", "bob")
+			Expect(err).ToNot(BeNil())
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+			err = bob.AppendToFile(bobFile, []byte(contentThree))
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Charles and Doris keep access.")
+			err = charles.AppendToFile(charlesFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			data, err = doris.LoadFile(dorisFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+
+			userlib.DebugMsg("Alice revokes the whole group.")
+			err = alice.RevokeAccess(aliceFile, client.GroupPrefix+"team")
+			Expect(err).To(BeNil())
+			_, err = charles.LoadFile(charlesFile)
+			Expect(err).ToNot(BeNil())
+			_, err = doris.LoadFile(dorisFile)
+			Expect(err).ToNot(BeNil())
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+		})
+
+		Specify("A removal that stops partway is finished by trying again", func() {
+			userlib.DebugMsg("Initializing Alice on her laptop and phone, Bob, and Charles.")
+			aliceLaptop, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			alicePhone, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice shares two files with a group of Bob and Charles.")
+			err = aliceLaptop.CreateGroup("team")
+			Expect(err).To(BeNil())
+			Expect(aliceLaptop.AddMember("team", "bob")).To(BeNil())
+			Expect(aliceLaptop.AddMember("team", "charles")).To(BeNil())
+			for _, filename := range []string{aliceFile, dorisFile} {
+				err = aliceLaptop.StoreFile(filename, []byte(contentOne))
+				Expect(err).To(BeNil())
+				invite, err := aliceLaptop.CreateInvitation(filename, client.GroupPrefix+"team")
+				Expect(err).To(BeNil())
+				Expect(bob.AcceptInvitation("alice", invite, "bob"+filename)).To(BeNil())
+				Expect(charles.AcceptInvitation("alice", invite, "charles"+filename)).To(BeNil())
+			}
+
+			userlib.DebugMsg("Removing Bob fails while Alice's phone has one of the files locked.")
+			err = alicePhone.LockFile(dorisFile, time.Minute)
+			Expect(err).To(BeNil())
+			err = aliceLaptop.RemoveMember("team", "bob")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Once the phone unlocks it, trying again finishes the removal.")
+			err = alicePhone.UnlockFile(dorisFile)
+			Expect(err).To(BeNil())
+			err = aliceLaptop.RemoveMember("team", "bob")
+			Expect(err).To(BeNil())
+			err = aliceLaptop.RemoveMember("team", "bob")
+			Expect(err).ToNot(BeNil())
+			for _, filename := range []string{aliceFile, dorisFile} {
+				err = aliceLaptop.AppendToFile(filename, []byte(contentTwo))
+				Expect(err).To(BeNil())
+				_, err = bob.LoadFile("bob" + filename)
+				Expect(err).ToNot(BeNil())
+				data, err := charles.LoadFile("charles" + filename)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+			}
+		})
+
+	})
+
+	Describe("Ownership Transfer Tests", func() {
+
+		Specify("Transferring ownership and revoking as the new owner", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, Charles, and Doris.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice shares %s with Bob and Charles.", aliceFile)
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Only users with access can receive the file, and only the owner can give it.")
+			err = alice.TransferOwnership(aliceFile, "doris", true)
+			Expect(err).ToNot(BeNil())
+			err = charles.TransferOwnership(charlesFile, "bob", true)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Alice transfers the file to Bob, keeping access.")
+			err = alice.TransferOwnership(aliceFile, "bob", true)
+			Expect(err).To(BeNil())
+			pending, err := bob.PendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(pending).To(HaveLen(1))
+			Expect(pending[0].Transfer).To(BeTrue())
+			err = charles.AcceptOwnership("alice", pending[0].Invitation, charlesFile)
+			Expect(err).ToNot(BeNil())
+			err = bob.AcceptOwnership("alice", pending[0].Invitation, bobFile)
+			Expect(err).To(BeNil())
+
+			entries, err := bob.ListAccess(bobFile)
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(3))
+			Expect(entries[0].Recipient).To(Equal("bob"))
+			Expect(entries[1].Recipient).To(Equal("alice"))
+			Expect(entries[1].InvitedBy).To(Equal("bob"))
+			entries, err = charles.ListAccess(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(entries[0].Recipient).To(Equal("bob"))
+
+			userlib.DebugMsg("Alice can no longer revoke, but Bob can.")
+			err = alice.RevokeAccess(aliceFile, "charles")
+			Expect(err).ToNot(BeNil())
+			err = bob.RevokeAccess(bobFile, "charles")
+			Expect(err).To(BeNil())
+			_, err = charles.LoadFile(charlesFile)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Alice still has ordinary access.")
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+		})
+
+		Specify("Transferring ownership without keeping access", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			err = alice.TransferOwnership(aliceFile, "bob", false)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice keeps the file until Bob accepts it.")
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			entries, err := alice.ListAccess(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(2))
+
+			pending, err := bob.PendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(pending).To(HaveLen(1))
+			userlib.DebugMsg("Bob accepts without deleting anything of Alice's.")
+			before := make(map[userlib.UUID]bool)
+			for key := range userlib.DatastoreGetMap() {
+				before[key] = true
+			}
+			err = bob.AcceptOwnership("alice", pending[0].Invitation, bobFile)
+			Expect(err).To(BeNil())
+			for key := range before {
+				_, ok := userlib.DatastoreGetMap()[key]
+				Expect(ok).To(BeTrue())
+			}
+			data, err = bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			err = bob.AcceptOwnership("alice", pending[0].Invitation, bobFile)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Alice's next session finishes the handoff.")
+			alice, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+			_, err = alice.ListAccess(aliceFile)
+			Expect(err).ToNot(BeNil())
+			files, err := alice.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(files).To(BeEmpty())
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err = bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+		})
+
+		Specify("A note accepting another transfer doesn't finish a handoff", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			for _, filename := range []string{aliceFile, charlesFile} {
+				err = alice.StoreFile(filename, []byte(contentOne))
+				Expect(err).To(BeNil())
+				for _, recipient := range []*client.User{bob, charles} {
+					invite, err := alice.CreateInvitation(filename, recipient.Username)
+					Expect(err).To(BeNil())
+					err = recipient.AcceptInvitation("alice", invite, recipient.Username+filename)
+					Expect(err).To(BeNil())
+				}
+			}
+
+			userlib.DebugMsg("Alice offers one file to Bob and the other to Charles, who accepts.")
+			err = alice.TransferOwnership(aliceFile, "bob", false)
+			Expect(err).To(BeNil())
+			offered, err := bob.PendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(offered).To(HaveLen(1))
+			err = alice.TransferOwnership(charlesFile, "charles", false)
+			Expect(err).To(BeNil())
+			pending, err := charles.PendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(pending).To(HaveLen(1))
+			err = charles.AcceptOwnership("alice", pending[0].Invitation, "charles"+charlesFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("The server copies Charles's note over the offer to Bob.")
+			userlib.DatastoreSet(offered[0].Invitation, userlib.DatastoreGetMap()[pending[0].Invitation])
+
+			userlib.DebugMsg("Alice's next session only finishes the handoff to Charles.")
+			alice, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			_, err = alice.LoadFile(charlesFile)
+			Expect(err).ToNot(BeNil())
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			entries, err := alice.ListAccess(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(3))
+		})
+
+		Specify("A transfer that is declined or overtaken leaves the owner in charge", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob declines the transfer, and Alice can still share and revoke.")
+			err = alice.TransferOwnership(aliceFile, "bob", true)
+			Expect(err).To(BeNil())
+			pending, err := bob.PendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(pending).To(HaveLen(1))
+			err = bob.DeclineInvitation("alice", pending[0].Invitation)
+			Expect(err).To(BeNil())
+			err = bob.AcceptOwnership("alice", pending[0].Invitation, bobFile)
+			Expect(err).ToNot(BeNil())
+			invite, err = alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+			entries, err := alice.ListAccess(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(3))
+
+			userlib.DebugMsg("Alice offers the file again but shares it before Bob accepts.")
+			err = alice.TransferOwnership(aliceFile, "bob", false)
+			Expect(err).To(BeNil())
+			pending, err = bob.PendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(pending).To(HaveLen(1))
+			err = alice.RevokeAccess(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = bob.AcceptOwnership("alice", pending[0].Invitation, bobFile)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("The file is still Alice's to manage.")
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+	})
 })
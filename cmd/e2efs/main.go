@@ -0,0 +1,365 @@
+// Command e2efs stores, shares and revokes end-to-end encrypted files from the command line,
+// using the client package with a Datastore and Keystore kept in a local directory.
+//
+//	eval "$(e2efs init alice)"
+//	e2efs put notes.txt ./notes.txt
+//	e2efs share notes.txt bob
+//
+// The directory defaults to ~/.e2efs and can be changed with -dir or E2EFS_DIR.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+
+	"github.com/cs161-staff/project2-starter-code/client"
+)
+
+type app struct {
+	dir      string
+	lifetime time.Duration
+	stdin    io.Reader
+	stdout   io.Writer
+	stderr   io.Writer
+	getenv   func(string) string
+	password func(prompt string) (string, error)
+}
+
+type command struct {
+	args  string
+	help  string
+	nargs []int
+	run   func(a *app, args []string) error
+}
+
+var commands = map[string]command{
+	"init":        {"USERNAME", "create a user and log in as them", []int{1}, (*app).initUser},
+	"login":       {"USERNAME", "log in as an existing user", []int{1}, (*app).login},
+	"logout":      {"[-everywhere]", "forget the saved session, or every session of the user", []int{0, 1}, (*app).logout},
+	"put":         {"NAME [FILE]", "store FILE (or stdin) as NAME, replacing its content", []int{1, 2}, (*app).put},
+	"get":         {"NAME [FILE]", "write the content of NAME to FILE (or stdout)", []int{1, 2}, (*app).get},
+	"append":      {"NAME [FILE]", "append FILE (or stdin) to NAME", []int{1, 2}, (*app).append},
+	"share":       {"NAME USERNAME", "invite USERNAME to NAME and print the invitation", []int{2}, (*app).share},
+	"invitations": {"", "list invitations waiting to be accepted", []int{0}, (*app).invitations},
+	"accept":      {"SENDER INVITATION NAME", "accept an invitation, saving the file as NAME", []int{3}, (*app).accept},
+	"revoke":      {"NAME USERNAME", "revoke USERNAME's access to NAME", []int{2}, (*app).revoke},
+	"ls":          {"", "list your files", []int{0}, (*app).list},
+	"rm":          {"NAME", "delete NAME", []int{1}, (*app).remove},
+	"fingerprint": {"USERNAME", "print the fingerprint of USERNAME's public keys", []int{1}, (*app).fingerprint},
+	"trust":       {"USERNAME FINGERPRINT", "accept USERNAME's changed keys if they have FINGERPRINT", []int{2}, (*app).trust},
+	"rotate":      {"", "replace your public keys with a new version", []int{0}, (*app).rotate},
+}
+
+func main() {
+	a := &app{
+		stdin:    os.Stdin,
+		stdout:   os.Stdout,
+		stderr:   os.Stderr,
+		getenv:   os.Getenv,
+		password: terminalPassword,
+	}
+	os.Exit(a.main(os.Args[1:]))
+}
+
+func (a *app) usage(flags *flag.FlagSet) {
+	fmt.Fprintln(a.stderr, "usage: e2efs [-dir DIR] [-lifetime DURATION] COMMAND [ARGS]")
+	fmt.Fprintln(a.stderr)
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(a.stderr, "  %-32s %s\n", strings.TrimSpace(name+" "+commands[name].args), commands[name].help)
+	}
+	fmt.Fprintln(a.stderr)
+	flags.PrintDefaults()
+}
+
+// main runs one command and returns the exit status
+func (a *app) main(args []string) int {
+	userlib.DebugOutput = false
+	flags := flag.NewFlagSet("e2efs", flag.ContinueOnError)
+	flags.SetOutput(a.stderr)
+	flags.StringVar(&a.dir, "dir", a.defaultDir(), "directory holding the datastore, keystore and session")
+	flags.DurationVar(&a.lifetime, "lifetime", DefaultSessionLifetime, "how long a login lasts")
+	flags.Usage = func() { a.usage(flags) }
+	if flags.Parse(args) != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		a.usage(flags)
+		return 2
+	}
+	cmd, ok := commands[flags.Arg(0)]
+	args = flags.Args()[1:]
+	if !ok || !validArgs(cmd, len(args)) {
+		a.usage(flags)
+		return 2
+	}
+	closeStore, err := store{dir: a.dir}.open()
+	if err == nil {
+		err = cmd.run(a, args)
+		closeStore()
+	}
+	if err != nil {
+		fmt.Fprintln(a.stderr, "e2efs:", err)
+		return 1
+	}
+	return 0
+}
+
+func validArgs(cmd command, n int) bool {
+	for _, allowed := range cmd.nargs {
+		if n == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *app) defaultDir() string {
+	if dir := a.getenv("E2EFS_DIR"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".e2efs"
+	}
+	return filepath.Join(home, ".e2efs")
+}
+
+// user resumes the saved session, asking for the password if the device key is missing or the
+// session has ended
+func (a *app) user() (*client.User, error) {
+	username, user, err := loadSession(a.dir, a.getenv(SessionVariable))
+	if err != nil || user != nil {
+		return user, err
+	}
+	password, err := a.password("Password for " + username + ": ")
+	if err != nil {
+		return nil, err
+	}
+	return client.GetUser(username, password)
+}
+
+// startSession saves the session and prints the command that hands its device key to the shell
+func (a *app) startSession(user *client.User) error {
+	key, err := saveSession(a.dir, user, a.lifetime)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(a.stdout, "export %s=%s\n", SessionVariable, key)
+	fmt.Fprintf(a.stderr, "Logged in as %s. Run this command through eval to stay logged in.\n", user.Username)
+	return nil
+}
+
+func (a *app) initUser(args []string) error {
+	password, err := a.password("New password: ")
+	if err != nil {
+		return err
+	}
+	again, err := a.password("Repeat password: ")
+	if err != nil {
+		return err
+	}
+	if password != again {
+		return errors.New("passwords don't match")
+	}
+	user, err := client.InitUser(args[0], password)
+	if err != nil {
+		return err
+	}
+	return a.startSession(user)
+}
+
+func (a *app) login(args []string) error {
+	password, err := a.password("Password: ")
+	if err != nil {
+		return err
+	}
+	user, err := client.GetUser(args[0], password)
+	if err != nil {
+		return errors.New("wrong username or password")
+	}
+	return a.startSession(user)
+}
+
+func (a *app) logout(args []string) error {
+	if len(args) == 1 {
+		if args[0] != "-everywhere" {
+			return errors.New("unknown option " + args[0])
+		}
+		user, err := a.user()
+		if err != nil {
+			return err
+		}
+		err = user.LogoutEverywhere()
+		if err != nil {
+			return err
+		}
+	}
+	return forgetSession(a.dir)
+}
+
+// input reads the file named in args, or stdin if there is none or it is "-"
+func (a *app) input(args []string) ([]byte, error) {
+	if len(args) == 0 || args[0] == "-" {
+		return io.ReadAll(a.stdin)
+	}
+	return os.ReadFile(args[0])
+}
+
+func (a *app) put(args []string) error {
+	content, err := a.input(args[1:])
+	if err != nil {
+		return err
+	}
+	user, err := a.user()
+	if err != nil {
+		return err
+	}
+	return user.StoreFile(args[0], content)
+}
+
+func (a *app) get(args []string) error {
+	user, err := a.user()
+	if err != nil {
+		return err
+	}
+	content, err := user.LoadFile(args[0])
+	if err != nil {
+		return err
+	}
+	if len(args) == 1 || args[1] == "-" {
+		_, err = a.stdout.Write(content)
+		return err
+	}
+	return os.WriteFile(args[1], content, 0600)
+}
+
+func (a *app) append(args []string) error {
+	content, err := a.input(args[1:])
+	if err != nil {
+		return err
+	}
+	user, err := a.user()
+	if err != nil {
+		return err
+	}
+	return user.AppendToFile(args[0], content)
+}
+
+func (a *app) share(args []string) error {
+	user, err := a.user()
+	if err != nil {
+		return err
+	}
+	invitation, err := user.CreateInvitation(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(a.stdout, invitation)
+	return nil
+}
+
+func (a *app) invitations(args []string) error {
+	user, err := a.user()
+	if err != nil {
+		return err
+	}
+	pending, err := user.PendingInvitations()
+	if err != nil {
+		return err
+	}
+	for _, invite := range pending {
+		kind := "file"
+		if invite.Transfer {
+			kind = "ownership"
+		}
+		fmt.Fprintf(a.stdout, "%s\t%s\t%s\t%s\n", invite.Sender, invite.Invitation, kind, invite.Filename)
+	}
+	return nil
+}
+
+func (a *app) accept(args []string) error {
+	invitation, err := uuid.Parse(args[1])
+	if err != nil {
+		return errors.New("not an invitation: " + args[1])
+	}
+	user, err := a.user()
+	if err != nil {
+		return err
+	}
+	return user.AcceptInvitation(args[0], invitation, args[2])
+}
+
+func (a *app) revoke(args []string) error {
+	user, err := a.user()
+	if err != nil {
+		return err
+	}
+	return user.RevokeAccess(args[0], args[1])
+}
+
+func (a *app) list(args []string) error {
+	user, err := a.user()
+	if err != nil {
+		return err
+	}
+	files, err := user.ListFiles()
+	if err != nil {
+		return err
+	}
+	for _, name := range files {
+		fmt.Fprintln(a.stdout, name)
+	}
+	return nil
+}
+
+func (a *app) remove(args []string) error {
+	user, err := a.user()
+	if err != nil {
+		return err
+	}
+	return user.DeleteFile(args[0])
+}
+
+func (a *app) fingerprint(args []string) error {
+	user, err := a.user()
+	if err != nil {
+		return err
+	}
+	fingerprint, err := user.Fingerprint(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(a.stdout, fingerprint)
+	return nil
+}
+
+func (a *app) trust(args []string) error {
+	user, err := a.user()
+	if err != nil {
+		return err
+	}
+	return user.TrustKeys(args[0], args[1])
+}
+
+func (a *app) rotate(args []string) error {
+	user, err := a.user()
+	if err != nil {
+		return err
+	}
+	return user.RotateKeys()
+}
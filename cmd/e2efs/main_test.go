@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// shell runs e2efs commands against one directory the way a user would from a shell, keeping
+// the session key from the last login in its environment.
+type shell struct {
+	t       *testing.T
+	dir     string
+	env     map[string]string
+	prompts int
+}
+
+func (sh *shell) run(stdin string, args ...string) (string, int) {
+	var stdout, stderr bytes.Buffer
+	a := &app{
+		stdin:  strings.NewReader(stdin),
+		stdout: &stdout,
+		stderr: &stderr,
+		getenv: func(name string) string { return sh.env[name] },
+		password: func(prompt string) (string, error) {
+			sh.prompts++
+			return "password12345", nil
+		},
+	}
+	status := a.main(append([]string{"-dir", sh.dir}, args...))
+	if status == 0 {
+		if export := strings.TrimPrefix(stdout.String(), "export "+SessionVariable+"="); export != stdout.String() {
+			sh.env[SessionVariable] = strings.TrimSpace(export)
+		}
+	}
+	return stdout.String(), status
+}
+
+func (sh *shell) must(stdin string, args ...string) string {
+	out, status := sh.run(stdin, args...)
+	if status != 0 {
+		sh.t.Fatalf("e2efs %s: exit status %d", strings.Join(args, " "), status)
+	}
+	return out
+}
+
+func TestCommands(t *testing.T) {
+	sh := &shell{t: t, dir: t.TempDir(), env: map[string]string{}}
+
+	sh.must("", "init", "alice")
+	sh.must("Bitcoin is Nick's favorite ", "put", "notes.txt")
+	sh.must("digital cryptocurrency!", "append", "notes.txt", "-")
+	if out := sh.must("", "get", "notes.txt"); out != "Bitcoin is Nick's favorite digital cryptocurrency!" {
+		t.Fatalf("get returned %q", out)
+	}
+	local := filepath.Join(t.TempDir(), "local.txt")
+	err := os.WriteFile(local, []byte("from a file"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh.must("", "put", "other.txt", local)
+	if out := sh.must("", "ls"); out != "notes.txt\nother.txt\n" {
+		t.Fatalf("ls returned %q", out)
+	}
+
+	// the session key saves typing the password again, and nothing works without the session
+	prompts := sh.prompts
+	sh.must("", "get", "other.txt")
+	if sh.prompts != prompts {
+		t.Fatal("asked for the password despite the session")
+	}
+	sh.env[SessionVariable] = ""
+	sh.must("", "get", "other.txt")
+	if sh.prompts != prompts+1 {
+		t.Fatal("didn't ask for the password without the session key")
+	}
+	sh.must("", "logout")
+	if _, status := sh.run("", "ls"); status == 0 {
+		t.Fatal("ls worked after logging out")
+	}
+	if _, status := sh.run("", "init", "alice"); status == 0 {
+		t.Fatal("created alice twice")
+	}
+
+	sh.must("", "init", "bob")
+	sh.must("", "login", "alice")
+	invitation := strings.TrimSpace(sh.must("", "share", "notes.txt", "bob"))
+	fingerprint := sh.must("", "fingerprint", "alice")
+
+	sh.must("", "rotate")
+
+	sh.must("", "login", "bob")
+	if out := sh.must("", "fingerprint", "alice"); out != fingerprint {
+		t.Fatalf("bob sees fingerprint %q for alice, who sees %q", out, fingerprint)
+	}
+	if out := sh.must("", "invitations"); !strings.Contains(out, invitation) {
+		t.Fatalf("invitations returned %q", out)
+	}
+	sh.must("", "accept", "alice", invitation, "shared.txt")
+	sh.must(" Bob was here.", "append", "shared.txt")
+	if out := sh.must("", "ls"); out != "shared.txt\n" {
+		t.Fatalf("ls returned %q", out)
+	}
+
+	sh.must("", "login", "alice")
+	if out := sh.must("", "get", "notes.txt"); !strings.HasSuffix(out, "Bob was here.") {
+		t.Fatalf("get returned %q", out)
+	}
+	if _, status := sh.run("", "rm", "notes.txt"); status == 0 {
+		t.Fatal("deleted a file that is still shared")
+	}
+	sh.must("", "revoke", "notes.txt", "bob")
+	sh.must("", "rm", "notes.txt")
+	if out := sh.must("", "ls"); out != "other.txt\n" {
+		t.Fatalf("ls returned %q", out)
+	}
+
+	sh.must("", "login", "bob")
+	if _, status := sh.run("", "get", "shared.txt"); status == 0 {
+		t.Fatal("bob still reads the file after being revoked")
+	}
+	if out := sh.must("", "ls"); out != "" {
+		t.Fatalf("ls returned %q", out)
+	}
+}
+
+func TestSessionEnds(t *testing.T) {
+	sh := &shell{t: t, dir: t.TempDir(), env: map[string]string{}}
+	sh.must("", "-lifetime", "1ms", "init", "alice")
+	time.Sleep(5 * time.Millisecond)
+	prompts := sh.prompts
+	sh.must("", "ls")
+	if sh.prompts != prompts+1 {
+		t.Fatal("an expired session didn't ask for the password")
+	}
+
+	// a copy of the session stops working once the user logs out everywhere
+	sh.must("", "login", "alice")
+	saved := map[string][]byte{}
+	for _, name := range []string{"session", "user"} {
+		saved[name], _ = os.ReadFile(filepath.Join(sh.dir, name))
+	}
+	prompts = sh.prompts
+	sh.must("", "ls")
+	if sh.prompts != prompts {
+		t.Fatal("asked for the password despite the session")
+	}
+	sh.must("", "logout", "-everywhere")
+	for name, content := range saved {
+		err := os.WriteFile(filepath.Join(sh.dir, name), content, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sh.must("", "ls")
+	if sh.prompts != prompts+1 {
+		t.Fatal("a session resumed after logging out everywhere")
+	}
+}
+
+func TestLockedDirectory(t *testing.T) {
+	sh := &shell{t: t, dir: t.TempDir(), env: map[string]string{}}
+	sh.must("", "init", "alice")
+	err := os.WriteFile(filepath.Join(sh.dir, "lock"), nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, status := sh.run("", "ls"); status == 0 {
+		t.Fatal("ran a command while the directory was locked")
+	}
+}
+
+func TestKeylogRollback(t *testing.T) {
+	sh := &shell{t: t, dir: t.TempDir(), env: map[string]string{}}
+	sh.must("", "init", "bob")
+	before, err := os.ReadFile(filepath.Join(sh.dir, "keylog"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh.must("", "init", "alice")
+	sh.must("hello", "put", "notes.txt")
+	sh.must("", "share", "notes.txt", "bob")
+
+	// the log in the directory goes back to before alice registered
+	err = os.WriteFile(filepath.Join(sh.dir, "keylog"), before, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, status := sh.run("", "share", "notes.txt", "bob"); status == 0 {
+		t.Fatal("shared with a key log that lost entries")
+	}
+}
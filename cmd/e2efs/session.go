@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+
+	"github.com/cs161-staff/project2-starter-code/client"
+)
+
+// login remembers the user so later commands don't ask for the password again. The session is
+// exported with client.ExportSession under a random device key, and kept in the directory next
+// to the name of the user, while the device key is handed to the shell in SessionVariable.
+// Neither half is any use without the other: copying the file doesn't give away the session,
+// and a shell without the variable is asked for the password instead. Sessions expire after
+// the lifetime given to login, and logout -everywhere ends the ones on every other machine too.
+
+// SessionVariable is the environment variable holding the device key printed by login.
+const SessionVariable = "E2EFS_SESSION"
+
+// DefaultSessionLifetime is how long a login lasts unless -lifetime says otherwise.
+const DefaultSessionLifetime = 12 * time.Hour
+
+func sessionPath(dir string) string {
+	return filepath.Join(dir, "session")
+}
+
+func usernamePath(dir string) string {
+	return filepath.Join(dir, "user")
+}
+
+// saveSession exports the session and returns the device key needed to resume it
+func saveSession(dir string, user *client.User, lifetime time.Duration) (string, error) {
+	key := userlib.RandomBytes(32)
+	err := user.ExportSession(sessionPath(dir), key, lifetime)
+	if err != nil {
+		return "", err
+	}
+	err = writeFile(usernamePath(dir), []byte(user.Username))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// loadSession resumes the saved session. If key can't open it, only the username is returned.
+func loadSession(dir string, key string) (string, *client.User, error) {
+	username, err := os.ReadFile(usernamePath(dir))
+	if err != nil || len(username) == 0 {
+		return "", nil, errors.New("not logged in; run e2efs login USERNAME first")
+	}
+	keyBytes, err := hex.DecodeString(key)
+	if err != nil || len(keyBytes) != 32 {
+		return string(username), nil, nil
+	}
+	user, err := client.ResumeSession(sessionPath(dir), keyBytes)
+	if err != nil || user.Username != string(username) {
+		return string(username), nil, nil
+	}
+	return string(username), user, nil
+}
+
+// forgetSession deletes the saved session
+func forgetSession(dir string) error {
+	for _, path := range []string{sessionPath(dir), usernamePath(dir)} {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// terminalPassword asks for a password on the terminal if there is one, and on stdin otherwise
+func terminalPassword(prompt string) (string, error) {
+	var input io.Reader = os.Stdin
+	var output io.Writer = os.Stderr
+	if tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0); err == nil {
+		defer tty.Close()
+		input, output = tty, tty
+	}
+	fmt.Fprint(output, prompt)
+	line, err := bufio.NewReader(input).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", errors.New("no password given")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+
+	"github.com/cs161-staff/project2-starter-code/client"
+)
+
+// The userlib Datastore and Keystore only live in memory, so e2efs swaps them for a directory:
+// every Datastore entry is a file named after its UUID, and every Keystore entry a JSON file
+// named after the hex of its key. Both are public by design, since the client encrypts and MACs
+// everything it stores, so the directory can just as well be synced or shared between users.
+//
+// The key transparency log is a client.LocalKeyLog whose entries are kept in one JSON file and
+// written back when a command adds to it, so the directory stands in for the log server too.
+//
+// A command holds a lock on the directory from start to finish, which makes the client's
+// compare-and-swap atomic across processes too.
+
+type store struct {
+	dir string
+}
+
+func (s store) datastorePath(key userlib.UUID) string {
+	return filepath.Join(s.dir, "datastore", key.String())
+}
+
+func (s store) keystorePath(key string) string {
+	return filepath.Join(s.dir, "keystore", hex.EncodeToString([]byte(key)))
+}
+
+// open creates the directory if needed, takes the lock and installs the store in place of the
+// userlib Datastore and Keystore and the client's key log. The returned function saves the log
+// and releases the lock.
+func (s store) open() (func(), error) {
+	for _, sub := range []string{"datastore", "keystore"} {
+		err := os.MkdirAll(filepath.Join(s.dir, sub), 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+	lockPath := filepath.Join(s.dir, "lock")
+	lock, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, fmt.Errorf("%s is locked by another e2efs command; remove %s if none is running",
+				s.dir, lockPath)
+		}
+		return nil, err
+	}
+	lock.Close()
+
+	var entries [][]byte
+	entriesBytes, err := os.ReadFile(s.keylogPath())
+	if err == nil {
+		err = json.Unmarshal(entriesBytes, &entries)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		os.Remove(lockPath)
+		return nil, fmt.Errorf("reading key log: %v", err)
+	}
+	keylog := client.NewLocalKeyLog(entries)
+
+	userlib.DatastoreGet = s.get
+	userlib.DatastoreSet = s.set
+	userlib.DatastoreDelete = s.delete
+	userlib.KeystoreGet = s.keystoreGet
+	userlib.KeystoreSet = s.keystoreSet
+	client.KeyTransparencyLog = keylog
+	return func() {
+		if grown := keylog.Entries(); len(grown) > len(entries) {
+			s.saveKeylog(grown)
+		}
+		os.Remove(lockPath)
+	}, nil
+}
+
+func (s store) keylogPath() string {
+	return filepath.Join(s.dir, "keylog")
+}
+
+func (s store) saveKeylog(entries [][]byte) {
+	entriesBytes, err := json.Marshal(entries)
+	if err == nil {
+		err = writeFile(s.keylogPath(), entriesBytes)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "e2efs: writing key log:", err)
+	}
+}
+
+// writeFile replaces a file in one step, so a command that dies halfway never leaves a torn entry
+func writeFile(path string, value []byte) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(value)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+	}
+	return err
+}
+
+func (s store) get(key userlib.UUID) ([]byte, bool) {
+	value, err := os.ReadFile(s.datastorePath(key))
+	if err != nil {
+		return nil, false
+	}
+	return value, true
+}
+
+// the userlib Datastore has no way to report a failed write, so neither does this one; the
+// client notices the missing entry when it next reads it
+func (s store) set(key userlib.UUID, value []byte) {
+	err := writeFile(s.datastorePath(key), value)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "e2efs: writing datastore:", err)
+	}
+}
+
+func (s store) delete(key userlib.UUID) {
+	os.Remove(s.datastorePath(key))
+}
+
+func (s store) keystoreGet(key string) (userlib.PublicKeyType, bool) {
+	var value userlib.PublicKeyType
+	valueBytes, err := os.ReadFile(s.keystorePath(key))
+	if err != nil {
+		return value, false
+	}
+	err = json.Unmarshal(valueBytes, &value)
+	if err != nil {
+		return value, false
+	}
+	return value, true
+}
+
+func (s store) keystoreSet(key string, value userlib.PublicKeyType) error {
+	if _, ok := s.keystoreGet(key); ok {
+		return errors.New("entry in keystore has been taken")
+	}
+	valueBytes, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return writeFile(s.keystorePath(key), valueBytes)
+}